@@ -0,0 +1,482 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+	"github.com/pquerna/otp/totp"
+)
+
+// Accounts can enable two-factor authentication using an authenticator app (RFC 6238 TOTP).
+// Enrolment starts with POST /accounts/@name/2fa, which returns the secret as a provisioning
+// URI and QR code. It is enabled once a code from the app is confirmed, and recovery codes
+// are returned. Accounts with two-factor authentication must send a code from the app (or an
+// unused recovery code) in the X-AUTH-OTP header along with their password. A recovery code
+// can only be used for one request (eg. to disable two-factor authentication).
+
+// totpIssuer is the name displayed by authenticator apps.
+const totpIssuer = "Lemma Chain"
+
+// recoveryCodeCount is the number of recovery codes issued.
+const recoveryCodeCount = 10
+
+type otpInput struct {
+	Code string `json:"code" form:"code"`
+}
+
+// totpPeriod is the number of seconds that a code from an authenticator app is valid for.
+const totpPeriod = 30
+
+// totpStep returns the time step of a valid code from an authenticator app. As with
+// totp.Validate, one step of clock drift is permitted. 0 is returned if the code is not valid.
+func totpStep(code, secret string, now time.Time) int64 {
+
+	step := now.Unix() / totpPeriod
+
+	for _, s := range []int64{step - 1, step, step + 1} {
+		expected, err := totp.GenerateCode(secret, time.Unix(s*totpPeriod, 0))
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return s
+		}
+	}
+
+	return 0
+}
+
+// checkSecondFactor checks a code from an authenticator app or a recovery code. A code from
+// the app can't be used again (nor can earlier codes) and a recovery code can only be used
+// once. The account is read and updated within one txn, so concurrent requests using the same
+// code conflict and only one of them succeeds.
+func checkSecondFactor(ctx context.Context, uid, secret, code string) (bool, error) {
+
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			user(func: uid($uid)) {
+				user.totp_last_step
+				user.recovery_codes
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return false, err
+	}
+
+	type Root struct {
+		User []struct {
+			LastStep      *int64   `json:"user.totp_last_step"`
+			RecoveryCodes []string `json:"user.recovery_codes"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return false, err
+	}
+
+	if len(root.User) == 0 {
+		return false, nil
+	}
+	user := root.User[0]
+
+	var mu *api.Mutation
+
+	if step := totpStep(code, secret, time.Now()); step > 0 {
+		if user.LastStep != nil && step <= *user.LastStep {
+			// The code has already been used
+			return false, nil
+		}
+
+		mu = &api.Mutation{SetJson: marshal(map[string]interface{}{
+			"uid":                 uid,
+			"user.totp_last_step": step,
+		})}
+	} else {
+		hashed := hashRecoveryCode(code)
+		for _, rc := range user.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(rc), []byte(hashed)) == 1 {
+				mu = &api.Mutation{DeleteJson: marshal(map[string]interface{}{
+					"uid":                 uid,
+					"user.recovery_codes": rc,
+				})}
+				break
+			}
+		}
+	}
+
+	if mu == nil {
+		return false, nil
+	}
+
+	_, err = txn.Mutate(ctx, mu)
+	if err != nil {
+		return false, err
+	}
+
+	err = txn.Commit(ctx)
+	if err == dgo.ErrAborted {
+		// A concurrent request used the code
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// newRecoveryCodes returns recovery codes (eg. "k7d2m-q9x4p") and their hashes.
+func newRecoveryCodes() ([]string, []string, error) {
+
+	codes := []string{}
+	hashes := []string{}
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash of a recovery code. Recovery codes are not case-sensitive
+// and the dash is optional.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadTwoFactor fetches the two-factor state of an account.
+func loadTwoFactor(ctx context.Context, uid string) (secret, pending *string, err error) {
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			user(func: uid($uid)) {
+				user.totp_secret
+				user.totp_pending_secret
+			}
+		}
+	`
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type Root struct {
+		User []struct {
+			Secret        *string `json:"user.totp_secret"`
+			PendingSecret *string `json:"user.totp_pending_secret"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(root.User) == 0 {
+		return nil, nil, nil
+	}
+
+	return root.User[0].Secret, root.User[0].PendingSecret, nil
+}
+
+// enrolTwoFactorHandler starts enabling two-factor authentication. It returns a new secret
+// that must be confirmed with a code (see confirmTwoFactorHandler).
+func enrolTwoFactorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "two-factor authentication")
+	if !ok {
+		return err
+	}
+
+	secret, _, err := loadTwoFactor(ctx, uid)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if secret != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("two-factor authentication is already enabled"))
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "@" + c.Get("logged-in-user").(string)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	img, err := key.Image(256, 256)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	var qr bytes.Buffer
+	err = png.Encode(&qr, img)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	data := struct {
+		UID           string `json:"uid"`
+		PendingSecret string `json:"user.totp_pending_secret"`
+	}{
+		uid,
+		key.Secret(),
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	out := map[string]interface{}{
+		"secret":  key.Secret(),
+		"uri":     key.URL(),
+		"qr_code": "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()),
+	}
+
+	return c.JSONPretty(http.StatusOK, out, "  ")
+}
+
+// confirmTwoFactorHandler enables two-factor authentication once a code generated from the
+// new secret is provided. The recovery codes are returned (only once).
+func confirmTwoFactorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "two-factor authentication")
+	if !ok {
+		return err
+	}
+
+	input := new(otpInput)
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	secret, pending, err := loadTwoFactor(ctx, uid)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if secret != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("two-factor authentication is already enabled"))
+	}
+
+	if pending == nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("two-factor authentication has not been started"))
+	}
+
+	if !totp.Validate(strings.TrimSpace(input.Code), *pending) {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("code is incorrect"))
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	del := map[string]interface{}{
+		"uid":                      uid,
+		"user.totp_pending_secret": nil,
+		"user.recovery_codes":      nil,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(del)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	data := struct {
+		UID           string   `json:"uid"`
+		Secret        string   `json:"user.totp_secret"`
+		RecoveryCodes []string `json:"user.recovery_codes"`
+	}{
+		uid,
+		*pending,
+		hashes,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	// Password-only logins must not be used anymore
+	revokeLogins(uid)
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"recovery_codes": codes}, "  ")
+}
+
+// recoveryCodesHandler replaces the recovery codes of an account with new ones.
+func recoveryCodesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "two-factor authentication")
+	if !ok {
+		return err
+	}
+
+	secret, _, err := loadTwoFactor(ctx, uid)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if secret == nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("two-factor authentication is not enabled"))
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	del := map[string]interface{}{
+		"uid":                 uid,
+		"user.recovery_codes": nil,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(del)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	data := struct {
+		UID           string   `json:"uid"`
+		RecoveryCodes []string `json:"user.recovery_codes"`
+	}{
+		uid,
+		hashes,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"recovery_codes": codes}, "  ")
+}
+
+// disableTwoFactorHandler disables two-factor authentication. Since the request must be
+// logged in, a code has already been checked.
+func disableTwoFactorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "two-factor authentication")
+	if !ok {
+		return err
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	del := map[string]interface{}{
+		"uid":                      uid,
+		"user.totp_secret":         nil,
+		"user.totp_pending_secret": nil,
+		"user.totp_last_step":      nil,
+		"user.recovery_codes":      nil,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(del)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	revokeLogins(uid)
+
+	return c.NoContent(http.StatusOK)
+}
@@ -6,8 +6,7 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"hash/crc32"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
@@ -16,7 +15,6 @@ import (
 
 	"github.com/dgraph-io/dgo/protos/api"
 	"github.com/labstack/echo"
-	"github.com/myesui/uuid"
 )
 
 type account struct {
@@ -76,33 +74,13 @@ func createAccountHandler(c echo.Context) error {
 	// Email:
 	u.Email = strings.ToLower(u.Email)
 
-	if u.Email == "" {
-		return c.JSON(http.StatusBadRequest, ErrorFmt("email must not be empty"))
-	}
-
-	if !strings.Contains(u.Email, "@") {
-		return c.JSON(http.StatusBadRequest, ErrorFmt("email must be valid and non-disposable"))
-	}
-
-	if len(u.Email) > 50 {
-		return c.JSON(http.StatusBadRequest, ErrorFmt("email must be less than 50 characters"))
-	}
-
-	if !checkEmail(u.Email) {
-		return c.JSON(http.StatusBadRequest, ErrorFmt("email must be valid and non-disposable"))
+	if err := validateEmail(u.Email); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
 	}
 
 	// Password:
-	if u.Password1 == "" {
-		return c.JSON(http.StatusBadRequest, ErrorFmt("password must not be empty"))
-	}
-
-	if len(u.Password1) < 6 {
-		return c.JSON(http.StatusBadRequest, ErrorFmt("password must contain more than 5 characters"))
-	}
-
-	if u.Password1 != u.Password2 {
-		return c.JSON(http.StatusBadRequest, ErrorFmt("passwords must match"))
+	if err := validatePassword(u.Password1, u.Password2, []string{u.Name, u.Email}); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
 	}
 
 	err := recaptchaCheck(u.RecaptchaCode)
@@ -160,27 +138,32 @@ func createAccountHandler(c echo.Context) error {
 
 	// Save User
 
-	activationCode := fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(uuid.NewV4().String())))
-	activate := false
-
-	if strings.TrimSpace(gmailAccount) == "" && strings.TrimSpace(gmailPassword) == "" {
-		activate = true
+	activationCode, codeExpiresAt, err := newVerificationCode()
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 	}
+	// Accounts are automatically activated if activation emails can't be sent
+	activate := !emailConfigured()
 
 	data := struct {
-		User      bool      `json:"user"`
-		Name      string    `json:"user.name"`
-		Email     string    `json:"user.email"`
-		Password  string    `json:"user.password"`
-		Code      string    `json:"user.code"`
-		CreatedAt time.Time `json:"user.created_at"`
-		Validated bool      `json:"user.validated"`
+		User          bool      `json:"user"`
+		Name          string    `json:"user.name"`
+		Email         string    `json:"user.email"`
+		Password      string    `json:"user.password"`
+		Code          string    `json:"user.code"`
+		CodeExpiresAt time.Time `json:"user.code_expires_at"`
+		CodeSentAt    time.Time `json:"user.code_sent_at"`
+		CreatedAt     time.Time `json:"user.created_at"`
+		Validated     bool      `json:"user.validated"`
 	}{
 		true,
 		u.Name,
 		u.Email,
 		u.Password1,
 		activationCode,
+		codeExpiresAt,
+		time.Now().UTC(),
 		time.Now().UTC(),
 		activate,
 	}
@@ -205,6 +188,10 @@ func createAccountHandler(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 	}
 
+	if activate {
+		suggestAccount(u.Name)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -3223,3 +3210,25 @@ var badDomains = map[string]struct{}{
 	"zzi.us":                                 struct{}{},
 	"zzz.com":                                struct{}{},
 }
+
+// validateEmail checks that a (lower-cased) email address can be used for an account.
+func validateEmail(email string) error {
+
+	if email == "" {
+		return errors.New("email must not be empty")
+	}
+
+	if !strings.Contains(email, "@") {
+		return errors.New("email must be valid and non-disposable")
+	}
+
+	if len(email) > 50 {
+		return errors.New("email must be less than 50 characters")
+	}
+
+	if !checkEmail(email) {
+		return errors.New("email must be valid and non-disposable")
+	}
+
+	return nil
+}
@@ -0,0 +1,449 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// When an account is deleted, its email address, password, profile and saved searches are
+// removed. The account's name is kept so that it can't be taken by someone else. The
+// account's refs are either:
+//
+//	orphan      the refs become anonymous refs. Their old ids (@name/hashid) still work.
+//	tombstone   the content of the refs is removed. Their ids and links to other refs are
+//	            kept so that chains through them are not broken.
+//
+// Schemas created by the account are kept because refs of other accounts may use them.
+
+// deleteAccountHandler deletes the logged in account.
+func deleteAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "deleting an account")
+	if !ok {
+		return err
+	}
+	name := c.Get("logged-in-user").(string)
+
+	mode := c.QueryParam("refs")
+	if mode != "orphan" && mode != "tombstone" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("refs query param must be orphan or tombstone"))
+	}
+
+	err = removeAccount(ctx, uid, name, mode)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// removeAccount deletes an account. mode is orphan or tombstone.
+func removeAccount(ctx context.Context, uid, name, mode string) error {
+
+	update := orphanRefs
+	if mode == "tombstone" {
+		update = tombstoneRefs
+	}
+
+	// Refs are updated a page at a time. If a page fails, the deletion can be retried.
+	after := "0x0"
+	for {
+		uids, err := ownedRefs(ctx, dg.NewReadOnlyTxn(), uid, after)
+		if err != nil {
+			return err
+		}
+
+		if len(uids) == 0 {
+			break
+		}
+
+		err = update(ctx, name, uids)
+		if err != nil {
+			return err
+		}
+
+		err = indexSearchRefs(ctx, uids)
+		if err != nil {
+			log.Println(err)
+		}
+
+		if mode == "tombstone" {
+			// Tombstoned refs are still owned by the account
+			after = uids[len(uids)-1]
+		}
+	}
+
+	err := deleteAccount(ctx, uid)
+	if err != nil {
+		return err
+	}
+
+	revokeLogins(uid)
+	suggestions.removeAccount("@" + name)
+
+	return nil
+}
+
+// orphanRefs removes the owner of refs. The old id of each ref is stored as its alias so that
+// it can still be found (see lookupRef).
+func orphanRefs(ctx context.Context, name string, uids []string) error {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	q := `
+		{
+			refs(func: uid(%s)) {
+				uid
+				node.hashid
+				node.alias
+				node.owner {
+					uid
+				}
+			}
+		}
+	`
+
+	resp, err := txn.Query(ctx, fmt.Sprintf(q, strings.Join(uids, ", ")))
+	if err != nil {
+		return err
+	}
+
+	type Root struct {
+		Refs []struct {
+			UID    string  `json:"uid"`
+			HashID string  `json:"node.hashid"`
+			Alias  *string `json:"node.alias"`
+			Owner  []struct {
+				UID string `json:"uid"`
+			} `json:"node.owner"`
+		} `json:"refs"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	dels := []map[string]interface{}{}
+	sets := []map[string]interface{}{}
+
+	for _, r := range root.Refs {
+		if len(r.Owner) == 0 {
+			continue
+		}
+
+		dels = append(dels, map[string]interface{}{
+			"uid":        r.UID,
+			"node.owner": map[string]string{"uid": r.Owner[0].UID},
+		})
+
+		if r.Alias == nil {
+			// Refs imported from another instance keep their original id
+			sets = append(sets, map[string]interface{}{
+				"uid":        r.UID,
+				"node.alias": "@" + name + "/" + r.HashID,
+			})
+		}
+	}
+
+	if len(dels) == 0 {
+		return nil
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(dels)})
+	if err != nil {
+		return err
+	}
+
+	if len(sets) > 0 {
+		_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(sets)})
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit(ctx)
+}
+
+// tombstoneRefs removes the content of refs and removes them from the suggest index. Files that
+// are no longer attached to any ref are removed from the blob store.
+func tombstoneRefs(ctx context.Context, name string, uids []string) error {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	q := `
+		{
+			refs(func: uid(%s)) {
+				uid
+				node.hashid
+				node.owner {
+					user.name
+				}
+				node.attachment {
+					uid
+					attachment.sha256
+				}
+			}
+		}
+	`
+
+	resp, err := txn.Query(ctx, fmt.Sprintf(q, strings.Join(uids, ", ")))
+	if err != nil {
+		return err
+	}
+
+	type Root struct {
+		Refs []struct {
+			UID         string       `json:"uid"`
+			HashID      string       `json:"node.hashid"`
+			Owner       []OwnerModel `json:"node.owner"`
+			Attachments []struct {
+				UID    string `json:"uid"`
+				SHA256 string `json:"attachment.sha256"`
+			} `json:"node.attachment"`
+		} `json:"refs"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	// The content of a ref
+	content := []string{
+		"node.search_title",
+		"node.search_synopsis",
+		"node.lang",
+		"node.content_hash",
+		"node.timestamp",
+		"node.timestamp_token",
+		"node.attachment",
+		"node.schema",
+	}
+	for _, f := range xdataFields {
+		content = append(content, f.predicate())
+	}
+
+	now := time.Now().UTC()
+	dels := []map[string]interface{}{}
+	sets := []map[string]interface{}{}
+	hashes := []string{}
+
+	for _, r := range root.Refs {
+		del := map[string]interface{}{"uid": r.UID}
+		for _, pred := range content {
+			del[pred] = nil
+		}
+		dels = append(dels, del)
+
+		for _, a := range r.Attachments {
+			dels = append(dels, map[string]interface{}{"uid": a.UID})
+			hashes = append(hashes, a.SHA256)
+		}
+
+		// The data payload is replaced rather than removed because refs must have one
+		sets = append(sets, map[string]interface{}{
+			"uid":                r.UID,
+			"node.xdata":         "{}",
+			"node.searchable":    false,
+			"node.tombstoned_at": now,
+		})
+	}
+
+	if len(dels) == 0 {
+		return nil
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(dels)})
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(sets)})
+	if err != nil {
+		return err
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range root.Refs {
+		id := r.HashID
+		if len(r.Owner) > 0 {
+			id = "@" + r.Owner[0].Name + "/" + id
+		}
+		suggestions.remove(id)
+	}
+
+	return deleteUnusedBlobs(ctx, hashes)
+}
+
+// deleteUnusedBlobs removes files from the blob store that are not attached to any ref.
+// Blobs are not stored while it runs (see blobsMu).
+func deleteUnusedBlobs(ctx context.Context, hashes []string) error {
+
+	blobsMu.Lock()
+	defer blobsMu.Unlock()
+
+	// The transaction starts after the lock is acquired so that it sees every ref
+	// committed by an upload that held the lock
+	txn := dg.NewReadOnlyTxn()
+
+	for _, hash := range hashes {
+		vars := map[string]string{
+			"$hash": hash,
+		}
+
+		const q = `
+			query withvar($hash: string) {
+				files(func: eq(attachment.sha256, $hash), first: 1) {
+					uid
+				}
+			}
+		`
+
+		resp, err := txn.QueryWithVars(ctx, q, vars)
+		if err != nil {
+			return err
+		}
+
+		type Root struct {
+			Files []struct {
+				UID string `json:"uid"`
+			} `json:"files"`
+		}
+
+		var root Root
+		err = json.Unmarshal(resp.Json, &root)
+		if err != nil {
+			return err
+		}
+
+		if len(root.Files) == 0 {
+			err = blobs.Delete(hash)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteAccount removes the personal data of an account: its email address, password,
+// profile, saved searches and feed.
+func deleteAccount(ctx context.Context, uid string) error {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			user(func: uid($uid)) {
+				~saved_search.owner {
+					uid
+				}
+				~feed_item.owner {
+					uid
+				}
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return err
+	}
+
+	type node struct {
+		UID string `json:"uid"`
+	}
+
+	type Root struct {
+		User []struct {
+			Searches  []node `json:"~saved_search.owner"`
+			FeedItems []node `json:"~feed_item.owner"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	dels := []interface{}{
+		map[string]interface{}{
+			"uid":                      uid,
+			"user.email":               nil,
+			"user.password":            nil,
+			"user.code":                nil,
+			"user.code_expires_at":     nil,
+			"user.code_sent_at":        nil,
+			"user.pending_email":       nil,
+			"user.totp_secret":         nil,
+			"user.totp_last_step":      nil,
+			"user.recovery_codes":      nil,
+			"user.totp_pending_secret": nil,
+			"user.display_name":        nil,
+			"user.bio":                 nil,
+			"user.affiliation":         nil,
+			"user.orcid":               nil,
+			"user.homepage":            nil,
+			"user.avatar":              nil,
+		},
+	}
+
+	if len(root.User) > 0 {
+		for _, n := range root.User[0].Searches {
+			dels = append(dels, n)
+		}
+		for _, n := range root.User[0].FeedItems {
+			dels = append(dels, n)
+		}
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(dels)})
+	if err != nil {
+		return err
+	}
+
+	data := struct {
+		UID       string    `json:"uid"`
+		DeletedAt time.Time `json:"user.deleted_at"`
+	}{
+		uid,
+		time.Now().UTC(),
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit(ctx)
+}
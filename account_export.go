@@ -0,0 +1,282 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/labstack/echo"
+)
+
+// An account export is a zip file containing:
+//
+//	profile.json          the account, its saved searches and its schemas
+//	refs/<hashid>.json    each ref owned by the account in the bundle format (see bundleRef)
+
+// exportPageSize is the number of refs fetched at a time.
+const exportPageSize = 500
+
+type accountExport struct {
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	accountProfile
+	SavedSearches []savedSearch   `json:"saved_searches"`
+	Schemas       []accountSchema `json:"schemas"`
+	ExportedAt    time.Time       `json:"exported_at"`
+}
+
+type accountSchema struct {
+	ID         string    `json:"id"`
+	Definition string    `json:"definition"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// exportAccountHandler streams a zip file of all the data of the logged in account.
+func exportAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "exporting an account")
+	if !ok {
+		return err
+	}
+
+	txn := dg.NewReadOnlyTxn()
+
+	profile, err := loadAccountExport(ctx, txn, uid)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/zip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"%s.export.zip\"", profile.Name))
+	res.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(res)
+
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		// Client has gone away
+		return nil
+	}
+
+	after := "0x0"
+	for {
+		uids, err := ownedRefs(ctx, txn, uid, after)
+		if err != nil {
+			// The response has already started
+			log.Println(err)
+			return nil
+		}
+
+		if len(uids) == 0 {
+			break
+		}
+
+		refs, err := loadBundleRefs(ctx, txn, uids)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+
+		for _, refUID := range uids {
+			br, exists := refs[refUID]
+			if !exists {
+				continue
+			}
+
+			hashID := br.ID[strings.LastIndex(br.ID, "/")+1:]
+			if err := writeZipJSON(zw, "refs/"+hashID+".json", br); err != nil {
+				return nil
+			}
+		}
+
+		if err := zw.Flush(); err != nil {
+			return nil
+		}
+		res.Flush()
+
+		after = uids[len(uids)-1]
+	}
+
+	return zw.Close()
+}
+
+// writeZipJSON adds a json file to a zip file.
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// ownedRefs returns the uids of a page of refs owned by an account. The page starts after the
+// provided uid.
+func ownedRefs(ctx context.Context, txn *dgo.Txn, uid, after string) ([]string, error) {
+
+	q := `
+		{
+			owner(func: uid(%s)) {
+				~node.owner(first: %d, after: %s) {
+					uid
+				}
+			}
+		}
+	`
+
+	resp, err := txn.Query(ctx, fmt.Sprintf(q, uid, exportPageSize, after))
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Owner []struct {
+			Refs []struct {
+				UID string `json:"uid"`
+			} `json:"~node.owner"`
+		} `json:"owner"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := []string{}
+	if len(root.Owner) > 0 {
+		for _, r := range root.Owner[0].Refs {
+			uids = append(uids, r.UID)
+		}
+	}
+
+	return uids, nil
+}
+
+// loadAccountExport fetches the profile of an account.
+func loadAccountExport(ctx context.Context, txn *dgo.Txn, uid string) (*accountExport, error) {
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			user(func: uid($uid)) {
+				user.name
+				user.email
+				user.created_at
+				` + accountProfileFields + `
+
+				~saved_search.owner(orderasc: saved_search.created_at) {
+					uid
+					saved_search.name
+					saved_search.query
+					saved_search.notify
+					saved_search.webhook
+					saved_search.created_at
+				}
+
+				~schema.owner(orderasc: schema.name) {
+					schema.name
+					schema.definition
+					schema.created_at
+				}
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		User []struct {
+			Name      string    `json:"user.name"`
+			Email     string    `json:"user.email"`
+			CreatedAt time.Time `json:"user.created_at"`
+			accountProfile
+			Searches []struct {
+				UID       string    `json:"uid"`
+				Name      string    `json:"saved_search.name"`
+				Query     string    `json:"saved_search.query"`
+				Notify    string    `json:"saved_search.notify"`
+				Webhook   *string   `json:"saved_search.webhook"`
+				CreatedAt time.Time `json:"saved_search.created_at"`
+			} `json:"~saved_search.owner"`
+			Schemas []struct {
+				Name       string    `json:"schema.name"`
+				Definition string    `json:"schema.definition"`
+				CreatedAt  time.Time `json:"schema.created_at"`
+			} `json:"~schema.owner"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root.User) == 0 {
+		return nil, fmt.Errorf("account not found: %s", uid)
+	}
+	u := root.User[0]
+
+	out := &accountExport{
+		Name:           u.Name,
+		Email:          u.Email,
+		CreatedAt:      u.CreatedAt,
+		accountProfile: u.accountProfile,
+		SavedSearches:  []savedSearch{},
+		Schemas:        []accountSchema{},
+		ExportedAt:     time.Now().UTC(),
+	}
+
+	for _, s := range u.Searches {
+		id, err := h.EncodeHex(s.UID[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		out.SavedSearches = append(out.SavedSearches, savedSearch{
+			ID:        id,
+			Name:      s.Name,
+			Query:     s.Query,
+			Notify:    s.Notify,
+			Webhook:   s.Webhook,
+			CreatedAt: s.CreatedAt,
+		})
+	}
+
+	for _, s := range u.Schemas {
+		out.Schemas = append(out.Schemas, accountSchema{
+			ID:         "@" + u.Name + "/" + s.Name,
+			Definition: s.Definition,
+			CreatedAt:  s.CreatedAt,
+		})
+	}
+
+	return out, nil
+}
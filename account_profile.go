@@ -0,0 +1,255 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// accountProfile describes the person or organization behind an account. All fields are
+// optional. The bio is only shown with the account (see showAccountHandler). The other fields
+// are also shown as the owner of refs in chains and search results.
+type accountProfile struct {
+	DisplayName *string `json:"display_name,omitempty"`
+	Bio         *string `json:"bio,omitempty"`
+	Affiliation *string `json:"affiliation,omitempty"`
+	ORCID       *string `json:"orcid,omitempty"`
+	Homepage    *string `json:"homepage,omitempty"`
+	Avatar      *string `json:"avatar,omitempty"`
+}
+
+// accountProfileFields are the fields of an accountProfile. They are used within queries.
+const accountProfileFields = `
+	display_name: user.display_name
+	bio: user.bio
+	affiliation: user.affiliation
+	orcid: user.orcid
+	homepage: user.homepage
+	avatar: user.avatar
+`
+
+// ownerProfileFields are the fields of an accountProfile shown with refs. They are used
+// within the node.owner block of @normalize queries.
+const ownerProfileFields = `
+	display_name: user.display_name
+	affiliation: user.affiliation
+	orcid: user.orcid
+	homepage: user.homepage
+	avatar: user.avatar
+`
+
+// ownerMetadata returns the owner of a ref as shown in chains and search results.
+func ownerMetadata(name string, p accountProfile) map[string]interface{} {
+
+	out := map[string]interface{}{
+		"name": "@" + name,
+	}
+
+	if p.DisplayName != nil {
+		out["display_name"] = *p.DisplayName
+	}
+	if p.Affiliation != nil {
+		out["affiliation"] = *p.Affiliation
+	}
+	if p.ORCID != nil {
+		out["orcid"] = *p.ORCID
+	}
+	if p.Homepage != nil {
+		out["homepage"] = *p.Homepage
+	}
+	if p.Avatar != nil {
+		out["avatar"] = *p.Avatar
+	}
+
+	return out
+}
+
+type accountProfileInput struct {
+	DisplayName string `json:"display_name" form:"display_name"`
+	Bio         string `json:"bio" form:"bio"`
+	Affiliation string `json:"affiliation" form:"affiliation"`
+	ORCID       string `json:"orcid" form:"orcid"`
+	Homepage    string `json:"homepage" form:"homepage"`
+	Avatar      string `json:"avatar" form:"avatar"`
+}
+
+var orcidPattern = regexp.MustCompile(`^\d{4}-\d{4}-\d{4}-\d{3}[\dX]$`)
+
+// normalizeORCID checks an ORCID iD (eg. 0000-0002-1825-0097 or https://orcid.org/0000-0002-1825-0097)
+// and returns it without the url.
+func normalizeORCID(id string) (string, error) {
+
+	id = strings.ToUpper(strings.TrimSpace(id))
+	for _, prefix := range []string{"HTTPS://ORCID.ORG/", "HTTP://ORCID.ORG/", "ORCID.ORG/"} {
+		id = strings.TrimPrefix(id, prefix)
+	}
+
+	if !orcidPattern.MatchString(id) {
+		return "", errors.New("orcid must be formatted as 0000-0000-0000-0000")
+	}
+
+	// ISO 7064 11,2 check digit
+	digits := strings.Replace(id, "-", "", -1)
+	total := 0
+	for _, d := range digits[:15] {
+		total = (total + int(d-'0')) * 2
+	}
+	check := (12 - total%11) % 11
+
+	expected := byte('0' + check)
+	if check == 10 {
+		expected = 'X'
+	}
+
+	if digits[15] != expected {
+		return "", errors.New("orcid is not valid")
+	}
+
+	return id, nil
+}
+
+// checkProfileURL checks that a url is absolute and uses one of the schemes.
+func checkProfileURL(field, raw string, schemes ...string) error {
+
+	if len(raw) > 300 {
+		return errors.New(field + " must be less than 300 characters")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New(field + " must be a valid url")
+	}
+
+	for _, s := range schemes {
+		if u.Scheme == s {
+			return nil
+		}
+	}
+
+	return errors.New(field + " must be a " + strings.Join(schemes, " or ") + " url")
+}
+
+// validateProfile checks and normalizes the profile fields. Empty fields are removed.
+func validateProfile(p *accountProfileInput) error {
+
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	p.Bio = strings.TrimSpace(p.Bio)
+	p.Affiliation = strings.TrimSpace(p.Affiliation)
+	p.ORCID = strings.TrimSpace(p.ORCID)
+	p.Homepage = strings.TrimSpace(p.Homepage)
+	p.Avatar = strings.TrimSpace(p.Avatar)
+
+	if utf8.RuneCountInString(p.DisplayName) > 100 {
+		return errors.New("display name must be less than 100 characters")
+	}
+
+	if utf8.RuneCountInString(p.Bio) > 1000 {
+		return errors.New("bio must be less than 1000 characters")
+	}
+
+	if utf8.RuneCountInString(p.Affiliation) > 200 {
+		return errors.New("affiliation must be less than 200 characters")
+	}
+
+	if p.ORCID != "" {
+		id, err := normalizeORCID(p.ORCID)
+		if err != nil {
+			return err
+		}
+		p.ORCID = id
+	}
+
+	if p.Homepage != "" {
+		if err := checkProfileURL("homepage", p.Homepage, "http", "https"); err != nil {
+			return err
+		}
+	}
+
+	if p.Avatar != "" {
+		if err := checkProfileURL("avatar", p.Avatar, "https"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateProfileHandler replaces the profile of an account. Fields that are empty or missing
+// are removed.
+func updateProfileHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "updating the profile")
+	if !ok {
+		return err
+	}
+
+	p := new(accountProfileInput)
+	if err := c.Bind(p); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	if err := validateProfile(p); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	set := map[string]interface{}{"uid": uid}
+	del := map[string]interface{}{"uid": uid}
+
+	for pred, value := range map[string]string{
+		"user.display_name": p.DisplayName,
+		"user.bio":          p.Bio,
+		"user.affiliation":  p.Affiliation,
+		"user.orcid":        p.ORCID,
+		"user.homepage":     p.Homepage,
+		"user.avatar":       p.Avatar,
+	} {
+		if value == "" {
+			del[pred] = nil
+		} else {
+			set[pred] = value
+		}
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	if len(del) > 1 {
+		// A delete with only the uid would remove every predicate of the account
+		_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(del)})
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+	}
+
+	if len(set) > 1 {
+		_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(set)})
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	// Cached chains and search results include the owner's profile
+	flushResponseCache()
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,40 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeORCID(t *testing.T) {
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"0000-0002-1825-0097", "0000-0002-1825-0097"},
+		{" https://orcid.org/0000-0002-1825-0097 ", "0000-0002-1825-0097"},
+		{"http://orcid.org/0000-0001-5109-3700", "0000-0001-5109-3700"},
+		{"orcid.org/0000-0002-1694-233X", "0000-0002-1694-233X"},
+		{"0000-0002-1694-233x", "0000-0002-1694-233X"},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeORCID(tt.id)
+		if err != nil {
+			t.Errorf("normalizeORCID(%q): %v", tt.id, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeORCID(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+
+	for _, id := range []string{"", "0000-0002-1825-0098", "0000000218250097", "0000-0002-1825-009", "https://example.org/0000-0002-1825-0097"} {
+		if _, err := normalizeORCID(id); err == nil {
+			t.Errorf("normalizeORCID(%q): expected an error", id)
+		}
+	}
+}
@@ -18,14 +18,16 @@ import (
 type showAccountModel struct {
 	Name  string `json:"name"`
 	Email string `json:"email,omitempty"`
+	accountProfile
 
 	Refs []struct {
-		ID             string    `json:"id"`
-		Data           string    `json:"data"`
-		Searchable     bool      `json:"searchable"`
-		SearchTitle    *string   `json:"search_title,omitempty"`
-		SearchSynopsis *string   `json:"search_synopsis,omitempty"`
-		CreatedAt      time.Time `json:"created_at"`
+		ID             string     `json:"id"`
+		Data           string     `json:"data"`
+		Searchable     bool       `json:"searchable"`
+		SearchTitle    *string    `json:"search_title,omitempty"`
+		SearchSynopsis *string    `json:"search_synopsis,omitempty"`
+		CreatedAt      time.Time  `json:"created_at"`
+		HiddenAt       *time.Time `json:"hidden_at,omitempty"`
 	} `json:"refs"`
 }
 
@@ -53,9 +55,10 @@ func showAccountHandler(c echo.Context) error {
 
 	q := `
 		query withvar($name: string) {
-			nodes(func: eq(user.name, $name))  {
+			nodes(func: eq(user.name, $name)) @filter(NOT has(user.deleted_at)) {
 				name: user.name
 				%s # email: user.email
+				` + accountProfileFields + `
 
 				refs: ~node.owner(orderdesc: node.created_at) @filter( %s ) {
 					# uid
@@ -65,6 +68,7 @@ func showAccountHandler(c echo.Context) error {
 					search_title: node.search_title
 					search_synopsis: node.search_synopsis
 					created_at: node.created_at
+					hidden_at: node.hidden_at
 				}
 			}
 		}
@@ -100,12 +104,13 @@ func showAccountHandler(c echo.Context) error {
 
 		if len(root.Model[0].Refs) == 0 {
 			root.Model[0].Refs = []struct {
-				ID             string    `json:"id"`
-				Data           string    `json:"data"`
-				Searchable     bool      `json:"searchable"`
-				SearchTitle    *string   `json:"search_title,omitempty"`
-				SearchSynopsis *string   `json:"search_synopsis,omitempty"`
-				CreatedAt      time.Time `json:"created_at"`
+				ID             string     `json:"id"`
+				Data           string     `json:"data"`
+				Searchable     bool       `json:"searchable"`
+				SearchTitle    *string    `json:"search_title,omitempty"`
+				SearchSynopsis *string    `json:"search_synopsis,omitempty"`
+				CreatedAt      time.Time  `json:"created_at"`
+				HiddenAt       *time.Time `json:"hidden_at,omitempty"`
 			}{}
 		} else {
 
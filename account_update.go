@@ -0,0 +1,283 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+type passwordChange struct {
+	CurrentPassword string `json:"current_password" form:"current_password"`
+	Password1       string `json:"password_1" form:"password_1"`
+	Password2       string `json:"password_2" form:"password_2"`
+}
+
+type emailChange struct {
+	Email string `json:"email" form:"email"`
+}
+
+// accountOwner checks that the logged in user owns the account in the url and returns the
+// uid of the account. If not, the error response has been written and ok is false.
+func accountOwner(c echo.Context, action string) (uid string, ok bool, err error) {
+
+	if !strings.HasPrefix(c.Param("name"), "@") {
+		return "", false, c.NoContent(http.StatusNotFound)
+	}
+	name := strings.ToLower(strings.TrimPrefix(c.Param("name"), "@"))
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return "", false, c.JSON(http.StatusUnauthorized, ErrorFmt(action+" requires login"))
+	}
+
+	if loggedInUser.(string) != name {
+		return "", false, c.JSON(http.StatusForbidden, ErrorFmt(action+" is only permitted by the account's owner"))
+	}
+
+	return c.Get("logged-in-user-uid").(string), true, nil
+}
+
+// changePasswordHandler changes the password of an account. The current password is required.
+func changePasswordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "changing the password")
+	if !ok {
+		return err
+	}
+
+	p := new(passwordChange)
+	if err := c.Bind(p); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	p.CurrentPassword = strings.TrimSpace(p.CurrentPassword)
+	p.Password1 = strings.TrimSpace(p.Password1)
+
+	if p.CurrentPassword == "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("current password must not be empty"))
+	}
+
+	if err := validatePassword(p.Password1, p.Password2, []string{c.Get("logged-in-user").(string), c.Get("logged-in-user-email").(string)}); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$uid":      uid,
+		"$password": p.CurrentPassword,
+	}
+
+	const q = `
+		query withvar($uid: string, $password: string) {
+			user_check(func: uid($uid)) @filter(eq(user, true)) {
+				checkpwd: checkpwd(user.password, $password)
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Check []struct {
+			Checkpwd bool `json:"checkpwd"`
+		} `json:"user_check"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if len(root.Check) == 0 || !root.Check[0].Checkpwd {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("current password is incorrect"))
+	}
+
+	data := struct {
+		UID      string `json:"uid"`
+		Password string `json:"user.password"`
+	}{
+		uid,
+		p.Password1,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	revokeLogins(uid)
+
+	return c.NoContent(http.StatusOK)
+}
+
+// changeEmailHandler changes the email address of an account. A verification link is sent to
+// the new email address and the account's email address is changed when the link is visited
+// (see verifyHandler). If emails are not configured, the email address is changed immediately.
+func changeEmailHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	uid, ok, err := accountOwner(c, "changing the email")
+	if !ok {
+		return err
+	}
+
+	e := new(emailChange)
+	if err := c.Bind(e); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	e.Email = strings.ToLower(strings.TrimSpace(e.Email))
+
+	if err := validateEmail(e.Email); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	if e.Email == c.Get("logged-in-user-email").(string) {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("email is unchanged"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$email": e.Email,
+	}
+
+	const q = `
+		query withvar($email: string) {
+			user_check1(func: eq(user.email, $email)) {
+				uid
+			}
+
+			user_check2(func: eq(user.pending_email, $email)) {
+				uid
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Check1 []struct {
+			UID string `json:"uid"`
+		} `json:"user_check1"`
+		Check2 []struct {
+			UID string `json:"uid"`
+		} `json:"user_check2"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if len(root.Check1) != 0 {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("email already exists"))
+	}
+
+	for _, u := range root.Check2 {
+		if u.UID != uid {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("email already exists"))
+		}
+	}
+
+	if !emailConfigured() {
+		// Emails are not configured so the email address can't be verified
+		data := struct {
+			UID   string `json:"uid"`
+			Email string `json:"user.email"`
+		}{
+			uid,
+			e.Email,
+		}
+
+		_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		err = txn.Commit(ctx)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		revokeLogins(uid)
+
+		return c.NoContent(http.StatusOK)
+	}
+
+	code, codeExpiresAt, err := newVerificationCode()
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	data := struct {
+		UID           string    `json:"uid"`
+		PendingEmail  string    `json:"user.pending_email"`
+		Code          string    `json:"user.code"`
+		CodeExpiresAt time.Time `json:"user.code_expires_at"`
+		CodeSentAt    time.Time `json:"user.code_sent_at"`
+	}{
+		uid,
+		e.Email,
+		code,
+		codeExpiresAt,
+		time.Now().UTC(),
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = sendEmailChange(e.Email, code)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	revokeLogins(uid)
+
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,391 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// Accounts with the admin role can moderate the instance using the /admin endpoints. The role
+// is granted and revoked from the command line (lemma-chain grant-admin @name). Every admin
+// action is recorded in the audit log (GET /admin/audit).
+
+// adminOnly is middleware that only permits logged in admins.
+func adminOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+
+		if c.Get("logged-in-user") == nil {
+			return c.JSON(http.StatusUnauthorized, ErrorFmt("admin requires login"))
+		}
+
+		if admin, _ := c.Get("logged-in-user-admin").(bool); !admin {
+			return c.JSON(http.StatusForbidden, ErrorFmt("admin is only permitted by admins"))
+		}
+
+		return next(c)
+	}
+}
+
+// auditEntry is an admin action recorded in the audit log.
+type auditEntry struct {
+	Admin     *string   `json:"admin,omitempty"` // nil for actions run from the command line
+	Action    string    `json:"action"`
+	Target    string    `json:"target"` // @name or ref id
+	Reason    *string   `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordAdminAction adds an action to the audit log. adminUID is empty for actions run from the
+// command line.
+func recordAdminAction(ctx context.Context, adminUID, adminName, action, target, reason string) error {
+
+	by := "console"
+	if adminName != "" {
+		by = "@" + adminName
+	}
+	log.Println(fmt.Sprintf("admin: %s %s %s", by, action, target))
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	data := map[string]interface{}{
+		"uid":              "_:audit",
+		"audit":            true,
+		"audit.action":     action,
+		"audit.target":     target,
+		"audit.created_at": time.Now().UTC(),
+	}
+
+	if adminUID != "" {
+		data["audit.admin"] = map[string]string{"uid": adminUID}
+	}
+
+	if reason != "" {
+		data["audit.reason"] = reason
+	}
+
+	_, err := txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit(ctx)
+}
+
+// auditAdminAction records an action by the logged in admin.
+func auditAdminAction(c echo.Context, action, target, reason string) {
+	err := recordAdminAction(c.Request().Context(), c.Get("logged-in-user-uid").(string), c.Get("logged-in-user").(string), action, target, reason)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// adminPage returns the first and offset query params.
+func adminPage(c echo.Context) (int, int, error) {
+
+	first, offset := 50, 0
+
+	if v := c.QueryParam("first"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 500 {
+			return 0, 0, errors.New("first query param must be between 1 and 500")
+		}
+		first = n
+	}
+
+	if v := c.QueryParam("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("offset query param is malformed")
+		}
+		offset = n
+	}
+
+	return first, offset, nil
+}
+
+// auditLogHandler lists the audit log, newest first. It can be filtered by action, admin and
+// target.
+func auditLogHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	first, offset, err := adminPage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	vars := map[string]string{
+		"$action": c.QueryParam("action"),
+		"$target": c.QueryParam("target"),
+		"$admin":  strings.ToLower(strings.TrimPrefix(c.QueryParam("admin"), "@")),
+	}
+
+	filters := []string{}
+	if vars["$action"] != "" {
+		filters = append(filters, "eq(audit.action, $action)")
+	}
+	if vars["$target"] != "" {
+		filters = append(filters, "eq(audit.target, $target)")
+	}
+	if vars["$admin"] != "" {
+		filters = append(filters, "uid_in(audit.admin, uid(admin))")
+	}
+
+	filter := ""
+	if len(filters) > 0 {
+		filter = "@filter(" + strings.Join(filters, " AND ") + ")"
+	}
+
+	adminBlock := ""
+	if vars["$admin"] != "" {
+		adminBlock = "admin as var(func: eq(user.name, $admin))"
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($action: string, $target: string, $admin: string) {
+			%s
+
+			entries(func: eq(audit, true), orderdesc: audit.created_at, first: %d, offset: %d) %s @normalize {
+				audit.admin {
+					admin: user.name
+				}
+				action: audit.action
+				target: audit.target
+				reason: audit.reason
+				created_at: audit.created_at
+			}
+		}
+	`, adminBlock, first, offset, filter)
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Entries []auditEntry `json:"entries"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if root.Entries == nil {
+		root.Entries = []auditEntry{}
+	}
+
+	for i := range root.Entries {
+		if root.Entries[i].Admin != nil {
+			name := "@" + *root.Entries[i].Admin
+			root.Entries[i].Admin = &name
+		}
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"entries": root.Entries}, "  ")
+}
+
+// statsHandler returns the number of accounts and refs on the instance.
+func statsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	now := time.Now().UTC()
+	vars := map[string]string{
+		"$day":  now.Add(-24 * time.Hour).Format(time.RFC3339),
+		"$week": now.Add(-7 * 24 * time.Hour).Format(time.RFC3339),
+	}
+
+	const q = `
+		query withvar($day: string, $week: string) {
+			accounts(func: eq(user, true)) @filter(NOT has(user.deleted_at)) { count(uid) }
+			validated(func: eq(user.validated, true)) @filter(NOT has(user.deleted_at)) { count(uid) }
+			suspended(func: has(user.suspended_at)) @filter(NOT has(user.deleted_at)) { count(uid) }
+			deleted(func: has(user.deleted_at)) { count(uid) }
+			admins(func: eq(user.admin, true)) { count(uid) }
+			new_accounts(func: ge(user.created_at, $week)) { count(uid) }
+
+			refs(func: eq(node, true)) { count(uid) }
+			searchable(func: eq(node.searchable, true)) { count(uid) }
+			hidden(func: has(node.hidden_at)) { count(uid) }
+			tombstoned(func: has(node.tombstoned_at)) { count(uid) }
+			refs_day(func: ge(node.created_at, $day)) { count(uid) }
+			refs_week(func: ge(node.created_at, $week)) { count(uid) }
+
+			files(func: eq(attachment, true)) { count(uid) }
+			schemas(func: eq(schema, true)) { count(uid) }
+			saved_searches(func: eq(saved_search, true)) { count(uid) }
+			open_reports(func: eq(report.status, "open")) { count(uid) }
+		}
+	`
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	var root map[string][]struct {
+		Count int `json:"count"`
+	}
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	count := func(block string) int {
+		if len(root[block]) == 0 {
+			return 0
+		}
+		return root[block][0].Count
+	}
+
+	out := map[string]interface{}{
+		"accounts": map[string]int{
+			"total":     count("accounts"),
+			"validated": count("validated"),
+			"suspended": count("suspended"),
+			"deleted":   count("deleted"),
+			"admins":    count("admins"),
+			"new_week":  count("new_accounts"),
+		},
+		"refs": map[string]int{
+			"total":      count("refs"),
+			"searchable": count("searchable"),
+			"hidden":     count("hidden"),
+			"tombstoned": count("tombstoned"),
+			"new_day":    count("refs_day"),
+			"new_week":   count("refs_week"),
+		},
+		"files":          count("files"),
+		"schemas":        count("schemas"),
+		"saved_searches": count("saved_searches"),
+		"open_reports":   count("open_reports"),
+	}
+
+	return c.JSONPretty(http.StatusOK, out, "  ")
+}
+
+// grantAdminCommand gives accounts the admin role.
+func grantAdminCommand(args []string) error {
+	return setAdminRole(args, true)
+}
+
+// revokeAdminCommand removes the admin role from accounts.
+func revokeAdminCommand(args []string) error {
+	return setAdminRole(args, false)
+}
+
+func setAdminRole(names []string, admin bool) error {
+
+	if len(names) == 0 {
+		return errors.New("an account name is required")
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "@"))
+
+		err := setAccountAdmin(context.Background(), name, admin)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setAccountAdmin(ctx context.Context, name string, admin bool) error {
+
+	uid, err := accountUID(ctx, name)
+	if err != nil {
+		return err
+	}
+	if uid == "" {
+		return fmt.Errorf("can't find account: @%s", name)
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	action := "grant_admin"
+	mu := &api.Mutation{SetJson: marshal(map[string]interface{}{"uid": uid, "user.admin": true})}
+	if !admin {
+		action = "revoke_admin"
+		mu = &api.Mutation{DeleteJson: marshal(map[string]interface{}{"uid": uid, "user.admin": nil})}
+	}
+
+	_, err = txn.Mutate(ctx, mu)
+	if err != nil {
+		return err
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = recordAdminAction(ctx, "", "", action, "@"+name, "")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: @%s\n", action, name)
+
+	return nil
+}
+
+// accountUID returns the uid of an account that has not been deleted. An empty uid is returned
+// if the account does not exist.
+func accountUID(ctx context.Context, name string) (string, error) {
+
+	vars := map[string]string{
+		"$name": name,
+	}
+
+	const q = `
+		query withvar($name: string) {
+			user(func: eq(user.name, $name), first: 1) @filter(NOT has(user.deleted_at)) {
+				uid
+			}
+		}
+	`
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return "", err
+	}
+
+	type Root struct {
+		User []struct {
+			UID string `json:"uid"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return "", err
+	}
+
+	if len(root.User) == 0 {
+		return "", nil
+	}
+
+	return root.User[0].UID, nil
+}
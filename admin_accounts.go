@@ -0,0 +1,371 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// Suspended accounts can't log in (see loginChecker) and therefore can't create refs. Their
+// existing refs are not affected (see admin_refs.go to hide them).
+
+type adminAccount struct {
+	UID         string     `json:"uid,omitempty"` // cleared before the account is listed
+	Name        string     `json:"name"`
+	Email       *string    `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Validated   bool       `json:"validated"`
+	Admin       bool       `json:"admin"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	Suspension  *string    `json:"suspension_reason,omitempty"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Refs        int        `json:"refs"`
+}
+
+// adminAccountFields are the fields of an adminAccount. They are used within queries.
+const adminAccountFields = `
+	uid
+	name: user.name
+	email: user.email
+	created_at: user.created_at
+	validated: user.validated
+	admin: user.admin
+	suspended_at: user.suspended_at
+	suspension_reason: user.suspension_reason
+	deleted_at: user.deleted_at
+	refs: count(~node.owner)
+`
+
+// accountSearchPattern restricts the characters of an account search so that it can be used
+// within a regular expression.
+var accountSearchPattern = regexp.MustCompile(`^[a-z0-9@._+-]+$`)
+
+// listAccountsHandler lists accounts, newest first. q searches the name and email address
+// (at least 3 characters are required for a partial match). status filters the accounts:
+// admin, suspended, unvalidated or deleted.
+func listAccountsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	first, offset, err := adminPage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	search := strings.ToLower(strings.TrimSpace(c.QueryParam("q")))
+	name := strings.TrimPrefix(search, "@")
+	if search != "" && !accountSearchPattern.MatchString(search) {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("q query param is malformed"))
+	}
+
+	fn := "eq(user, true)"
+	filters := []string{}
+
+	switch {
+	case search == "":
+	case len(name) < 3:
+		fn = "eq(user.name, $name)"
+		filters = append(filters, "eq(user, true)")
+	default:
+		// Trigram indexes can only match partial terms of at least 3 characters
+		re := regexp.QuoteMeta(name)
+		fn = "eq(user, true)"
+		filters = append(filters, fmt.Sprintf("(regexp(user.name, /%s/) OR regexp(user.email, /%s/))", re, re))
+	}
+
+	switch c.QueryParam("status") {
+	case "":
+		filters = append(filters, "NOT has(user.deleted_at)")
+	case "admin":
+		filters = append(filters, "eq(user.admin, true)")
+	case "suspended":
+		filters = append(filters, "has(user.suspended_at) AND NOT has(user.deleted_at)")
+	case "unvalidated":
+		filters = append(filters, "NOT eq(user.validated, true) AND NOT has(user.deleted_at)")
+	case "deleted":
+		filters = append(filters, "has(user.deleted_at)")
+	default:
+		return c.JSON(http.StatusBadRequest, ErrorFmt("status query param must be admin, suspended, unvalidated or deleted"))
+	}
+
+	vars := map[string]string{
+		"$name": name,
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($name: string) {
+			accounts(func: %s, orderdesc: user.created_at, first: %d, offset: %d) @filter(%s) {
+				%s
+			}
+		}
+	`, fn, first, offset, strings.Join(filters, " AND "), adminAccountFields)
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Accounts []adminAccount `json:"accounts"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if root.Accounts == nil {
+		root.Accounts = []adminAccount{}
+	}
+
+	for i := range root.Accounts {
+		root.Accounts[i].UID = ""
+		root.Accounts[i].Name = "@" + root.Accounts[i].Name
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"accounts": root.Accounts}, "  ")
+}
+
+// loadAdminAccount fetches the account in the name route param. nil is returned if the account
+// does not exist or has been deleted.
+func loadAdminAccount(c echo.Context) (*adminAccount, error) {
+
+	if !strings.HasPrefix(c.Param("name"), "@") {
+		return nil, nil
+	}
+
+	vars := map[string]string{
+		"$name": strings.ToLower(strings.TrimPrefix(c.Param("name"), "@")),
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($name: string) {
+			accounts(func: eq(user.name, $name), first: 1) @filter(NOT has(user.deleted_at)) {
+				%s
+			}
+		}
+	`, adminAccountFields)
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(c.Request().Context(), q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Accounts []adminAccount `json:"accounts"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root.Accounts) == 0 {
+		return nil, nil
+	}
+
+	return &root.Accounts[0], nil
+}
+
+type suspendInput struct {
+	Reason string `json:"reason" form:"reason"`
+}
+
+// suspendAccountHandler suspends an account. Admins can't be suspended.
+func suspendAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	input := new(suspendInput)
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+
+	account, err := loadAdminAccount(c)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if account == nil {
+		return c.JSON(http.StatusNotFound, ErrorFmt("can't find account"))
+	}
+
+	if account.Admin {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("admins can't be suspended"))
+	}
+
+	err = suspendAccount(ctx, account.UID, input.Reason)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	auditAdminAction(c, "suspend_account", "@"+account.Name, input.Reason)
+
+	return c.NoContent(http.StatusOK)
+}
+
+// suspendAccount suspends an account and logs it out.
+func suspendAccount(ctx context.Context, uid, reason string) error {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	data := map[string]interface{}{
+		"uid":               uid,
+		"user.suspended_at": time.Now().UTC(),
+	}
+	if reason != "" {
+		data["user.suspension_reason"] = reason
+	}
+
+	_, err := txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		return err
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	revokeLogins(uid)
+
+	return nil
+}
+
+// unsuspendAccountHandler lifts the suspension of an account.
+func unsuspendAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	account, err := loadAdminAccount(c)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if account == nil {
+		return c.JSON(http.StatusNotFound, ErrorFmt("can't find account"))
+	}
+
+	if account.SuspendedAt == nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("account is not suspended"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	del := map[string]interface{}{
+		"uid":                    account.UID,
+		"user.suspended_at":      nil,
+		"user.suspension_reason": nil,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(del)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	auditAdminAction(c, "unsuspend_account", "@"+account.Name, "")
+
+	return c.NoContent(http.StatusOK)
+}
+
+// adminDeleteAccountHandler deletes a (spam) account. Its refs are tombstoned unless the refs
+// query param is orphan.
+func adminDeleteAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	mode := c.QueryParam("refs")
+	if mode == "" {
+		mode = "tombstone"
+	}
+	if mode != "orphan" && mode != "tombstone" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("refs query param must be orphan or tombstone"))
+	}
+
+	account, err := loadAdminAccount(c)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if account == nil {
+		return c.JSON(http.StatusNotFound, ErrorFmt("can't find account"))
+	}
+
+	if account.Admin {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("admins can't be deleted"))
+	}
+
+	err = removeAccount(ctx, account.UID, account.Name, mode)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	auditAdminAction(c, "delete_account", "@"+account.Name, c.QueryParam("reason"))
+
+	flushResponseCache()
+
+	return c.NoContent(http.StatusOK)
+}
+
+// accountSuspended returns true if an account has been suspended.
+func accountSuspended(ctx context.Context, txn *dgo.Txn, uid string) (bool, error) {
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			user(func: uid($uid)) @filter(has(user.suspended_at)) {
+				uid
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return false, err
+	}
+
+	type Root struct {
+		User []struct {
+			UID string `json:"uid"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return false, err
+	}
+
+	return len(root.User) > 0, nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// Admins can hide refs. A hidden ref is removed from search results and can't be viewed. Chains
+// through a hidden ref are kept but its content is not shown (see ChainModel). The ref is made
+// unsearchable while hidden, and its previous searchable value is restored when it is unhidden.
+//
+// Spam can be deleted, which tombstones the refs (see tombstoneRefs).
+
+// maxModeratedRefs is the maximum number of refs per moderation request.
+const maxModeratedRefs = 100
+
+type moderateRefsInput struct {
+	Refs   []string `json:"refs" form:"refs"` // ref ids (@owner/hashid or hashid)
+	Reason string   `json:"reason" form:"reason"`
+}
+
+// moderatedRef is a ref that an admin action is applied to.
+type moderatedRef struct {
+	UID              string       `json:"uid"`
+	ID               string       `json:"-"` // @owner/hashid or hashid
+	HashID           string       `json:"node.hashid"`
+	Owner            []OwnerModel `json:"node.owner"`
+	Searchable       bool         `json:"node.searchable"`
+	SearchTitle      *string      `json:"node.search_title"`
+	HiddenAt         *time.Time   `json:"node.hidden_at"`
+	HiddenSearchable *bool        `json:"node.hidden_searchable"`
+	TombstonedAt     *time.Time   `json:"node.tombstoned_at"`
+}
+
+// loadModeratedRefs fetches the refs of a moderation request. An error message is returned if
+// the request is invalid.
+func loadModeratedRefs(ctx context.Context, txn *dgo.Txn, ids []string) ([]moderatedRef, string, error) {
+
+	if len(ids) == 0 {
+		return nil, "refs must not be empty", nil
+	}
+
+	if len(ids) > maxModeratedRefs {
+		return nil, fmt.Sprintf("max %d refs permitted", maxModeratedRefs), nil
+	}
+
+	out := []moderatedRef{}
+
+	for _, id := range ids {
+		id = strings.ToLower(strings.Trim(strings.TrimSpace(id), "/"))
+
+		uid, err := lookupRef(ctx, txn, id)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if uid == "" {
+			return nil, fmt.Sprintf("can't find ref: %s", id), nil
+		}
+
+		r, err := loadModeratedRef(ctx, txn, uid)
+		if err != nil {
+			return nil, "", err
+		}
+
+		out = append(out, *r)
+	}
+
+	return out, "", nil
+}
+
+func loadModeratedRef(ctx context.Context, txn *dgo.Txn, uid string) (*moderatedRef, error) {
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			refs(func: uid($uid)) {
+				uid
+				node.hashid
+				node.owner {
+					user.name
+				}
+				node.searchable
+				node.search_title
+				node.hidden_at
+				node.hidden_searchable
+				node.tombstoned_at
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Refs []moderatedRef `json:"refs"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root.Refs) == 0 {
+		return nil, fmt.Errorf("ref not found: %s", uid)
+	}
+
+	r := &root.Refs[0]
+	r.ID = r.HashID
+	if len(r.Owner) == 1 {
+		r.ID = "@" + r.Owner[0].Name + "/" + r.HashID
+	}
+
+	return r, nil
+}
+
+// hideRefsHandler hides refs.
+func hideRefsHandler(c echo.Context) error {
+	return moderateRefs(c, "hide_ref", hideRefs)
+}
+
+// unhideRefsHandler shows hidden refs again.
+func unhideRefsHandler(c echo.Context) error {
+	return moderateRefs(c, "unhide_ref", unhideRefs)
+}
+
+// deleteRefsHandler removes the content of (spam) refs.
+func deleteRefsHandler(c echo.Context) error {
+	return moderateRefs(c, "delete_ref", func(ctx context.Context, refs []moderatedRef) error {
+		uids := []string{}
+		for _, r := range refs {
+			uids = append(uids, r.UID)
+		}
+		return tombstoneRefs(ctx, "", uids)
+	})
+}
+
+// moderateRefs applies an admin action to the refs in the request.
+func moderateRefs(c echo.Context, action string, apply func(context.Context, []moderatedRef) error) error {
+	ctx := c.Request().Context()
+
+	input := new(moderateRefsInput)
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+
+	refs, msg, err := loadModeratedRefs(ctx, dg.NewReadOnlyTxn(), input.Refs)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if msg != "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(msg))
+	}
+
+	err = apply(ctx, refs)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	uids := []string{}
+	for _, r := range refs {
+		uids = append(uids, r.UID)
+		auditAdminAction(c, action, r.ID, input.Reason)
+	}
+
+	err = indexSearchRefs(ctx, uids)
+	if err != nil {
+		log.Println(err)
+	}
+
+	flushResponseCache()
+
+	return c.NoContent(http.StatusOK)
+}
+
+// hideRefs hides refs that are not already hidden.
+func hideRefs(ctx context.Context, refs []moderatedRef) error {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	now := time.Now().UTC()
+	sets := []map[string]interface{}{}
+
+	for _, r := range refs {
+		if r.HiddenAt != nil {
+			continue
+		}
+
+		sets = append(sets, map[string]interface{}{
+			"uid":                    r.UID,
+			"node.hidden_at":         now,
+			"node.hidden_searchable": r.Searchable,
+			"node.searchable":        false,
+		})
+	}
+
+	if len(sets) == 0 {
+		return nil
+	}
+
+	_, err := txn.Mutate(ctx, &api.Mutation{SetJson: marshal(sets)})
+	if err != nil {
+		return err
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range refs {
+		suggestions.remove(r.ID)
+	}
+
+	return nil
+}
+
+// unhideRefs restores hidden refs.
+func unhideRefs(ctx context.Context, refs []moderatedRef) error {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	dels := []map[string]interface{}{}
+	sets := []map[string]interface{}{}
+
+	for _, r := range refs {
+		if r.HiddenAt == nil {
+			continue
+		}
+
+		if r.TombstonedAt != nil {
+			// Tombstoned refs are never searchable
+			f := false
+			r.HiddenSearchable = &f
+		}
+
+		dels = append(dels, map[string]interface{}{
+			"uid":                    r.UID,
+			"node.hidden_at":         nil,
+			"node.hidden_searchable": nil,
+		})
+
+		sets = append(sets, map[string]interface{}{
+			"uid":             r.UID,
+			"node.searchable": r.HiddenSearchable != nil && *r.HiddenSearchable,
+		})
+	}
+
+	if len(dels) == 0 {
+		return nil
+	}
+
+	_, err := txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(dels)})
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(sets)})
+	if err != nil {
+		return err
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range refs {
+		if r.HiddenAt != nil && r.TombstonedAt == nil {
+			suggestRef(r.ID, r.HiddenSearchable != nil && *r.HiddenSearchable, r.SearchTitle)
+		}
+	}
+
+	return nil
+}
+
+// refHidden returns true if a ref has been hidden by an admin.
+func refHidden(ctx context.Context, txn *dgo.Txn, uid string) (bool, error) {
+
+	r, err := loadModeratedRef(ctx, txn, uid)
+	if err != nil {
+		return false, err
+	}
+
+	return r.HiddenAt != nil, nil
+}
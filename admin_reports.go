@@ -0,0 +1,402 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// The moderation queue lists open reports, oldest first. An admin resolves a report by:
+//
+//	dismiss   the ref does not break the rules
+//	hide      hide the ref (see admin_refs.go)
+//	suspend   suspend the ref's owner (see admin_accounts.go)
+//
+// All the open reports about the same ref are resolved together.
+
+type resolveReportInput struct {
+	Note string `json:"note" form:"note"` // recorded in the audit log
+}
+
+// reportQueueHandler lists reports. status filters the reports (default: open) and reason
+// filters their category.
+func reportQueueHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	first, offset, err := adminPage(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	status := c.QueryParam("status")
+	if status == "" {
+		status = reportOpen
+	}
+	if status != reportOpen && status != reportDismissed && status != reportActioned {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("status query param must be open, dismissed or actioned"))
+	}
+
+	// The queue is worked through from the oldest report
+	order := "orderasc"
+	if status != reportOpen {
+		order = "orderdesc"
+	}
+
+	vars := map[string]string{
+		"$status": status,
+		"$reason": c.QueryParam("reason"),
+	}
+
+	filter := "eq(report, true)"
+	if vars["$reason"] != "" {
+		filter = filter + " AND eq(report.reason, $reason)"
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($status: string, $reason: string) {
+			reports(func: eq(report.status, $status), %s: report.created_at, first: %d, offset: %d) @filter(%s) {
+				%s
+			}
+		}
+	`, order, first, offset, filter, refReportFields)
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Reports []refReport `json:"reports"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	out := []map[string]interface{}{}
+	for i := range root.Reports {
+		v, err := root.Reports[i].view(true)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+		out = append(out, v)
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"reports": out}, "  ")
+}
+
+// loadReport fetches a report. nil is returned if it does not exist.
+func loadReport(ctx context.Context, uid string) (*refReport, error) {
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($uid: string) {
+			reports(func: uid($uid)) @filter(eq(report, true)) {
+				%s
+			}
+		}
+	`, refReportFields)
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Reports []refReport `json:"reports"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root.Reports) == 0 || len(root.Reports[0].Ref) == 0 {
+		return nil, nil
+	}
+
+	return &root.Reports[0], nil
+}
+
+// dismissReportHandler dismisses the open reports about a ref.
+func dismissReportHandler(c echo.Context) error {
+	return resolveReport(c, "dismiss", func(ctx context.Context, r *refReport, note string) (string, error) {
+		auditAdminAction(c, "dismiss_report", r.refID(), note)
+		return "", nil
+	})
+}
+
+// hideReportedRefHandler hides a reported ref.
+func hideReportedRefHandler(c echo.Context) error {
+	return resolveReport(c, "hide_ref", func(ctx context.Context, r *refReport, note string) (string, error) {
+
+		ref, err := loadModeratedRef(ctx, dg.NewReadOnlyTxn(), r.Ref[0].UID)
+		if err != nil {
+			return "", err
+		}
+
+		err = hideRefs(ctx, []moderatedRef{*ref})
+		if err != nil {
+			return "", err
+		}
+
+		err = indexSearchRefs(ctx, []string{ref.UID})
+		if err != nil {
+			log.Println(err)
+		}
+
+		flushResponseCache()
+		auditAdminAction(c, "hide_ref", ref.ID, note)
+
+		return "", nil
+	})
+}
+
+// suspendReportedOwnerHandler suspends the owner of a reported ref.
+func suspendReportedOwnerHandler(c echo.Context) error {
+	return resolveReport(c, "suspend_owner", func(ctx context.Context, r *refReport, note string) (string, error) {
+
+		if len(r.Ref[0].Owner) == 0 {
+			return "ref has no owner", nil
+		}
+		name := r.Ref[0].Owner[0].Name
+
+		uid, err := accountUID(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		if uid == "" {
+			return "owner's account has been deleted", nil
+		}
+
+		admin, err := accountIsAdmin(ctx, uid)
+		if err != nil {
+			return "", err
+		}
+		if admin {
+			return "admins can't be suspended", nil
+		}
+
+		err = suspendAccount(ctx, uid, note)
+		if err != nil {
+			return "", err
+		}
+
+		auditAdminAction(c, "suspend_account", "@"+name, note)
+
+		return "", nil
+	})
+}
+
+// resolveReport applies an action to a report and resolves all the open reports about the
+// same ref. apply returns an error message if the action can't be applied.
+func resolveReport(c echo.Context, action string, apply func(context.Context, *refReport, string) (string, error)) error {
+	ctx := c.Request().Context()
+
+	uid, err := reportUID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorFmt(err))
+	}
+
+	input := new(resolveReportInput)
+	if err := c.Bind(input); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+	input.Note = strings.TrimSpace(input.Note)
+
+	r, err := loadReport(ctx, uid)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if r == nil {
+		return c.JSON(http.StatusNotFound, ErrorFmt("can't find report"))
+	}
+
+	if r.Status != reportOpen {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("report has already been resolved"))
+	}
+
+	msg, err := apply(ctx, r, input.Note)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if msg != "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(msg))
+	}
+
+	status := reportActioned
+	if action == "dismiss" {
+		status = reportDismissed
+	}
+
+	resolved, err := resolveOpenReports(ctx, r.Ref[0].UID, c.Get("logged-in-user-uid").(string), status, action)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	notifyReporters(resolved, status)
+
+	return c.NoContent(http.StatusOK)
+}
+
+// resolveOpenReports resolves the open reports about a ref and returns them.
+func resolveOpenReports(ctx context.Context, refUID, adminUID, status, action string) ([]refReport, error) {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$ref": refUID,
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($ref: string) {
+			ref(func: uid($ref)) {
+				~report.ref @filter(eq(report.status, "open")) {
+					%s
+				}
+			}
+		}
+	`, refReportFields)
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Ref []struct {
+			Reports []refReport `json:"~report.ref"`
+		} `json:"ref"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root.Ref) == 0 || len(root.Ref[0].Reports) == 0 {
+		return nil, nil
+	}
+	reports := root.Ref[0].Reports
+
+	now := time.Now().UTC()
+	sets := []map[string]interface{}{}
+
+	for i := range reports {
+		reports[i].Status = status
+		reports[i].Action = &action
+		reports[i].ResolvedAt = &now
+
+		sets = append(sets, map[string]interface{}{
+			"uid":                reports[i].UID,
+			"report.status":      status,
+			"report.action":      action,
+			"report.resolved_at": now,
+			"report.resolved_by": map[string]string{"uid": adminUID},
+		})
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(sets)})
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, txn.Commit(ctx)
+}
+
+// notifyReporters emails the reporters of resolved reports (if gmail is configured).
+func notifyReporters(reports []refReport, status string) {
+
+	if !emailConfigured() {
+		return
+	}
+
+	outcome := "An administrator reviewed the ref and found that it does not break the rules."
+	if status == reportActioned {
+		outcome = "An administrator reviewed the ref and took action. Thank you for helping to keep Lemma Chain free of abuse."
+	}
+
+	go func() {
+		sent := map[string]struct{}{}
+
+		for i := range reports {
+			email := reports[i].reporterEmail()
+			if email == "" {
+				continue
+			}
+			if _, exists := sent[email]; exists {
+				continue
+			}
+			sent[email] = struct{}{}
+
+			body := fmt.Sprintf("Your report about %s (%s) has been resolved.<br><br>%s",
+				reports[i].refID(), strings.Replace(reports[i].Reason, "_", " ", -1), outcome)
+
+			if err := deliverEmail(email, "Your Lemma Chain Report", body); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+// accountIsAdmin returns true if an account has the admin role.
+func accountIsAdmin(ctx context.Context, uid string) (bool, error) {
+
+	vars := map[string]string{
+		"$uid": uid,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			user(func: uid($uid)) @filter(eq(user.admin, true)) {
+				uid
+			}
+		}
+	`
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return false, err
+	}
+
+	type Root struct {
+		User []struct {
+			UID string `json:"uid"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return false, err
+	}
+
+	return len(root.User) > 0, nil
+}
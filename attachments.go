@@ -0,0 +1,534 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+var blobs blobStore
+
+// blobsMu serialises deleting blobs against storing them. Uploads hold a read lock from storing
+// their files until the ref attaching them is committed, and deleteUnusedBlobs holds the write
+// lock while it checks that a blob is unattached and deletes it. Otherwise a blob could be
+// deleted just before a new ref attaching it is committed.
+var blobsMu sync.RWMutex
+
+// blobStore stores attachment files by their sha256 hash.
+type blobStore interface {
+	// Put stores the blob and returns its (hex encoded) sha256 hash and size.
+	Put(r io.Reader) (string, int64, error)
+
+	// Get returns the blob with the provided hash. os.ErrNotExist is returned if
+	// the blob is not stored.
+	Get(hash string) (blob, error)
+
+	// Delete removes the blob with the provided hash (if it is stored).
+	Delete(hash string) error
+}
+
+type blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// localBlobStore stores blobs on the local filesystem.
+type localBlobStore struct {
+	dir string
+}
+
+func (ls *localBlobStore) path(hash string) string {
+	return filepath.Join(ls.dir, hash[:2], hash[2:4], hash)
+}
+
+func (ls *localBlobStore) Put(r io.Reader) (string, int64, error) {
+
+	err := os.MkdirAll(ls.dir, 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := ioutil.TempFile(ls.dir, ".upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	path := ls.path(hash)
+
+	if _, err := os.Stat(path); err == nil {
+		// Blob is already stored
+		return hash, size, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hash, size, nil
+}
+
+func (ls *localBlobStore) Get(hash string) (blob, error) {
+
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != 64 {
+		return nil, os.ErrNotExist
+	}
+
+	return os.Open(ls.path(hash))
+}
+
+func (ls *localBlobStore) Delete(hash string) error {
+
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != 64 {
+		return nil
+	}
+
+	err := os.Remove(ls.path(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func init() {
+	switch attachmentsBackend {
+	case "local":
+		blobs = &localBlobStore{dir: attachmentsDir}
+	default:
+		log.Fatal(fmt.Sprintf("unknown ATTACHMENTS_BACKEND: %s", attachmentsBackend))
+	}
+}
+
+// attachment is the metadata of a file linked to a ref.
+type attachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// attachmentModel is used to unmarshal attachments from DGraph.
+type attachmentModel struct {
+	Name        string `json:"attachment.name"`
+	ContentType string `json:"attachment.content_type"`
+	Size        int64  `json:"attachment.size"`
+	SHA256      string `json:"attachment.sha256"`
+}
+
+func (am attachmentModel) attachment() attachment {
+	return attachment{am.Name, am.ContentType, am.Size, am.SHA256}
+}
+
+// node returns the DGraph representation of the attachment.
+func (a attachment) node() map[string]interface{} {
+	return map[string]interface{}{
+		"attachment":              true,
+		"attachment.name":         a.Name,
+		"attachment.content_type": a.ContentType,
+		"attachment.size":         a.Size,
+		"attachment.sha256":       a.SHA256,
+	}
+}
+
+// toAttachments converts attachments from DGraph and sorts them by name.
+func toAttachments(models []attachmentModel) []attachment {
+	out := []attachment{}
+	for _, am := range models {
+		out = append(out, am.attachment())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+var errAttachmentQuota = errors.New("attachment quota exceeded")
+
+// attachmentFiles returns the files uploaded (as multipart form data) with a new ref.
+func attachmentFiles(c echo.Context) ([]*multipart.FileHeader, error) {
+
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return nil, nil
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, err
+	}
+
+	files := form.File["files"]
+
+	if len(files) > maxAttachments {
+		return nil, fmt.Errorf("max %d files permitted", maxAttachments)
+	}
+
+	names := map[string]struct{}{}
+	for _, f := range files {
+		if err := checkAttachmentFile(attachmentName(f.Filename), f.Size, names); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// checkAttachmentFile checks the (sanitized) name and size of a file. names contains the names
+// of the ref's other files.
+func checkAttachmentFile(name string, size int64, names map[string]struct{}) error {
+
+	if name == "" {
+		return errors.New("file name is invalid")
+	}
+
+	if _, exists := names[name]; exists {
+		return errors.New("file names must be unique")
+	}
+	names[name] = struct{}{}
+
+	if size > maxAttachmentSize*1024*1024 {
+		return fmt.Errorf("files must be less than %dMB", maxAttachmentSize)
+	}
+
+	return nil
+}
+
+// checkImportedAttachments checks the metadata of files in an imported ref using the same
+// rules as uploaded files.
+func checkImportedAttachments(files []attachment) error {
+
+	if len(files) > maxAttachments {
+		return fmt.Errorf("max %d files permitted", maxAttachments)
+	}
+
+	names := map[string]struct{}{}
+	for _, a := range files {
+		if attachmentName(a.Name) != a.Name {
+			return errors.New("file name is invalid")
+		}
+
+		if a.Size < 0 {
+			return errors.New("file size is invalid")
+		}
+
+		if err := checkAttachmentFile(a.Name, a.Size, names); err != nil {
+			return err
+		}
+
+		if _, err := hex.DecodeString(a.SHA256); err != nil || len(a.SHA256) != 64 || strings.ToLower(a.SHA256) != a.SHA256 {
+			return errors.New("file sha256 must be a hex encoded sha256 hash")
+		}
+
+		if _, _, err := mime.ParseMediaType(a.ContentType); err != nil {
+			return errors.New("file content type is invalid")
+		}
+	}
+
+	return nil
+}
+
+// attachmentName sanitizes the name of an uploaded file.
+func attachmentName(filename string) string {
+
+	name := strings.TrimSpace(filepath.Base(strings.Replace(filename, "\\", "/", -1)))
+	if name == "." || name == "/" || name == ".." || len(name) > 200 {
+		return ""
+	}
+
+	for _, char := range name {
+		if char < 32 || char == 34 || char == 127 {
+			return ""
+		}
+	}
+
+	return name
+}
+
+// checkAttachmentQuota returns errAttachmentQuota if storing the files would exceed
+// the account's quota.
+func checkAttachmentQuota(ctx context.Context, txn *dgo.Txn, ownerUID string, files []*multipart.FileHeader) error {
+
+	var size int64
+	for _, f := range files {
+		size = size + f.Size
+	}
+
+	return checkAttachmentQuotaSize(ctx, txn, ownerUID, size)
+}
+
+// checkAttachmentQuotaSize returns errAttachmentQuota if adding files of the provided total
+// size (in bytes) would exceed the account's quota. The usage is a sum that no other transaction
+// writes to, so the account's user.attachments_added_at is also set in txn. Concurrent
+// transactions adding files to the account's refs then conflict and only one is committed.
+func checkAttachmentQuotaSize(ctx context.Context, txn *dgo.Txn, ownerUID string, size int64) error {
+
+	usage, err := attachmentUsage(ctx, txn, ownerUID)
+	if err != nil {
+		return err
+	}
+
+	if usage+size > attachmentQuota*1024*1024 {
+		return errAttachmentQuota
+	}
+
+	update := map[string]interface{}{
+		"uid":                       ownerUID,
+		"user.attachments_added_at": time.Now().UTC(),
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(update)})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// attachmentUsage returns the total size (in bytes) of all files attached to refs owned by an account.
+func attachmentUsage(ctx context.Context, txn *dgo.Txn, ownerUID string) (int64, error) {
+
+	vars := map[string]string{
+		"$uid": ownerUID,
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			var(func: uid($uid)) {
+				~node.owner {
+					node.attachment {
+						s as attachment.size
+					}
+				}
+			}
+
+			usage() {
+				total: sum(val(s))
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return 0, err
+	}
+
+	type Root struct {
+		Usage []struct {
+			Total int64 `json:"total"`
+		} `json:"usage"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(root.Usage) == 0 {
+		return 0, nil
+	}
+
+	return root.Usage[0].Total, nil
+}
+
+// blobUpload stores the files of a new ref. It holds a read lock on blobsMu from the first
+// file being stored until the upload ends, which must be after the ref is committed (or
+// discarded). If the upload ends before commit is called, its blobs are removed again (unless
+// they are attached to other refs) so that a failed upload doesn't leave orphaned blobs.
+type blobUpload struct {
+	hashes    []string
+	locked    bool
+	committed bool
+}
+
+// store saves uploaded files to the blob store.
+func (u *blobUpload) store(files []*multipart.FileHeader) ([]attachment, error) {
+
+	if !u.locked {
+		blobsMu.RLock()
+		u.locked = true
+	}
+
+	out := []attachment{}
+
+	for _, f := range files {
+		file, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		hash, size, err := blobs.Put(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		u.hashes = append(u.hashes, hash)
+
+		contentType := f.Header.Get(echo.HeaderContentType)
+		if _, _, err := mime.ParseMediaType(contentType); err != nil || contentType == "" {
+			contentType = echo.MIMEOctetStream
+		}
+
+		out = append(out, attachment{
+			Name:        attachmentName(f.Filename),
+			ContentType: contentType,
+			Size:        size,
+			SHA256:      hash,
+		})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	return out, nil
+}
+
+// commit records that the ref attaching the blobs was committed and ends the upload.
+func (u *blobUpload) commit() {
+	u.committed = true
+	u.end()
+}
+
+// end releases the lock and removes the blobs if the ref wasn't committed. It can be called
+// more than once.
+func (u *blobUpload) end() {
+
+	if !u.locked {
+		return
+	}
+	blobsMu.RUnlock()
+	u.locked = false
+
+	if u.committed || len(u.hashes) == 0 {
+		return
+	}
+
+	hashes := u.hashes
+	u.hashes = nil
+
+	if err := deleteUnusedBlobs(context.Background(), hashes); err != nil {
+		log.Println(err)
+	}
+}
+
+// fileHandler downloads a file attached to a ref.
+// Files are visible to anyone that can see the ref.
+func fileHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	nodeID, _, name := splitRefPath(c.Param("*"))
+	if name == "" {
+		return c.JSON(http.StatusNotFound, ErrorFmt("can't find file"))
+	}
+
+	txn := dg.NewReadOnlyTxn()
+
+	uid, err := lookupRef(ctx, txn, nodeID)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if uid == "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
+	}
+
+	vars := map[string]string{
+		"$uid":  uid,
+		"$name": name,
+	}
+
+	const q = `
+		query withvar($uid: string, $name: string) {
+			files(func: uid($uid)) @filter(NOT has(node.hidden_at)) {
+				node.attachment @filter(eq(attachment.name, $name)) {
+					attachment.name
+					attachment.content_type
+					attachment.size
+					attachment.sha256
+				}
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Files []struct {
+			Attachments []attachmentModel `json:"node.attachment"`
+		} `json:"files"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if len(root.Files) == 0 || len(root.Files[0].Attachments) == 0 {
+		return c.JSON(http.StatusNotFound, ErrorFmt("can't find file"))
+	}
+	a := root.Files[0].Attachments[0].attachment()
+
+	f, err := blobs.Get(a.SHA256)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c.JSON(http.StatusNotFound, ErrorFmt("file is not available on this server"))
+		}
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+	defer f.Close()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, a.ContentType)
+	res.Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.Header().Set("ETag", "\""+a.SHA256+"\"")
+
+	http.ServeContent(res, c.Request(), a.Name, time.Time{}, f)
+	return nil
+}
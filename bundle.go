@@ -0,0 +1,889 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+	"github.com/patrickmn/go-cache"
+)
+
+// bundleVersion is the format version of exported bundles.
+const bundleVersion = 1
+
+// chainBundle is a self-contained export of a ref and its complete ancestor chain.
+// It can be verified offline and imported into another instance.
+type chainBundle struct {
+	Version   int         `json:"version"`
+	Root      string      `json:"root"`
+	Instance  string      `json:"instance,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	Refs      []bundleRef `json:"refs"`
+
+	// Digest is the sha256 hash of the root id and the hash of every ref (in order).
+	Digest string `json:"digest"`
+
+	// PublicKey and Signature are only present if the exporting instance has a signing key.
+	PublicKey string `json:"public_key,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+type bundleRef struct {
+	ID             string       `json:"id"`
+	Owner          *string      `json:"owner"`
+	Data           string       `json:"data"`
+	Searchable     bool         `json:"searchable"`
+	SearchTitle    *string      `json:"search_title,omitempty"`
+	SearchSynopsis *string      `json:"search_synopsis,omitempty"`
+	CreatedAt      time.Time    `json:"created_at"`
+	Parents        []bundleEdge `json:"parents"`
+	Files          []attachment `json:"files,omitempty"`
+
+	// Hidden is set if the ref has been hidden by a moderator. Its content is not exported
+	// but it remains in the chain.
+	Hidden bool `json:"hidden,omitempty"`
+
+	// Hash is the sha256 hash of the ref's content (ie. all the other fields).
+	Hash string `json:"hash"`
+
+	// Timestamp is the TSA's timestamp token for the content hash stored when the ref was
+	// created (if any).
+	Timestamp *refTimestamp `json:"timestamp,omitempty"`
+}
+
+type bundleEdge struct {
+	ID      string `json:"id"`
+	RefType string `json:"ref_type"`
+}
+
+// contentHash returns the sha256 hash of the ref's content.
+func (br bundleRef) contentHash() string {
+	br.Hash = ""
+	br.Timestamp = nil
+	sum := sha256.Sum256(marshal(br))
+	return hex.EncodeToString(sum[:])
+}
+
+// digest returns the sha256 hash of the root id and the hash of every ref.
+func (b *chainBundle) digest() string {
+	hashes := []string{b.Root}
+	for _, r := range b.Refs {
+		hashes = append(hashes, r.Hash)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(hashes, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// bundleHandler exports a ref and its complete ancestor chain as a single json file.
+func bundleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	nodeID, _, _ := splitRefPath(c.Param("*"))
+
+	// Check cache
+	key := fmt.Sprintf("bundle-%s", nodeID)
+	cachedData, found := memoryCache.Get(key)
+	if found {
+		b := cachedData.(*chainBundle)
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", bundleFilename(b.Root)))
+		return c.JSONPretty(http.StatusOK, b, "  ")
+	}
+
+	if stdQueryTimeout != 0 {
+		// Create a max query timeout
+		_ctx, cancel := context.WithTimeout(ctx, time.Duration(stdQueryTimeout)*time.Millisecond)
+		defer cancel()
+		ctx = _ctx
+	}
+
+	txn := dg.NewReadOnlyTxn()
+
+	b, err := buildBundle(ctx, txn, nodeID)
+	if err != nil {
+		if strings.Contains(err.Error(), "context canceled") {
+			return c.NoContent(http.StatusNoContent)
+		} else if strings.Contains(err.Error(), "context deadline exceeded") {
+			return c.NoContent(http.StatusRequestTimeout)
+		}
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if b == nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
+	}
+
+	// Store data in cache
+	memoryCache.Set(key, b, cache.DefaultExpiration)
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", bundleFilename(b.Root)))
+	return c.JSONPretty(http.StatusOK, b, "  ")
+}
+
+// bundleFilename returns the suggested filename for a bundle.
+func bundleFilename(root string) string {
+	return strings.Replace(strings.TrimPrefix(root, "@"), "/", "-", -1) + ".bundle.json"
+}
+
+// buildBundle exports the ref with the provided id and its complete ancestor chain.
+// A nil bundle is returned if the ref does not exist or has been hidden.
+func buildBundle(ctx context.Context, txn *dgo.Txn, nodeID string) (*chainBundle, error) {
+
+	uid, err := lookupRef(ctx, txn, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if uid == "" {
+		return nil, nil
+	}
+
+	hidden, err := refHidden(ctx, txn, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	if hidden {
+		return nil, nil
+	}
+
+	// Find the uids of all refs in the chain
+	q := `
+		{
+			chain(func: uid(%s)) @recurse(loop:false) {
+				uid
+				node.parent
+			}
+		}
+	`
+
+	resp, err := txn.Query(ctx, fmt.Sprintf(q, uid))
+	if err != nil {
+		return nil, err
+	}
+
+	type uidTree struct {
+		UID     string    `json:"uid"`
+		Parents []uidTree `json:"node.parent"`
+	}
+
+	type RootChain struct {
+		Chain []uidTree `json:"chain"`
+	}
+
+	var rootChain RootChain
+	err = json.Unmarshal(resp.Json, &rootChain)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := []string{uid}
+	seen := map[string]struct{}{uid: {}}
+
+	var collect func([]uidTree)
+	collect = func(chain []uidTree) {
+		for _, n := range chain {
+			if _, exists := seen[n.UID]; !exists && n.UID != "" {
+				seen[n.UID] = struct{}{}
+				uids = append(uids, n.UID)
+			}
+			collect(n.Parents)
+		}
+	}
+	collect(rootChain.Chain)
+
+	refs, err := loadBundleRefs(ctx, txn, uids)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &chainBundle{
+		Version:   bundleVersion,
+		Root:      refs[uid].ID,
+		Instance:  serverHostUrl,
+		CreatedAt: time.Now().UTC(),
+		Refs:      []bundleRef{},
+	}
+
+	for _, br := range refs {
+		b.Refs = append(b.Refs, br)
+	}
+
+	// The root ref is always first
+	sort.SliceStable(b.Refs, func(i, j int) bool {
+		if b.Refs[i].ID == b.Root || b.Refs[j].ID == b.Root {
+			return b.Refs[i].ID == b.Root
+		}
+		return b.Refs[i].ID < b.Refs[j].ID
+	})
+
+	b.Digest = b.digest()
+
+	if bundleSigningKey != "" {
+		seed, err := hex.DecodeString(bundleSigningKey)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, errors.New("BUNDLE_SIGNING_KEY must be a hex encoded 32 byte seed")
+		}
+
+		privateKey := ed25519.NewKeyFromSeed(seed)
+		b.PublicKey = hex.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+		b.Signature = hex.EncodeToString(ed25519.Sign(privateKey, []byte(b.Digest)))
+	}
+
+	return b, nil
+}
+
+// loadBundleRefs fetches the content of refs. The returned map's key is the uid.
+func loadBundleRefs(ctx context.Context, txn *dgo.Txn, uids []string) (map[string]bundleRef, error) {
+
+	q := `
+		{
+			refs(func: uid(%s)) {
+				uid
+				node.hashid
+				node.owner {
+					user.name
+				}
+				node.xdata
+				node.searchable
+				node.search_title
+				node.search_synopsis
+				node.created_at
+				node.content_hash
+				node.timestamp
+				node.timestamp_token
+				node.hidden_at
+				node.attachment {
+					attachment.name
+					attachment.content_type
+					attachment.size
+					attachment.sha256
+				}
+				node.parent @facets {
+					node.hashid
+					node.owner {
+						user.name
+					}
+				}
+			}
+		}
+	`
+
+	resp, err := txn.Query(ctx, fmt.Sprintf(q, strings.Join(uids, ", ")))
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Refs []struct {
+			UID            string            `json:"uid"`
+			HashID         string            `json:"node.hashid"`
+			Owner          []OwnerModel      `json:"node.owner"`
+			XData          string            `json:"node.xdata"`
+			Searchable     bool              `json:"node.searchable"`
+			SearchTitle    *string           `json:"node.search_title"`
+			SearchSynopsis *string           `json:"node.search_synopsis"`
+			CreatedAt      time.Time         `json:"node.created_at"`
+			ContentHash    *string           `json:"node.content_hash"`
+			Timestamp      *time.Time        `json:"node.timestamp"`
+			TimestampToken *string           `json:"node.timestamp_token"`
+			HiddenAt       *time.Time        `json:"node.hidden_at"`
+			Attachments    []attachmentModel `json:"node.attachment"`
+			Parents        []struct {
+				HashID string       `json:"node.hashid"`
+				Owner  []OwnerModel `json:"node.owner"`
+				Facet  interface{}  `json:"node.parent|facet"`
+			} `json:"node.parent"`
+		} `json:"refs"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]bundleRef{}
+
+	for _, n := range root.Refs {
+		br := bundleRef{
+			ID:             n.HashID,
+			Data:           n.XData,
+			Searchable:     n.Searchable,
+			SearchTitle:    n.SearchTitle,
+			SearchSynopsis: n.SearchSynopsis,
+			CreatedAt:      n.CreatedAt,
+			Parents:        []bundleEdge{},
+		}
+
+		if len(n.Owner) == 1 {
+			br.ID = "@" + n.Owner[0].Name + "/" + n.HashID
+			br.Owner = &n.Owner[0].Name
+		}
+
+		if n.HiddenAt != nil {
+			// The content of hidden refs is not exported
+			br.Data = "{}"
+			br.Searchable = false
+			br.SearchTitle = nil
+			br.SearchSynopsis = nil
+			br.Hidden = true
+			n.Attachments = nil
+			n.Timestamp = nil
+		}
+
+		if len(n.Attachments) > 0 {
+			br.Files = toAttachments(n.Attachments)
+		}
+
+		for _, p := range n.Parents {
+			refType, _ := facetRefType(p.Facet)
+			edge := bundleEdge{ID: p.HashID, RefType: refType}
+			if len(p.Owner) == 1 {
+				edge.ID = "@" + p.Owner[0].Name + "/" + p.HashID
+			}
+			br.Parents = append(br.Parents, edge)
+		}
+
+		sortBundleEdges(br.Parents)
+
+		br.Hash = br.contentHash()
+
+		if n.Timestamp != nil && n.TimestampToken != nil {
+			br.Timestamp = &refTimestamp{Time: *n.Timestamp, Token: *n.TimestampToken, Hash: br.Hash}
+			if n.ContentHash != nil {
+				br.Timestamp.Hash = *n.ContentHash
+			}
+		}
+
+		refs[n.UID] = br
+	}
+
+	return refs, nil
+}
+
+// sortBundleEdges sorts edges so that a ref's content hash does not depend on the order
+// in which its parents were stored.
+func sortBundleEdges(edges []bundleEdge) {
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].ID == edges[j].ID {
+			return edges[i].RefType < edges[j].RefType
+		}
+		return edges[i].ID < edges[j].ID
+	})
+}
+
+// verifyBundle checks that a bundle is complete and has not been tampered with.
+// If trustedKey is provided, the bundle must be signed by it.
+func verifyBundle(b *chainBundle, trustedKey string) error {
+
+	if b.Version != bundleVersion {
+		return fmt.Errorf("unsupported bundle version: %d", b.Version)
+	}
+
+	if len(b.Refs) == 0 {
+		return errors.New("bundle contains no refs")
+	}
+
+	refs := map[string]bundleRef{} // key is ref id
+	for _, r := range b.Refs {
+		if _, exists := refs[r.ID]; exists {
+			return fmt.Errorf("ref %s appears more than once", r.ID)
+		}
+		refs[r.ID] = r
+
+		if r.Hash != r.contentHash() {
+			return fmt.Errorf("ref %s does not match its hash", r.ID)
+		}
+
+		x := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(r.Data), &x); err != nil {
+			return fmt.Errorf("ref %s does not contain a valid json object", r.ID)
+		}
+
+		if r.Timestamp != nil {
+			token, err := base64.StdEncoding.DecodeString(r.Timestamp.Token)
+			if err != nil {
+				return fmt.Errorf("ref %s has a malformed timestamp token", r.ID)
+			}
+
+			// Bundles exported before the timestamped hash was included
+			hash := r.Timestamp.Hash
+			if hash == "" {
+				hash = r.Hash
+			}
+
+			if _, err := verifyTimestampToken(token, hash, tsaRoots); err != nil {
+				return fmt.Errorf("ref %s: %v", r.ID, err)
+			}
+		}
+	}
+
+	if _, exists := refs[b.Root]; !exists {
+		return fmt.Errorf("root ref %s is missing", b.Root)
+	}
+
+	// The chain must be complete and contain nothing else
+	reachable := map[string]struct{}{}
+
+	var visit func(id string) error
+	visit = func(id string) error {
+		if _, exists := reachable[id]; exists {
+			return nil
+		}
+		reachable[id] = struct{}{}
+
+		for _, p := range refs[id].Parents {
+			if _, exists := refs[p.ID]; !exists {
+				return fmt.Errorf("ref %s links to missing ref %s", id, p.ID)
+			}
+			if err := visit(p.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := visit(b.Root); err != nil {
+		return err
+	}
+
+	if len(reachable) != len(refs) {
+		return errors.New("bundle contains refs that are not part of the chain")
+	}
+
+	if b.Digest != b.digest() {
+		return errors.New("bundle digest does not match its refs")
+	}
+
+	if trustedKey != "" && !strings.EqualFold(trustedKey, b.PublicKey) {
+		return errors.New("bundle is not signed by the trusted key")
+	}
+
+	if b.Signature != "" || b.PublicKey != "" {
+		publicKey, err := hex.DecodeString(b.PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return errors.New("bundle public key is malformed")
+		}
+
+		signature, err := hex.DecodeString(b.Signature)
+		if err != nil || !ed25519.Verify(publicKey, []byte(b.Digest), signature) {
+			return errors.New("bundle signature is invalid")
+		}
+	}
+
+	return nil
+}
+
+// verifyBundleCommand verifies a bundle file without requiring a connection to DGraph.
+func verifyBundleCommand(args []string) error {
+
+	fs := flag.NewFlagSet("verify-bundle", flag.ContinueOnError)
+	trustedKey := fs.String("key", "", "hex encoded public key that the bundle must be signed by")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: verify-bundle [-key <public key>] <file>")
+	}
+
+	raw, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	b := new(chainBundle)
+	err = json.Unmarshal(raw, b)
+	if err != nil {
+		return fmt.Errorf("bundle is malformed: %v", err)
+	}
+
+	err = verifyBundle(b, strings.TrimSpace(*trustedKey))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("ok: %s (%d refs, digest %s)\n", b.Root, len(b.Refs), b.Digest)
+	if b.PublicKey != "" {
+		fmt.Printf("signed by: %s\n", b.PublicKey)
+	} else {
+		fmt.Println("bundle is not signed")
+	}
+
+	return nil
+}
+
+// importBundleHandler recreates the refs of a bundle that do not exist on this instance.
+// Imported refs keep their original id as an alias. Refs owned by the logged in user
+// remain owned by the user. All other refs are imported without an owner.
+func importBundleHandler(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return c.JSON(http.StatusUnauthorized, ErrorFmt("import requires login"))
+	}
+
+	b := new(chainBundle)
+	if err := c.Bind(b); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	if len(b.Refs) > maxBundleRefs {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("max %d refs permitted in a bundle", maxBundleRefs)))
+	}
+
+	err := verifyBundle(b, "")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	// The account may have been suspended since the login was checked
+	suspended, err := accountSuspended(ctx, txn, c.Get("logged-in-user-uid").(string))
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if suspended {
+		return c.JSON(http.StatusForbidden, ErrorFmt("account is suspended"))
+	}
+
+	// Find refs that have already been imported. The ids in the bundle belong to the
+	// exporting instance, so they are only matched against the aliases of imported refs
+	// (never against the hashids of this instance's refs).
+	existing := map[string]string{} // key is ref id, value is uid
+	for _, r := range b.Refs {
+		uid, err := lookupAlias(ctx, txn, r.ID)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		if uid != "" {
+			existing[r.ID] = uid
+		}
+	}
+
+	// Imported refs must satisfy the same rules as refs that are created
+	var filesSize int64 // files of refs that will be owned by the logged in user
+
+	for _, r := range b.Refs {
+		if _, exists := existing[r.ID]; exists {
+			continue
+		}
+
+		if err := validateRefContent(r.Data, r.Searchable, r.SearchTitle, r.SearchSynopsis); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("ref %s: %v", r.ID, err)))
+		}
+
+		if err := checkImportedAttachments(r.Files); err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("ref %s: %v", r.ID, err)))
+		}
+
+		if r.Owner != nil && *r.Owner == loggedInUser.(string) {
+			for _, a := range r.Files {
+				filesSize = filesSize + a.Size
+			}
+		}
+	}
+
+	if filesSize > 0 {
+		err = checkAttachmentQuotaSize(ctx, txn, c.Get("logged-in-user-uid").(string), filesSize)
+		if err == errAttachmentQuota {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("files exceed the account's quota of %dMB", attachmentQuota)))
+		} else if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+	}
+
+	// Order refs so that parents are created before the refs that link to them
+	refs := map[string]bundleRef{}
+	for _, r := range b.Refs {
+		refs[r.ID] = r
+	}
+
+	ordered := []bundleRef{}
+	visited := map[string]struct{}{}
+
+	var visit func(id string)
+	visit = func(id string) {
+		if _, exists := visited[id]; exists {
+			return
+		}
+		visited[id] = struct{}{}
+
+		for _, p := range refs[id].Parents {
+			visit(p.ID)
+		}
+		ordered = append(ordered, refs[id])
+	}
+	visit(b.Root)
+
+	type owner struct {
+		ID    string `json:"uid,omitempty"`
+		Facet string `json:"node.parent|facet,omitempty"`
+	}
+
+	blankNames := map[string]string{} // key is ref id, value is blank node name
+	nodes := []map[string]interface{}{}
+
+	for i, r := range ordered {
+		if _, exists := existing[r.ID]; exists {
+			continue
+		}
+
+		blankNames[r.ID] = fmt.Sprintf("r%d", i)
+
+		compactedJson, _ := compactJson(r.Data)
+
+		data := map[string]interface{}{
+			"uid":             "_:" + blankNames[r.ID],
+			"node":            true,
+			"node.alias":      r.ID,
+			"node.xdata":      compactedJson,
+			"node.searchable": r.Searchable,
+			"node.created_at": r.CreatedAt,
+		}
+
+		if r.Hidden {
+			// The ref was hidden on the exporting instance and its content is not included
+			data["node.hidden_at"] = time.Now().UTC()
+			data["node.hidden_searchable"] = false
+			data["node.searchable"] = false
+		}
+
+		if r.Owner != nil && *r.Owner == loggedInUser.(string) {
+			data["node.owner"] = &owner{ID: c.Get("logged-in-user-uid").(string)}
+		}
+
+		links := []owner{}
+		for _, p := range r.Parents {
+			if uid, exists := existing[p.ID]; exists {
+				links = append(links, owner{uid, p.RefType})
+			} else {
+				links = append(links, owner{"_:" + blankNames[p.ID], p.RefType})
+			}
+		}
+
+		if len(links) > 0 {
+			data["node.parent"] = links
+		}
+
+		if r.SearchTitle != nil {
+			data["node.search_title"] = *r.SearchTitle
+		}
+
+		if r.SearchSynopsis != nil {
+			data["node.search_synopsis"] = *r.SearchSynopsis
+		}
+
+		for pred, value := range languagePredicates(refLanguage("", r.SearchTitle, r.SearchSynopsis), r.SearchSynopsis) {
+			data[pred] = value
+		}
+
+		if len(r.Files) > 0 {
+			// Only the metadata is imported. The files themselves are available once
+			// they are added to the blob store.
+			files := []map[string]interface{}{}
+			for _, a := range r.Files {
+				files = append(files, a.node())
+			}
+			data["node.attachment"] = files
+		}
+
+		for pred, values := range xdataFieldValues(xdataFields, compactedJson) {
+			data[pred] = values
+		}
+
+		nodes = append(nodes, data)
+	}
+
+	if len(nodes) > 0 {
+		assigned, err := txn.Mutate(ctx, &api.Mutation{SetJson: marshal(nodes)})
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		// Update hashids of imported refs
+		hashids := []map[string]interface{}{}
+		for id, name := range blankNames {
+			uid := assigned.Uids[name]
+
+			hashid, err := h.EncodeHex(uid[2:])
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+			}
+
+			existing[id] = uid
+			hashids = append(hashids, map[string]interface{}{
+				"uid":         uid,
+				"node.hashid": hashid,
+			})
+		}
+
+		_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(hashids)})
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+	}
+
+	localIDs, err := refIDs(ctx, txn, existing)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	imported := []string{}
+	for _, r := range ordered {
+		if _, exists := blankNames[r.ID]; exists {
+			suggestRef(localIDs[r.ID], r.Searchable, r.SearchTitle)
+			imported = append(imported, existing[r.ID])
+		}
+	}
+
+	if err := indexSearchRefs(ctx, imported); err != nil {
+		log.Println(err)
+	}
+
+	notifySavedSearches(imported)
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"imported": len(nodes),
+		"refs":     localIDs,
+	})
+}
+
+// lookupAlias returns the uid of the ref imported with the provided (original) id. An empty
+// uid is returned if it has not been imported.
+func lookupAlias(ctx context.Context, txn *dgo.Txn, id string) (string, error) {
+
+	vars := map[string]string{
+		"$id": id,
+	}
+
+	const q = `
+		query withvar($id: string) {
+			alias(func: eq(node.alias, $id), first: 1) {
+				uid
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return "", err
+	}
+
+	type Root struct {
+		Alias []struct {
+			UID string `json:"uid"`
+		} `json:"alias"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return "", err
+	}
+
+	if len(root.Alias) == 0 {
+		return "", nil
+	}
+
+	return root.Alias[0].UID, nil
+}
+
+// refIDs returns the ids of refs. The provided map's values must be uids.
+// The returned map has the same keys with the values replaced by ref ids.
+func refIDs(ctx context.Context, txn *dgo.Txn, uids map[string]string) (map[string]string, error) {
+
+	out := map[string]string{}
+	if len(uids) == 0 {
+		return out, nil
+	}
+
+	list := []string{}
+	for _, uid := range uids {
+		list = append(list, uid)
+	}
+
+	q := `
+		{
+			refs(func: uid(%s)) @normalize {
+				uid: uid
+				id: node.hashid
+				node.owner {
+					name: user.name
+				}
+			}
+		}
+	`
+
+	resp, err := txn.Query(ctx, fmt.Sprintf(q, strings.Join(list, ", ")))
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Refs []struct {
+			UID  string  `json:"uid"`
+			ID   string  `json:"id"`
+			Name *string `json:"name"`
+		} `json:"refs"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	uidToID := map[string]string{}
+	for _, n := range root.Refs {
+		if n.Name != nil {
+			uidToID[n.UID] = "@" + *n.Name + "/" + n.ID
+		} else {
+			uidToID[n.UID] = n.ID
+		}
+	}
+
+	for k, uid := range uids {
+		out[k] = uidToID[uid]
+	}
+
+	return out, nil
+}
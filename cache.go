@@ -5,6 +5,7 @@
 package main
 
 import (
+	"strings"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -15,6 +16,8 @@ var memoryCache cacher
 type cacher interface {
 	Get(k string) (interface{}, bool)
 	Set(k string, x interface{}, d time.Duration)
+	Delete(k string)
+	Items() map[string]cache.Item
 }
 
 // noCache is used to disable caching
@@ -28,6 +31,14 @@ func (nc *noCache) Set(k string, x interface{}, d time.Duration) {
 	return
 }
 
+func (nc *noCache) Delete(k string) {
+	return
+}
+
+func (nc *noCache) Items() map[string]cache.Item {
+	return nil
+}
+
 func init() {
 	if cacheDuration != 0 {
 		memoryCache = cache.New(time.Duration(cacheDuration)*time.Minute, 10*time.Minute)
@@ -36,3 +47,13 @@ func init() {
 		memoryCache = &noCache{}
 	}
 }
+
+// flushResponseCache removes the cached responses (chains, bundles and search results) so that
+// moderation and profile changes take effect immediately. Cached logins are kept.
+func flushResponseCache() {
+	for key := range memoryCache.Items() {
+		if !strings.HasPrefix(key, "middleware.loginChecker-") {
+			memoryCache.Delete(key)
+		}
+	}
+}
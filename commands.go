@@ -0,0 +1,69 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a maintenance task that can be run from the command line
+// instead of starting the server. eg. lemma-chain verify-bundle chain.json
+type command struct {
+	run   func(args []string) error
+	usage string
+
+	// offline commands do not require a connection to DGraph.
+	offline bool
+}
+
+var commands = map[string]command{
+	"verify-bundle":  {verifyBundleCommand, "verify-bundle <file>: check the integrity of an exported chain bundle", true},
+	"migrate":        {migrateCommand, "migrate: apply the schema and check that the indexes have been built", false},
+	"reindex-search": {reindexSearchCommand, "reindex-search: rebuild the bleve search index (the server must be stopped)", false},
+	"backfill-lang":  {backfillLangCommand, "backfill-lang: detect the language of existing refs", false},
+	"backfill-xdata": {backfillXDataCommand, "backfill-xdata: index the XDATA_INDEX fields of existing refs", false},
+	"grant-admin":    {grantAdminCommand, "grant-admin <@name>...: give accounts the admin role", false},
+	"revoke-admin":   {revokeAdminCommand, "revoke-admin <@name>...: remove the admin role from accounts", false},
+}
+
+// lookupCommand returns the command requested via the command line arguments (if any).
+func lookupCommand() (string, command, bool) {
+	if len(os.Args) < 2 {
+		return "", command{}, false
+	}
+
+	cmd, exists := commands[os.Args[1]]
+	return os.Args[1], cmd, exists
+}
+
+// runCommand runs the command requested via the command line arguments and returns the exit code.
+func runCommand() int {
+
+	name, cmd, exists := lookupCommand()
+	if !exists {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\ncommands:\n", os.Args[1])
+
+		names := []string{}
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		for _, n := range names {
+			fmt.Fprintf(os.Stderr, "  %s\n", commands[n].usage)
+		}
+		return 2
+	}
+
+	err := cmd.run(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
+	}
+
+	return 0
+}
@@ -14,6 +14,38 @@ var maxDataPayload = lookupEnvOrUseDefaultInt("MAX_PAYLOAD_KB", 12)
 // expensive GET requests.
 var stdQueryTimeout = lookupEnvOrUseDefaultInt64("QUERY_TIMEOUT", 300)
 
+// maxSearchResults sets the maximum number of search results per page.
+// maxSearchCandidates sets the maximum number of matching refs that are ranked when search
+// results are sorted by relevance or when fuzzy and prefix matches are ranked after exact matches.
+// maxSearchExport sets the maximum number of search results that are exported (see exportSearch).
+var (
+	maxSearchResults    = lookupEnvOrUseDefaultInt("MAX_SEARCH_RESULTS", 100)
+	maxSearchCandidates = lookupEnvOrUseDefaultInt("MAX_SEARCH_CANDIDATES", 1000)
+	maxSearchExport     = lookupEnvOrUseDefaultInt("MAX_SEARCH_EXPORT", 10000)
+)
+
+// The weights of the signals used to rank search results by relevance (see scoreRef).
+// rankFreshnessHalfLife sets (in days) how quickly the freshness of a ref decays. Set it to 0
+// to ignore freshness.
+var (
+	rankTitleWeight       = lookupEnvOrUseDefaultFloat64("RANK_TITLE_WEIGHT", 3.0)
+	rankSynopsisWeight    = lookupEnvOrUseDefaultFloat64("RANK_SYNOPSIS_WEIGHT", 1.0)
+	rankProximityWeight   = lookupEnvOrUseDefaultFloat64("RANK_PROXIMITY_WEIGHT", 1.0)
+	rankCitationWeight    = lookupEnvOrUseDefaultFloat64("RANK_CITATION_WEIGHT", 1.0)
+	rankFreshnessWeight   = lookupEnvOrUseDefaultFloat64("RANK_FRESHNESS_WEIGHT", 0.5)
+	rankFreshnessHalfLife = lookupEnvOrUseDefaultFloat64("RANK_FRESHNESS_HALF_LIFE", 365)
+)
+
+// searchBackend selects the search engine: dgraph (default) or bleve (an embedded full-text index
+// stored in bleveIndexDir). After switching to bleve, stop the server and run "lemma-chain reindex-search".
+var (
+	searchBackend = lookupEnvOrUseDefault("SEARCH_BACKEND", "dgraph")
+	bleveIndexDir = lookupEnvOrUseDefault("BLEVE_INDEX_DIR", "search.bleve")
+)
+
+// maxFuzzyDistance sets the maximum edit distance (Levenshtein) of a fuzzy search match.
+var maxFuzzyDistance = lookupEnvOrUseDefaultInt("MAX_FUZZY_DISTANCE", 2)
+
 // port used to listen for connections.
 var listenPort = lookupEnvOrUseDefaultInt64("PORT", 1323)
 
@@ -30,7 +62,7 @@ var rateLimit = lookupEnvOrUseDefaultFloat64("RATE_LIMIT", 4.0)
 var dgraphUrl = lookupEnvOrUseDefault("DGRAPH_URL", "127.0.0.1:9080")
 
 // Both gmailAccount and gmailPassword must be set to send account activation emails.
-// If not set, accounts are automatically activated.
+// If either is not set (see emailConfigured), accounts are automatically activated.
 // serverHostUrl is the url root that the lemma chain server runs on. Activation links will use
 // this url.
 // website will be the website url that the activation link will redirect to.
@@ -43,6 +75,94 @@ var (
 	smtpPort      = lookupEnvOrUseDefaultInt("SMTP_PORT", 587)
 )
 
+// New passwords must have at least passwordMinLength characters and a zxcvbn strength score
+// (0 to 4) of at least passwordMinScore. 0 disables the score check.
+// breachedPasswordsFile is a sorted list of the SHA-1 hashes of breached passwords that must not
+// be used (see password_policy.go). If not set, passwords are not checked.
+var (
+	passwordMinLength     = lookupEnvOrUseDefaultInt("PASSWORD_MIN_LENGTH", 8)
+	passwordMinScore      = lookupEnvOrUseDefaultInt("PASSWORD_MIN_SCORE", 2)
+	breachedPasswordsFile = lookupEnvOrUseDefault("BREACHED_PASSWORDS_FILE", "")
+)
+
+// Failed logins are counted per account and per ip address (see login_throttle.go).
+// After loginBackoffFailures failures, logins are delayed. The delay (in seconds) starts at
+// loginBackoffSeconds and doubles with each further failure.
+// After loginLockoutFailures failures, logins are locked for loginLockoutMinutes.
+// loginIPBackoffFailures and loginIPLockoutFailures are the same for an ip address. They are
+// higher because many users may share an ip address.
+// loginFailureWindow sets (in minutes) how long failed logins are remembered.
+// loginAlertFailures sets the number of failures that trigger an email alert to the account's
+// owner. 0 disables alerts.
+var (
+	loginBackoffFailures   = lookupEnvOrUseDefaultInt("LOGIN_BACKOFF_FAILURES", 3)
+	loginBackoffSeconds    = lookupEnvOrUseDefaultInt("LOGIN_BACKOFF_SECONDS", 1)
+	loginLockoutFailures   = lookupEnvOrUseDefaultInt("LOGIN_LOCKOUT_FAILURES", 10)
+	loginLockoutMinutes    = lookupEnvOrUseDefaultInt("LOGIN_LOCKOUT_MINUTES", 15)
+	loginIPBackoffFailures = lookupEnvOrUseDefaultInt("LOGIN_IP_BACKOFF_FAILURES", 10)
+	loginIPLockoutFailures = lookupEnvOrUseDefaultInt("LOGIN_IP_LOCKOUT_FAILURES", 50)
+	loginFailureWindow     = lookupEnvOrUseDefaultInt("LOGIN_FAILURE_WINDOW", 60)
+	loginAlertFailures     = lookupEnvOrUseDefaultInt("LOGIN_ALERT_FAILURES", 5)
+)
+
+// verificationExpiry sets (in hours) how long verification links are valid. Accounts that are
+// not activated in time are removed.
+// cleanupInterval sets (in hours) how often accounts that were not activated are removed.
+// resendVerificationInterval sets (in minutes) how often an activation link can be resent.
+var (
+	verificationExpiry         = lookupEnvOrUseDefaultInt("VERIFICATION_EXPIRY_HOURS", 48)
+	cleanupInterval            = lookupEnvOrUseDefaultInt("CLEANUP_INTERVAL_HOURS", 24)
+	resendVerificationInterval = lookupEnvOrUseDefaultInt("RESEND_VERIFICATION_MINUTES", 5)
+)
+
 // recaptchaSecret is used for Google Recaptcha protection in POST requests.
 // Use 6LeIxAcTAAAAAGG-vFI1TnRWxMZNFuojJ4WifJWe for testing
 var recaptchaSecret = lookupEnvOrUseDefault("RECAPTCHA_SECRET", "6LeIxAcTAAAAAGG-vFI1TnRWxMZNFuojJ4WifJWe")
+
+// bundleSigningKey is a hex encoded ed25519 seed (32 bytes) used to sign exported chain bundles.
+// If not set, bundles are exported without a signature.
+var bundleSigningKey = lookupEnvOrUseDefault("BUNDLE_SIGNING_KEY", "")
+
+// maxBundleRefs sets the maximum number of refs that can be imported from a single bundle.
+var maxBundleRefs = lookupEnvOrUseDefaultInt("MAX_BUNDLE_REFS", 5000)
+
+// tsaURL is the url of an RFC 3161 Time Stamping Authority. If set, the content hash of every
+// new ref is timestamped by the TSA.
+// tsaRootsFile is a PEM file of the TSA's root certificates. If set, timestamp verification
+// also checks that the TSA's certificate is trusted.
+// tsaTimeout sets (in ms) the maximum duration of a request to the TSA.
+var (
+	tsaURL       = lookupEnvOrUseDefault("TSA_URL", "")
+	tsaRootsFile = lookupEnvOrUseDefault("TSA_ROOTS_FILE", "")
+	tsaTimeout   = lookupEnvOrUseDefaultInt64("TSA_TIMEOUT", 5000)
+)
+
+// Attachments are files uploaded with a ref. They are stored by their sha256 hash.
+// attachmentsBackend selects where files are stored. Valid values are "local".
+// attachmentsDir is the directory used by the "local" backend.
+// maxAttachments sets the maximum number of files per ref.
+// maxAttachmentSize sets (in MB) the maximum size of a single file.
+// attachmentQuota sets (in MB) the maximum total size of files per account.
+var (
+	attachmentsBackend = lookupEnvOrUseDefault("ATTACHMENTS_BACKEND", "local")
+	attachmentsDir     = lookupEnvOrUseDefault("ATTACHMENTS_DIR", "attachments")
+	maxAttachments     = lookupEnvOrUseDefaultInt("MAX_ATTACHMENTS", 10)
+	maxAttachmentSize  = lookupEnvOrUseDefaultInt64("MAX_ATTACHMENT_MB", 25)
+	attachmentQuota    = lookupEnvOrUseDefaultInt64("ATTACHMENT_QUOTA_MB", 500)
+)
+
+// schemasDir is a directory of instance-wide JSON Schemas (*.json) that can be used to validate
+// the data payload of refs. The file name (without extension) is the schema's name.
+var schemasDir = lookupEnvOrUseDefault("SCHEMAS_DIR", "")
+
+// xdataIndexConfig lists the fields of the data payload that are indexed for querying and searching.
+// eg. "year=year:int,author=authors[*].name:term,keywords:text" (see xdata_index.go).
+var xdataIndexConfig = lookupEnvOrUseDefault("XDATA_INDEX", "")
+
+// maxSavedSearches sets the maximum number of saved searches per account.
+// savedSearchDigestHours sets how often new matches of saved searches are emailed
+// (for saved searches with email notifications).
+var (
+	maxSavedSearches       = lookupEnvOrUseDefaultInt("MAX_SAVED_SEARCHES", 20)
+	savedSearchDigestHours = lookupEnvOrUseDefaultInt("SAVED_SEARCH_DIGEST_HOURS", 24)
+)
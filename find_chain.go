@@ -21,7 +21,23 @@ import (
 )
 
 type OwnerModel struct {
-	Name string `json:"user.name"`
+	Name        string  `json:"user.name"`
+	DisplayName *string `json:"user.display_name"`
+	Affiliation *string `json:"user.affiliation"`
+	ORCID       *string `json:"user.orcid"`
+	Homepage    *string `json:"user.homepage"`
+	Avatar      *string `json:"user.avatar"`
+}
+
+// profile returns the owner's profile as shown with their refs.
+func (om OwnerModel) profile() accountProfile {
+	return accountProfile{
+		DisplayName: om.DisplayName,
+		Affiliation: om.Affiliation,
+		ORCID:       om.ORCID,
+		Homepage:    om.Homepage,
+		Avatar:      om.Avatar,
+	}
 }
 
 type ChainModel struct {
@@ -31,15 +47,27 @@ type ChainModel struct {
 	XData   string       `json:"node.xdata"`
 	Parents []ChainModel `json:"node.parent"`
 	Facet   interface{}  `json:"node.parent|facet"` // Changed from *string due to https://github.com/dgraph-io/dgraph/issues/3582
+
+	ContentHash    *string    `json:"node.content_hash"`
+	Timestamp      *time.Time `json:"node.timestamp"`
+	TimestampToken *string    `json:"node.timestamp_token"`
+
+	Attachments []attachmentModel `json:"node.attachment"`
+	Schema      *string           `json:"node.schema"`
+
+	TombstonedAt *time.Time `json:"node.tombstoned_at"`
+	HiddenAt     *time.Time `json:"node.hidden_at"` // the content of hidden refs is not shown
 }
 
 func (cm *ChainModel) MarshalJSON() ([]byte, error) {
 
 	data := map[string]interface{}{}
 
-	err := json.Unmarshal([]byte(cm.XData), &data)
-	if err != nil {
-		return nil, err
+	if cm.HiddenAt == nil {
+		err := json.Unmarshal([]byte(cm.XData), &data)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	out := map[string]interface{}{
@@ -48,6 +76,7 @@ func (cm *ChainModel) MarshalJSON() ([]byte, error) {
 
 	if len(cm.Owner) == 1 {
 		out["id"] = "@" + cm.Owner[0].Name + "/" + cm.HashID
+		out["owner"] = ownerMetadata(cm.Owner[0].Name, cm.Owner[0].profile())
 	} else {
 		out["id"] = cm.HashID
 	}
@@ -62,21 +91,63 @@ func (cm *ChainModel) MarshalJSON() ([]byte, error) {
 		out["refs"] = []int{}
 	}
 
-	// https://github.com/dgraph-io/dgraph/issues/3582
-	if cm.Facet != nil {
-		switch v := cm.Facet.(type) {
-		case string:
-			out["ref_type"] = v
-		case []string:
-			out["ref_type"] = v[0]
-		case []interface{}:
-			out["ref_type"] = v[0]
+	if refType, exists := facetRefType(cm.Facet); exists {
+		out["ref_type"] = refType
+	}
+
+	if cm.HiddenAt != nil {
+		out["hidden"] = true
+		return json.Marshal(out)
+	}
+
+	if cm.ContentHash != nil {
+		out["content_hash"] = *cm.ContentHash
+	}
+
+	if cm.Timestamp != nil && cm.TimestampToken != nil {
+		ts := &refTimestamp{Time: *cm.Timestamp, Token: *cm.TimestampToken}
+		if cm.ContentHash != nil {
+			ts.Hash = *cm.ContentHash
 		}
+		out["timestamp"] = ts
+	}
+
+	if len(cm.Attachments) > 0 {
+		out["files"] = toAttachments(cm.Attachments)
+	}
+
+	if cm.Schema != nil {
+		out["schema"] = *cm.Schema
+	}
+
+	if cm.TombstonedAt != nil {
+		out["tombstoned_at"] = *cm.TombstonedAt
 	}
 
 	return json.Marshal(out)
 }
 
+// facetRefType returns the ref type stored in the facet of a node.parent edge.
+func facetRefType(facet interface{}) (string, bool) {
+
+	// https://github.com/dgraph-io/dgraph/issues/3582
+	switch v := facet.(type) {
+	case string:
+		return v, true
+	case []string:
+		if len(v) > 0 {
+			return v[0], true
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			s, ok := v[0].(string)
+			return s, ok
+		}
+	}
+
+	return "", false
+}
+
 // findChainHandler will list all nodes linked to the provided ref.
 func findChainHandler(c echo.Context) error {
 	ctx := c.Request().Context()
@@ -126,16 +197,25 @@ func findChainHandler(c echo.Context) error {
 	// Check if hashID is owned by owner name
 	vars := map[string]string{
 		"$hashid": hashID,
+		"$id":     nodeID,
 	}
 
 	q := `
-		query withvar($hashid: string) {
+		query withvar($hashid: string, $id: string) {
 			check(func: eq(node.hashid, $hashid)) @normalize {
 				uid: uid
+				hidden_at: node.hidden_at
 			    node.owner {
 			    	name: user.name 
 			    }
 			}
+
+			alias(func: eq(node.alias, $id), first: 1) @normalize {
+				id: node.hashid
+				node.owner {
+					name: user.name
+				}
+			}
 		}
 	`
 
@@ -152,9 +232,14 @@ func findChainHandler(c echo.Context) error {
 
 	type Root struct {
 		Check []struct {
-			UID  string  `json:"uid"`
-			Name *string `json:"name"`
+			UID      string     `json:"uid"`
+			Name     *string    `json:"name"`
+			HiddenAt *time.Time `json:"hidden_at"`
 		} `json:"check"`
+		Alias []struct {
+			ID   string  `json:"id"`
+			Name *string `json:"name"`
+		} `json:"alias"`
 	}
 
 	var root Root
@@ -164,23 +249,35 @@ func findChainHandler(c echo.Context) error {
 		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 	}
 
+	exists := false
 	if ownerName == nil {
-		if !(len(root.Check) == 1 && (root.Check[0].Name == nil)) {
-			// Can't find the hashid or name exists
-			return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
-		}
-	} else {
-		if len(root.Check) == 0 {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
-		}
-
+		// Can't find the hashid or name exists
+		exists = len(root.Check) == 1 && (root.Check[0].Name == nil)
+	} else if len(root.Check) != 0 {
 		actualName := root.Check[0].Name
+		exists = actualName != nil && *actualName == *ownerName
+	}
+
+	if !exists {
+		if len(root.Alias) == 1 {
+			// The ref was imported from another instance. Redirect to its local id.
+			localID := root.Alias[0].ID
+			if root.Alias[0].Name != nil {
+				localID = "@" + *root.Alias[0].Name + "/" + localID
+			}
 
-		if actualName == nil {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
-		} else if *actualName != *ownerName {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
+			target := "/" + localID
+			if c.QueryString() != "" {
+				target = target + "?" + c.QueryString()
+			}
+			return c.Redirect(http.StatusMovedPermanently, target)
 		}
+
+		return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
+	}
+
+	if root.Check[0].HiddenAt != nil {
+		return c.JSON(http.StatusGone, ErrorFmt("ref has been hidden by a moderator"))
 	}
 
 	// Find entire chain
@@ -208,8 +305,24 @@ func findChainHandler(c echo.Context) error {
 				uid
 				node.owner
 				user.name
+				user.display_name
+				user.affiliation
+				user.orcid
+				user.homepage
+				user.avatar
 				node.hashid
 				node.xdata
+				node.schema
+				node.tombstoned_at
+				node.hidden_at
+				node.content_hash
+				node.timestamp
+				node.timestamp_token
+				node.attachment
+				attachment.name
+				attachment.content_type
+				attachment.size
+				attachment.sha256
 				node.parent @facets %s
 			}
 		}
@@ -239,7 +352,7 @@ func findChainHandler(c echo.Context) error {
 
 	/////// Expand owners in deeply nested nodes due to BUG: https://github.com/dgraph-io/dgraph/issues/3634
 
-	uidToOwnerModel := map[string]string{} // key is uid, value is owner account name
+	uidToOwnerModel := map[string]OwnerModel{} // key is uid, value is owner account
 
 	var inspect func([]ChainModel, bool)
 	inspect = func(chain []ChainModel, insert bool) {
@@ -249,11 +362,11 @@ func findChainHandler(c echo.Context) error {
 
 			if !insert {
 				if len(cm.Owner) > 0 {
-					uidToOwnerModel[cm.UID] = cm.Owner[0].Name
+					uidToOwnerModel[cm.UID] = cm.Owner[0]
 				}
 			} else {
-				if ownerID, exists := uidToOwnerModel[cm.UID]; exists {
-					cm.Owner = []OwnerModel{OwnerModel{Name: ownerID}}
+				if owner, exists := uidToOwnerModel[cm.UID]; exists {
+					cm.Owner = []OwnerModel{owner}
 				}
 			}
 
@@ -263,13 +376,13 @@ func findChainHandler(c echo.Context) error {
 
 	cm := rootChain.Chain[0]
 	if len(cm.Owner) > 0 {
-		uidToOwnerModel[cm.UID] = cm.Owner[0].Name
+		uidToOwnerModel[cm.UID] = cm.Owner[0]
 	}
 	inspect(cm.Parents, false)
 
 	// Insert owners back into model
-	if ownerID, exists := uidToOwnerModel[cm.UID]; exists {
-		cm.Owner = []OwnerModel{OwnerModel{Name: ownerID}}
+	if owner, exists := uidToOwnerModel[cm.UID]; exists {
+		cm.Owner = []OwnerModel{owner}
 	}
 	inspect(cm.Parents, true)
 
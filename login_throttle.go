@@ -0,0 +1,311 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+	"golang.org/x/xerrors"
+)
+
+// Failed logins are counted per account and per ip address. Once there are too many failures,
+// logins are delayed with exponential backoff and then locked for a while. The counters are
+// stored in DGraph so that they survive restarts and are shared by all instances.
+
+func init() {
+	go func() {
+		c := time.Tick(24 * time.Hour) // Run daily
+		for range c {
+			cleanupLoginThrottles(context.Background())
+		}
+	}()
+}
+
+type loginThrottle struct {
+	UID          string     `json:"uid"`
+	Failures     int        `json:"login_throttle.failures"`
+	LastFailure  time.Time  `json:"login_throttle.last_failure"`
+	BlockedUntil *time.Time `json:"login_throttle.blocked_until"`
+}
+
+// clientIP returns the ip address of the client. Proxy headers are only trusted if the
+// server is behind a proxy.
+func clientIP(c echo.Context) string {
+
+	if behindProxy == 1 {
+		return c.RealIP()
+	}
+
+	host, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		return c.Request().RemoteAddr
+	}
+	return host
+}
+
+// loginThrottleDelay returns how long logins are refused after a number of failures.
+func loginThrottleDelay(failures, backoffFailures, lockoutFailures int) time.Duration {
+
+	lockout := time.Duration(loginLockoutMinutes) * time.Minute
+
+	if failures >= lockoutFailures {
+		return lockout
+	}
+
+	if failures >= backoffFailures {
+		delay := time.Duration(float64(loginBackoffSeconds)*math.Pow(2, float64(failures-backoffFailures))) * time.Second
+		if delay > lockout {
+			return lockout
+		}
+		return delay
+	}
+
+	return 0
+}
+
+// loadLoginThrottle fetches the failed login counter for a key. nil is returned if there have
+// been no recent failures.
+func loadLoginThrottle(ctx context.Context, txn *dgo.Txn, key string) (*loginThrottle, error) {
+
+	vars := map[string]string{
+		"$key": key,
+	}
+
+	const q = `
+		query withvar($key: string) {
+			throttle(func: eq(login_throttle.key, $key), first: 1) {
+				uid
+				login_throttle.failures
+				login_throttle.last_failure
+				login_throttle.blocked_until
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Throttle []loginThrottle `json:"throttle"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root.Throttle) == 0 {
+		return nil, nil
+	}
+
+	return &root.Throttle[0], nil
+}
+
+// loginThrottled returns how long logins are refused for a key and the number of recent
+// failures.
+func loginThrottled(ctx context.Context, key string) (time.Duration, int, error) {
+
+	t, err := loadLoginThrottle(ctx, dg.NewReadOnlyTxn(), key)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now().UTC()
+
+	if t == nil || now.Sub(t.LastFailure) > time.Duration(loginFailureWindow)*time.Minute {
+		return 0, 0, nil
+	}
+
+	if t.BlockedUntil != nil && now.Before(*t.BlockedUntil) {
+		return t.BlockedUntil.Sub(now), t.Failures, nil
+	}
+
+	return 0, t.Failures, nil
+}
+
+// tooManyLogins refuses a login. The client can retry after the wait.
+func tooManyLogins(c echo.Context, wait time.Duration) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return c.JSON(http.StatusTooManyRequests, ErrorFmt("too many failed logins. Try again later"))
+}
+
+// recordLoginFailure increments the failed login counters of the ip address and account.
+// If alertEmail is provided, the account's owner is alerted once there are LOGIN_ALERT_FAILURES
+// failures. An error is returned if a counter could not be incremented, in which case the
+// login must be refused as if it were throttled.
+func recordLoginFailure(ctx context.Context, ip, accountKey, alertEmail string) error {
+
+	if _, err := incrementLoginThrottle(ctx, "ip:"+ip, loginIPBackoffFailures, loginIPLockoutFailures); err != nil {
+		return err
+	}
+
+	failures, err := incrementLoginThrottle(ctx, accountKey, loginBackoffFailures, loginLockoutFailures)
+	if err != nil {
+		return err
+	}
+
+	if alertEmail != "" && loginAlertFailures > 0 && failures == loginAlertFailures {
+		if !emailConfigured() {
+			return nil
+		}
+
+		go func() {
+			body := fmt.Sprintf("There have been %d failed attempts to log in to your Lemma Chain account. The most recent attempt was from the ip address %s at %s.<br><br>If this wasn't you, change your password and consider enabling two-factor authentication.",
+				failures, ip, time.Now().UTC().Format(time.RFC1123))
+
+			if err := deliverEmail(alertEmail, "Failed Lemma Chain Logins", body); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// loginThrottleRetries is the number of times a failed login is recorded again when it
+// conflicts with a concurrent failed login for the same key.
+const loginThrottleRetries = 10
+
+// incrementLoginThrottle records a failed login for a key and returns the number of recent
+// failures.
+func incrementLoginThrottle(ctx context.Context, key string, backoffFailures, lockoutFailures int) (int, error) {
+
+	for attempt := 0; ; attempt++ {
+		failures, err := tryIncrementLoginThrottle(ctx, key, backoffFailures, lockoutFailures)
+		if err == dgo.ErrAborted && attempt < loginThrottleRetries {
+			continue
+		}
+		return failures, err
+	}
+}
+
+func tryIncrementLoginThrottle(ctx context.Context, key string, backoffFailures, lockoutFailures int) (int, error) {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	t, err := loadLoginThrottle(ctx, txn, key)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+
+	data := map[string]interface{}{
+		"uid":                         "_:throttle",
+		"login_throttle":              true,
+		"login_throttle.key":          key,
+		"login_throttle.failures":     1,
+		"login_throttle.last_failure": now,
+	}
+
+	if t != nil {
+		data["uid"] = t.UID
+		if now.Sub(t.LastFailure) <= time.Duration(loginFailureWindow)*time.Minute {
+			data["login_throttle.failures"] = t.Failures + 1
+		}
+	}
+
+	failures := data["login_throttle.failures"].(int)
+	if delay := loginThrottleDelay(failures, backoffFailures, lockoutFailures); delay > 0 {
+		data["login_throttle.blocked_until"] = now.Add(delay)
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		return 0, err
+	}
+
+	return failures, txn.Commit(ctx)
+}
+
+// resetLoginFailures clears the failed login counter of a key after a successful login.
+func resetLoginFailures(ctx context.Context, key string) {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	t, err := loadLoginThrottle(ctx, txn, key)
+	if err != nil || t == nil {
+		return
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal([]map[string]string{{"uid": t.UID}})})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := txn.Commit(ctx); err != nil {
+		log.Println(err)
+	}
+}
+
+// cleanupLoginThrottles removes failed login counters that are older than the failure window.
+func cleanupLoginThrottles(ctx context.Context) {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$dt": time.Now().UTC().Add(-time.Duration(loginFailureWindow) * time.Minute).Format(time.RFC3339),
+	}
+
+	const q = `
+		query withvar($dt: string) {
+			throttles(func: le(login_throttle.last_failure, $dt)) {
+				uid
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(xerrors.Errorf("login throttles: %w", err))
+		return
+	}
+
+	type Root struct {
+		Throttles []struct {
+			UID string `json:"uid"`
+		} `json:"throttles"`
+	}
+
+	var r Root
+	err = json.Unmarshal(resp.Json, &r)
+	if err != nil {
+		log.Println(xerrors.Errorf("login throttles: %w", err))
+		return
+	}
+
+	if len(r.Throttles) == 0 {
+		return
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(r.Throttles)})
+	if err != nil {
+		log.Println(xerrors.Errorf("login throttles: %w", err))
+		return
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(xerrors.Errorf("login throttles: %w", err))
+	}
+}
@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/dgraph-io/dgo"
 	"github.com/dgraph-io/dgo/protos/api"
@@ -21,6 +22,13 @@ var dg *dgo.Dgraph
 
 func init() {
 
+	if len(os.Args) > 1 {
+		if _, cmd, exists := lookupCommand(); !exists || cmd.offline {
+			// Offline commands don't require DGraph
+			return
+		}
+	}
+
 	conn, err := grpc.Dial(dgraphUrl, grpc.WithInsecure())
 	if err != nil {
 		log.Fatal("While trying to dial gRPC")
@@ -33,6 +41,10 @@ func init() {
 
 func main() {
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand())
+	}
+
 	// Echo instance
 	e := echo.New()
 
@@ -53,11 +65,55 @@ func main() {
 
 	// Routes
 	e.POST("/accounts", createAccountHandler)
+	e.POST("/accounts/resend-verification", resendVerificationHandler)
 	e.GET("/accounts/:name", showAccountHandler)
+	e.PUT("/accounts/:name/password", changePasswordHandler)
+	e.PUT("/accounts/:name/email", changeEmailHandler)
+	e.PUT("/accounts/:name/profile", updateProfileHandler)
+	e.GET("/accounts/:name/export", exportAccountHandler)
+	e.DELETE("/accounts/:name", deleteAccountHandler)
+	e.POST("/accounts/:name/2fa", enrolTwoFactorHandler)
+	e.POST("/accounts/:name/2fa/confirm", confirmTwoFactorHandler)
+	e.POST("/accounts/:name/2fa/recovery-codes", recoveryCodesHandler)
+	e.DELETE("/accounts/:name/2fa", disableTwoFactorHandler)
 	e.POST("/ref", createNodeHandler)
+	e.POST("/schemas", createSchemaHandler)
+	e.GET("/schemas", listSchemasHandler)
+	e.GET("/schemas/*", showSchemaHandler)
 	e.GET("/verify/:code", verifyHandler)
+	e.POST("/import/bundle", importBundleHandler)
+	e.GET("/suggest", suggestHandler)
+	e.POST("/searches", createSavedSearchHandler)
+	e.GET("/searches", listSavedSearchesHandler)
+	e.DELETE("/searches/:id", deleteSavedSearchHandler)
+	e.GET("/feed", feedHandler)
+	e.GET("/reports", listReportsHandler)
+	e.GET("/search", searchHandler)        // Cached
 	e.GET("/search/:terms", searchHandler) // Cached
-	e.GET("*", findChainHandler)           // Cached
+	e.GET("/query", queryHandler)          // Cached
+	e.GET("*", refGetHandler)              // Cached
+	e.POST("*", refPostHandler)
+
+	// Admin
+	admin := e.Group("/admin", adminOnly)
+	admin.GET("/accounts", listAccountsHandler)
+	admin.POST("/accounts/:name/suspend", suspendAccountHandler)
+	admin.DELETE("/accounts/:name/suspend", unsuspendAccountHandler)
+	admin.DELETE("/accounts/:name", adminDeleteAccountHandler)
+	admin.POST("/refs/hide", hideRefsHandler)
+	admin.POST("/refs/unhide", unhideRefsHandler)
+	admin.POST("/refs/delete", deleteRefsHandler)
+	admin.GET("/reports", reportQueueHandler)
+	admin.POST("/reports/:id/dismiss", dismissReportHandler)
+	admin.POST("/reports/:id/hide", hideReportedRefHandler)
+	admin.POST("/reports/:id/suspend", suspendReportedOwnerHandler)
+	admin.GET("/stats", statsHandler)
+	admin.GET("/audit", auditLogHandler)
+
+	startSuggestIndex()
+	startSearchBackend()
+	startSavedSearchMatcher()
+	startSavedSearchDigests()
 
 	// Start server
 	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", listenPort)))
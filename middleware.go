@@ -10,6 +10,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo"
 	"github.com/patrickmn/go-cache"
@@ -25,6 +26,7 @@ func loginChecker(next echo.HandlerFunc) echo.HandlerFunc {
 
 		account := strings.TrimSpace(c.Request().Header.Get("X-AUTH-ACCOUNT")) // Can be an account name or email
 		password := strings.TrimSpace(c.Request().Header.Get("X-AUTH-PASSWORD"))
+		otp := strings.TrimSpace(c.Request().Header.Get("X-AUTH-OTP")) // Required if the account has two-factor authentication
 		name := strings.ToLower(strings.TrimPrefix(account, "@"))
 		email := strings.ToLower(account)
 
@@ -45,6 +47,17 @@ func loginChecker(next echo.HandlerFunc) echo.HandlerFunc {
 			c.Set("logged-in-user-email", cd["email"])
 		}
 
+		// Check if the ip address has too many failed logins
+		ip := clientIP(c)
+		wait, _, err := loginThrottled(ctx, "ip:"+ip)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+		if wait > 0 {
+			return tooManyLogins(c, wait)
+		}
+
 		// Check login
 		txn := dg.NewReadOnlyTxn()
 
@@ -61,6 +74,9 @@ func loginChecker(next echo.HandlerFunc) echo.HandlerFunc {
 					user.name
 					user.email
 					user.validated
+					user.totp_secret
+					user.admin
+					user.suspended_at
 					checkpwd: checkpwd(user.password, $password)
 				}
 
@@ -69,6 +85,9 @@ func loginChecker(next echo.HandlerFunc) echo.HandlerFunc {
 					user.name
 					user.email
 					user.validated
+					user.totp_secret
+					user.admin
+					user.suspended_at
 					checkpwd: checkpwd(user.password, $password)
 				}
 			}
@@ -81,21 +100,20 @@ func loginChecker(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		// Check if a user exists
+		type loginUser struct {
+			UID         string     `json:"uid"`
+			Name        string     `json:"user.name"`
+			Email       string     `json:"user.email"`
+			Validated   bool       `json:"user.validated"`
+			TOTPSecret  *string    `json:"user.totp_secret"`
+			Admin       bool       `json:"user.admin"`
+			SuspendedAt *time.Time `json:"user.suspended_at"`
+			Checkpwd    bool       `json:"checkpwd"`
+		}
+
 		type Root struct {
-			Check1 []struct {
-				UID       string `json:"uid"`
-				Name      string `json:"user.name"`
-				Email     string `json:"user.email"`
-				Validated bool   `json:"user.validated"`
-				Checkpwd  bool   `json:"checkpwd"`
-			} `json:"user_check1"`
-			Check2 []struct {
-				UID       string `json:"uid"`
-				Name      string `json:"user.name"`
-				Email     string `json:"user.email"`
-				Validated bool   `json:"user.validated"`
-				Checkpwd  bool   `json:"checkpwd"`
-			} `json:"user_check2"`
+			Check1 []loginUser `json:"user_check1"`
+			Check2 []loginUser `json:"user_check2"`
 		}
 
 		var r Root
@@ -105,53 +123,98 @@ func loginChecker(next echo.HandlerFunc) echo.HandlerFunc {
 			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 		}
 
-		if len(r.Check1) == 0 && len(r.Check2) == 0 {
-			// User not found
-			return c.NoContent(http.StatusUnauthorized)
-		} else if len(r.Check1) == 1 {
+		var user *loginUser
+		validationMsg := "account requires email validation"
+		if len(r.Check1) == 1 {
+			user = &r.Check1[0]
+		} else if len(r.Check2) == 1 {
+			user = &r.Check2[0]
+			validationMsg = "account requires email verification"
+		}
 
-			if r.Check1[0].Checkpwd == false {
-				// Password incorrect
-				return c.NoContent(http.StatusUnauthorized)
-			}
+		// Failures are counted per account (or per name/email if the account doesn't exist)
+		accountKey := "account:" + email
+		alertEmail := ""
+		if user != nil {
+			accountKey = "account:" + user.UID
+			alertEmail = user.Email
+		}
 
-			if r.Check1[0].Validated == false {
-				// User has not verified email
-				return c.JSON(http.StatusUnauthorized, ErrorFmt("account requires email validation"))
-			}
+		wait, failures, err := loginThrottled(ctx, accountKey)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+		if wait > 0 {
+			return tooManyLogins(c, wait)
+		}
 
-			c.Set("logged-in-user", r.Check1[0].Name)
-			c.Set("logged-in-user-uid", r.Check1[0].UID)
-			c.Set("logged-in-user-email", r.Check1[0].Email)
+		if user == nil || !user.Checkpwd {
+			// User not found or password incorrect
+			if err := recordLoginFailure(ctx, ip, accountKey, alertEmail); err != nil {
+				// Fail closed so that failures are never uncounted
+				log.Println(err)
+				return tooManyLogins(c, time.Duration(loginBackoffSeconds)*time.Second)
+			}
+			return c.NoContent(http.StatusUnauthorized)
+		}
 
-			// Store data in cache
-			memoryCache.Set(key, map[string]string{"user": r.Check1[0].Name, "uid": r.Check1[0].UID, "email": r.Check1[0].Email}, cache.DefaultExpiration)
+		if !user.Validated {
+			// User has not verified email
+			return c.JSON(http.StatusUnauthorized, ErrorFmt(validationMsg))
+		}
 
-		} else if len(r.Check2) == 1 {
+		if user.SuspendedAt != nil {
+			return c.JSON(http.StatusForbidden, ErrorFmt("account is suspended"))
+		}
 
-			if r.Check2[0].Checkpwd == false {
-				// Password incorrect
-				return c.NoContent(http.StatusUnauthorized)
+		if user.TOTPSecret != nil {
+			ok, err := checkSecondFactor(ctx, user.UID, *user.TOTPSecret, otp)
+			if err != nil {
+				log.Println(err)
+				return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 			}
-
-			if r.Check2[0].Validated == false {
-				// User has not verified email
-				return c.JSON(http.StatusUnauthorized, ErrorFmt("account requires email verification"))
+			if !ok {
+				// Password-only logins are not permitted
+				if otp != "" {
+					if err := recordLoginFailure(ctx, ip, accountKey, alertEmail); err != nil {
+						log.Println(err)
+						return tooManyLogins(c, time.Duration(loginBackoffSeconds)*time.Second)
+					}
+				}
+				return c.JSON(http.StatusUnauthorized, ErrorFmt("account requires a two-factor authentication code"))
 			}
+		}
 
-			c.Set("logged-in-user", r.Check2[0].Name)
-			c.Set("logged-in-user-uid", r.Check2[0].UID)
-			c.Set("logged-in-user-email", r.Check2[0].Email)
+		if failures > 0 {
+			resetLoginFailures(ctx, accountKey)
+		}
 
-			// Store data in cache
-			memoryCache.Set(key, map[string]string{"user": r.Check2[0].Name, "uid": r.Check2[0].UID, "email": r.Check2[0].Email}, cache.DefaultExpiration)
+		c.Set("logged-in-user", user.Name)
+		c.Set("logged-in-user-uid", user.UID)
+		c.Set("logged-in-user-email", user.Email)
+		c.Set("logged-in-user-admin", user.Admin)
 
-		}
+		// Store data in cache
+		memoryCache.Set(key, map[string]string{"user": user.Name, "uid": user.UID, "email": user.Email}, cache.DefaultExpiration)
 
 		return next(c)
 	}
 }
 
+// revokeLogins removes the cached logins of an account so that the account's credentials
+// are checked again on the next request.
+func revokeLogins(uid string) {
+	for key, item := range memoryCache.Items() {
+		if !strings.HasPrefix(key, "middleware.loginChecker-") {
+			continue
+		}
+		if cd, ok := item.Object.(map[string]string); ok && cd["uid"] == uid {
+			memoryCache.Delete(key)
+		}
+	}
+}
+
 // nocache instructs browsers to not record response
 func nocache(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -36,6 +37,8 @@ type ref struct {
 	Searchable     bool     `json:"searchable" form:"searchable"`           // Defaults to false
 	SearchTitle    *string  `json:"search_title" form:"search_title"`       // Optional
 	SearchSynopsis *string  `json:"search_synopsis" form:"search_synopsis"` // Optional
+	Schema         *string  `json:"schema" form:"schema"`                   // Optional
+	Lang           string   `json:"lang" form:"lang"`                       // Optional (detected if empty)
 	RecaptchaCode  string   `json:"recaptcha_code" form:"recaptcha_code"`   // Required
 }
 
@@ -56,52 +59,50 @@ func createNodeHandler(c echo.Context) error {
 
 	if r.Data == nil {
 		return c.JSON(http.StatusBadRequest, ErrorFmt("data payload must not be empty"))
-	} else {
-		x := map[string]interface{}{}
-		err := json.Unmarshal([]byte(*r.Data), &x)
-		if err != nil {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("data payload must be valid json object"))
-		}
-
-		// Check if payload size is too big
-		if len([]byte(*r.Data)) > maxDataPayload*1024 {
-			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("data payload must be less than %dkB", maxDataPayload)))
-		}
 	}
 
-	// Validate search related input
-	if r.Searchable == true {
-		// We require at least a title or synopsis
-		if r.SearchTitle == nil && r.SearchSynopsis == nil {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("when searchable is true, a search title or search synopsis is required"))
-		}
+	if err := validateRefContent(*r.Data, r.Searchable, r.SearchTitle, r.SearchSynopsis); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
 	}
 
-	if r.SearchTitle != nil {
-		*r.SearchTitle = strings.TrimSpace(*r.SearchTitle)
+	// Validate data payload against the schema (if provided)
+	if r.Schema != nil {
+		*r.Schema = strings.ToLower(strings.TrimSpace(*r.Schema))
+
+		s, err := loadSchema(ctx, dg.NewReadOnlyTxn(), *r.Schema)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
 
-		if *r.SearchTitle == "" {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("search title must not be empty"))
+		if s == nil {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("schema does not exist"))
 		}
 
-		if len(*r.SearchTitle) > 100 {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("search title must be less than 100 characters"))
+		if errs := validateAgainstSchema(s, *r.Data); len(errs) > 0 {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":  "data payload does not match schema",
+				"errors": errs,
+			})
 		}
 	}
 
-	if r.SearchSynopsis != nil {
-		*r.SearchSynopsis = strings.TrimSpace(*r.SearchSynopsis)
+	lang := refLanguage(r.Lang, r.SearchTitle, r.SearchSynopsis)
+	if _, exists := searchLanguages[lang]; !exists && lang != "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("lang is not a supported language"))
+	}
 
-		if *r.SearchSynopsis == "" {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("search synopsis must not be empty"))
-		}
+	// Validate attached files
+	files, err := attachmentFiles(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
 
-		if len(*r.SearchSynopsis) > 800 {
-			return c.JSON(http.StatusBadRequest, ErrorFmt("search synopsis must be less than 800 characters"))
-		}
+	if len(files) > 0 && r.Owner == nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("files require an owner"))
 	}
 
-	err := recaptchaCheck(r.RecaptchaCode)
+	err = recaptchaCheck(r.RecaptchaCode)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, ErrorFmt("recaptcha invalid"))
 	}
@@ -122,10 +123,22 @@ func createNodeHandler(c echo.Context) error {
 		if loggedInUser == nil || ((loggedInUser.(string) != suppliedOwnerName) && (loggedInUserEmail.(string) != suppliedOwnerName)) {
 			return c.JSON(http.StatusUnauthorized, ErrorFmt("owner requires login"))
 		}
+
+		// The account may have been suspended since the login was checked
+		suspended, err := accountSuspended(ctx, txn, c.Get("logged-in-user-uid").(string))
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		if suspended {
+			return c.JSON(http.StatusForbidden, ErrorFmt("account is suspended"))
+		}
 	}
 
 	// Convert Parents to uid
 	links := []owner{}
+	edges := []bundleEdge{}
 
 	if len(r.Parents) != 0 {
 
@@ -222,18 +235,47 @@ func createNodeHandler(c echo.Context) error {
 			}
 
 			links = append(links, owner{rk.UID, p.facet})
+
+			if p.ownerName == nil {
+				edges = append(edges, bundleEdge{p.hashID, p.facet})
+			} else {
+				edges = append(edges, bundleEdge{"@" + *p.ownerName + "/" + p.hashID, p.facet})
+			}
+		}
+	}
+
+	// Store attached files
+	attachments := []attachment{}
+	upload := &blobUpload{}
+	defer upload.end()
+
+	if len(files) > 0 {
+		err = checkAttachmentQuota(ctx, txn, c.Get("logged-in-user-uid").(string), files)
+		if err == errAttachmentQuota {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("files exceed the account's quota of %dMB", attachmentQuota)))
+		} else if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		attachments, err = upload.store(files)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 		}
 	}
 
 	// Attempt to save ref
 
 	compactedJson, _ := compactJson(*r.Data)
+	createdAt := time.Now().UTC()
 
 	data := map[string]interface{}{
+		"uid":             "_:ref", // named because attachments are also new nodes
 		"node":            true,
 		"node.xdata":      compactedJson,
 		"node.searchable": r.Searchable,
-		"node.created_at": time.Now(),
+		"node.created_at": createdAt,
 	}
 
 	if r.Owner != nil {
@@ -245,6 +287,22 @@ func createNodeHandler(c echo.Context) error {
 		data["node.parent"] = links
 	}
 
+	if len(attachments) > 0 {
+		nodes := []map[string]interface{}{}
+		for _, a := range attachments {
+			nodes = append(nodes, a.node())
+		}
+		data["node.attachment"] = nodes
+	}
+
+	for pred, values := range xdataFieldValues(xdataFields, compactedJson) {
+		data[pred] = values
+	}
+
+	if r.Schema != nil {
+		data["node.schema"] = *r.Schema
+	}
+
 	if r.SearchTitle != nil {
 		data["node.search_title"] = *r.SearchTitle
 	}
@@ -253,6 +311,10 @@ func createNodeHandler(c echo.Context) error {
 		data["node.search_synopsis"] = *r.SearchSynopsis
 	}
 
+	for pred, value := range languagePredicates(lang, r.SearchSynopsis) {
+		data[pred] = value
+	}
+
 	assigned, err := txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
 	if err != nil {
 		log.Println(err)
@@ -260,39 +322,135 @@ func createNodeHandler(c echo.Context) error {
 	}
 
 	// Update hashid of link
-	uid := assigned.Uids["blank-0"]
+	uid := assigned.Uids["ref"]
 
 	hashid, err := h.EncodeHex(uid[2:])
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 	}
 
-	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(map[string]interface{}{
-		"uid":         uid,
-		"node.hashid": hashid,
-	})})
-	if err != nil {
-		log.Println(err)
-		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
-	}
-
 	linkAddress := hashid
 	if r.Owner != nil {
 		// an owner has been provided and it is validated
 		linkAddress = "@" + c.Get("logged-in-user").(string) + "/" + linkAddress
 	}
 
+	// The content hash is the same hash used by exported chain bundles
+	sortBundleEdges(edges)
+	br := bundleRef{
+		ID:             linkAddress,
+		Data:           compactedJson,
+		Searchable:     r.Searchable,
+		SearchTitle:    r.SearchTitle,
+		SearchSynopsis: r.SearchSynopsis,
+		CreatedAt:      createdAt,
+		Parents:        edges,
+	}
+	if len(attachments) > 0 {
+		br.Files = attachments
+	}
+	if r.Owner != nil {
+		owner := c.Get("logged-in-user").(string)
+		br.Owner = &owner
+	}
+	contentHash := br.contentHash()
+
+	update := map[string]interface{}{
+		"uid":               uid,
+		"node.hashid":       hashid,
+		"node.content_hash": contentHash,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(update)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
 	err = txn.Commit(ctx)
 	if err != nil {
 		log.Println(err)
 		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
 	}
+	upload.commit()
+
+	if tsaURL != "" {
+		// Timestamping is best effort. The ref is still created if the TSA is unavailable.
+		// The TSA is contacted in the background after the ref is committed so that neither
+		// the transaction nor the response waits for it. The request's context is cancelled
+		// once the response is sent, so it has its own.
+		go func() {
+			if err := timestampRef(context.Background(), uid, contentHash); err != nil {
+				log.Println(err)
+			}
+		}()
+	}
+
+	suggestRef(linkAddress, r.Searchable, r.SearchTitle)
+
+	if err := indexSearchRefs(ctx, []string{uid}); err != nil {
+		log.Println(err)
+	}
+
+	if r.Searchable {
+		notifySavedSearches([]string{uid})
+	}
 
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"link": linkAddress,
 	})
 }
 
+// validateRefContent checks the data payload and search fields of a ref. The search title
+// and synopsis are trimmed. It is used when refs are created and imported.
+func validateRefContent(data string, searchable bool, searchTitle, searchSynopsis *string) error {
+
+	x := map[string]interface{}{}
+	err := json.Unmarshal([]byte(data), &x)
+	if err != nil {
+		return errors.New("data payload must be valid json object")
+	}
+
+	// Check if payload size is too big
+	if len([]byte(data)) > maxDataPayload*1024 {
+		return fmt.Errorf("data payload must be less than %dkB", maxDataPayload)
+	}
+
+	// Validate search related input
+	if searchable {
+		// We require at least a title or synopsis
+		if searchTitle == nil && searchSynopsis == nil {
+			return errors.New("when searchable is true, a search title or search synopsis is required")
+		}
+	}
+
+	if searchTitle != nil {
+		*searchTitle = strings.TrimSpace(*searchTitle)
+
+		if *searchTitle == "" {
+			return errors.New("search title must not be empty")
+		}
+
+		if len(*searchTitle) > 100 {
+			return errors.New("search title must be less than 100 characters")
+		}
+	}
+
+	if searchSynopsis != nil {
+		*searchSynopsis = strings.TrimSpace(*searchSynopsis)
+
+		if *searchSynopsis == "" {
+			return errors.New("search synopsis must not be empty")
+		}
+
+		if len(*searchSynopsis) > 800 {
+			return errors.New("search synopsis must be less than 800 characters")
+		}
+	}
+
+	return nil
+}
+
 // splitRefName returns facet, owner name and hashid
 func splitRefName(refName string) (string, *string, string, error) {
 
@@ -0,0 +1,202 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nbutton23/zxcvbn-go"
+)
+
+// New passwords must:
+//
+//	- have at least PASSWORD_MIN_LENGTH characters
+//	- have a zxcvbn strength score (0-4) of at least PASSWORD_MIN_SCORE
+//	- not be in the breached password list (BREACHED_PASSWORDS_FILE)
+//
+// The breached password list is a text file of upper-case hex encoded SHA-1 hashes sorted by
+// hash, one per line and optionally followed by ":<count>" (ie. the Pwned Passwords list
+// ordered by hash). Like the k-anonymity range api, a password is checked by reading all the
+// hashes that start with the first 5 characters of its hash. The file is searched on disk so
+// it can be large.
+
+// maxScoredPasswordLength limits the part of a password that is scored because zxcvbn is slow
+// for long passwords.
+const maxScoredPasswordLength = 100
+
+// breachedPrefixLength is the length of the hash prefix used to look up a password.
+const breachedPrefixLength = 5
+
+var (
+	breachedPasswordsOnce sync.Once
+	breachedPasswords     *breachedPasswordList
+)
+
+// validatePassword checks that a new password meets the password policy and matches its
+// confirmation. userInputs (eg. the account's name and email) make a password weaker if it
+// contains them.
+func validatePassword(password1, password2 string, userInputs []string) error {
+
+	if password1 == "" {
+		return errors.New("password must not be empty")
+	}
+
+	if len([]rune(password1)) < passwordMinLength {
+		return fmt.Errorf("password must contain at least %d characters", passwordMinLength)
+	}
+
+	if password1 != password2 {
+		return errors.New("passwords must match")
+	}
+
+	if passwordMinScore > 0 {
+		scored := password1
+		if len([]rune(scored)) > maxScoredPasswordLength {
+			scored = string([]rune(scored)[:maxScoredPasswordLength])
+		}
+
+		if zxcvbn.PasswordStrength(scored, userInputs).Score < passwordMinScore {
+			return errors.New("password is too easy to guess")
+		}
+	}
+
+	breachedPasswordsOnce.Do(func() {
+		if breachedPasswordsFile == "" {
+			return
+		}
+
+		list, err := openBreachedPasswordList(breachedPasswordsFile)
+		if err != nil {
+			log.Println(fmt.Sprintf("breached passwords: %v", err))
+			return
+		}
+		breachedPasswords = list
+	})
+
+	if breachedPasswords != nil {
+		breached, err := breachedPasswords.contains(password1)
+		if err != nil {
+			// The policy is not enforced rather than preventing all password changes
+			log.Println(fmt.Sprintf("breached passwords: %v", err))
+		} else if breached {
+			return errors.New("password has appeared in a data breach and must not be used")
+		}
+	}
+
+	return nil
+}
+
+// breachedPasswordList is a sorted file of SHA-1 hashes of breached passwords.
+type breachedPasswordList struct {
+	f    *os.File
+	size int64
+}
+
+func openBreachedPasswordList(path string) (*breachedPasswordList, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &breachedPasswordList{f: f, size: info.Size()}, nil
+}
+
+// contains returns true if the password's hash is in the list.
+func (bl *breachedPasswordList) contains(password string) (bool, error) {
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix := hash[:breachedPrefixLength]
+
+	// Find the first line at or after the prefix
+	lo, hi := int64(0), bl.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		line, _, err := bl.lineAt(mid)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+
+		if err == io.EOF || breachedHash(line) >= prefix {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	// Read the range of hashes with the prefix
+	off := lo
+	for {
+		line, next, err := bl.lineAt(off)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		h := breachedHash(line)
+		if !strings.HasPrefix(h, prefix) {
+			return false, nil
+		}
+		if h == hash {
+			return true, nil
+		}
+
+		off = next
+	}
+}
+
+// lineAt returns the first line that starts at or after off and the offset of the next line.
+func (bl *breachedPasswordList) lineAt(off int64) (string, int64, error) {
+
+	start := off
+	if off > 0 {
+		// Skip the rest of the line that contains off-1 (unless off is the start of a line)
+		start = off - 1
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(bl.f, start, bl.size-start))
+
+	if off > 0 {
+		skipped, err := r.ReadString('\n')
+		if err != nil {
+			return "", 0, io.EOF
+		}
+		start = start + int64(len(skipped))
+	}
+
+	line, err := r.ReadString('\n')
+	if line == "" && err != nil {
+		return "", 0, io.EOF
+	}
+
+	return strings.TrimSpace(line), start + int64(len(line)), nil
+}
+
+// breachedHash returns the hash of a line of the breached password list.
+func breachedHash(line string) string {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.ToUpper(line)
+}
@@ -0,0 +1,101 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeBreachedPasswordList writes a sorted list of hashes in the format of Have I Been Pwned's
+// downloads (HASH:count).
+func writeBreachedPasswordList(t *testing.T, passwords []string, newline string) string {
+
+	lines := []string{}
+	for i, p := range passwords {
+		sum := sha1.Sum([]byte(p))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	sort.Strings(lines)
+
+	f, err := ioutil.TempFile("", "breached")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	_, err = f.WriteString(strings.Join(lines, newline) + newline)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestBreachedPasswordListContains(t *testing.T) {
+
+	breached := []string{}
+	for i := 0; i < 2000; i++ {
+		breached = append(breached, fmt.Sprintf("password%d", i))
+	}
+
+	for _, newline := range []string{"\n", "\r\n"} {
+		bl, err := openBreachedPasswordList(writeBreachedPasswordList(t, breached, newline))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range breached {
+			found, err := bl.contains(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !found {
+				t.Errorf("contains(%q) = false, want true", p)
+			}
+		}
+
+		for i := 0; i < 2000; i++ {
+			p := fmt.Sprintf("correct horse %d", i)
+			found, err := bl.contains(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				t.Errorf("contains(%q) = true, want false", p)
+			}
+		}
+
+		bl.f.Close()
+	}
+}
+
+func TestBreachedPasswordListEmpty(t *testing.T) {
+
+	bl, err := openBreachedPasswordList(writeBreachedPasswordList(t, nil, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bl.f.Close()
+
+	found, err := bl.contains("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Error("contains = true for an empty list")
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/patrickmn/go-cache"
+)
+
+// queryOps maps the operators of a field filter to DGraph functions.
+// eg. year.ge=2018 => ge(xdata.year, 2018)
+var queryOps = map[string]string{
+	"":         "eq",
+	"gt":       "gt",
+	"ge":       "ge",
+	"lt":       "lt",
+	"le":       "le",
+	"term":     "anyofterms",
+	"allterms": "allofterms",
+}
+
+// queryVarTypes maps field types to GraphQL+- variable types.
+var queryVarTypes = map[string]string{
+	"int":      "int",
+	"float":    "float",
+	"bool":     "bool",
+	"datetime": "string",
+	"exact":    "string",
+	"term":     "string",
+	"text":     "string",
+}
+
+// queryHandler finds refs using the indexed fields of their data payload (see XDATA_INDEX).
+// Field filters are provided as query params in the form name[.op]=value and are combined
+// with AND. Repeating a filter combines its values with OR. Text fields match any of the
+// (stemmed) words of the value.
+// eg. /query?year.ge=2018&author.term=knuth&owner=@alice&from=2019-01-01
+//
+// The results can also be filtered by owner and by creation date (from and to).
+// Only searchable refs are returned unless the owner is the logged in user.
+func queryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	params := c.QueryParams()
+
+	vars := map[string]string{}
+	varDecls := []string{}
+	fns := []string{} // DGraph functions that must all match
+	rootIdx := -1     // index of the first function that can be used as the root function
+
+	addVar := func(typ, val string) string {
+		name := fmt.Sprintf("$v%d", len(vars))
+		vars[name] = val
+		varDecls = append(varDecls, name+": "+typ)
+		return name
+	}
+
+	fieldsByName := map[string]xdataField{}
+	for _, f := range xdataFields {
+		fieldsByName[f.Name] = f
+	}
+
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch k {
+		case "owner", "from", "to", "first", "offset":
+			continue
+		}
+
+		name, op := k, ""
+		if i := strings.Index(k, "."); i != -1 {
+			name, op = k[:i], k[i+1:]
+		}
+
+		f, exists := fieldsByName[name]
+		if !exists {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("%s is not an indexed field", name)))
+		}
+
+		fn, exists := queryOps[op]
+		if !exists {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("%s: unsupported operator %q", name, op)))
+		}
+
+		isTermOp := op == "term" || op == "allterms"
+		switch {
+		case f.Type == "term" && op == "":
+			fn = "anyofterms"
+		case f.Type == "text" && op == "":
+			fn = "anyoftext"
+		case isTermOp != (f.Type == "term"), f.Type == "bool" && op != "", f.Type == "text":
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("%s: operator %q is not supported for %s fields", name, op, f.Type)))
+		}
+
+		alternatives := []string{}
+		for _, val := range params[k] {
+			var v interface{} = val
+			if f.Type == "bool" {
+				b, err := strconv.ParseBool(val)
+				if err != nil {
+					return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("%s: %q is not a valid bool", name, val)))
+				}
+				v = b
+			}
+
+			v, ok := convertXDataValue(f.Type, v)
+			if !ok {
+				return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("%s: %q is not a valid %s", name, val, f.Type)))
+			}
+
+			var s string
+			switch x := v.(type) {
+			case time.Time:
+				s = x.Format(time.RFC3339)
+			default:
+				s = fmt.Sprintf("%v", x)
+			}
+
+			alternatives = append(alternatives, fmt.Sprintf("%s(%s, %s)", fn, f.predicate(), addVar(queryVarTypes[f.Type], s)))
+		}
+
+		if len(alternatives) == 1 {
+			if rootIdx == -1 {
+				rootIdx = len(fns)
+			}
+			fns = append(fns, alternatives[0])
+		} else {
+			fns = append(fns, "("+strings.Join(alternatives, " OR ")+")")
+		}
+	}
+
+	// Creation date
+	for _, p := range []struct{ param, fn string }{{"from", "ge"}, {"to", "le"}} {
+		val := strings.TrimSpace(c.QueryParam(p.param))
+		if val == "" {
+			continue
+		}
+
+		t, err := parseXDataTime(val)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("%s query param must be a date", p.param)))
+		}
+
+		if rootIdx == -1 {
+			rootIdx = len(fns)
+		}
+		fns = append(fns, fmt.Sprintf("%s(node.created_at, %s)", p.fn, addVar("string", t.Format(time.RFC3339))))
+	}
+
+	// Owner
+	owner := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.QueryParam("owner")), "@"))
+	ownerBlock := ""
+	if owner != "" {
+		ownerBlock = fmt.Sprintf(`
+			var(func: eq(user.name, %s)) {
+				o as ~node.owner
+			}
+		`, addVar("string", owner))
+		if rootIdx == -1 {
+			rootIdx = len(fns)
+		}
+		fns = append(fns, "uid(o)")
+	}
+
+	if len(fns) == 0 {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("at least one filter is required"))
+	}
+
+	loggedInUser := c.Get("logged-in-user")
+	private := owner != "" && loggedInUser != nil && loggedInUser.(string) == owner
+
+	// The root function is the first single-valued field filter so that only the refs matching
+	// it are filtered (an OR group of repeated values can't be used as the root function).
+	// Without one, it is a creation date filter or the owner's refs. The other filters and
+	// searchability are applied by @filter.
+	rootFn := "eq(node.searchable, true)"
+	filters := []string{}
+	for i, fn := range fns {
+		if i == rootIdx {
+			rootFn = fn
+		} else {
+			filters = append(filters, fn)
+		}
+	}
+
+	if !private && rootIdx != -1 {
+		filters = append(filters, "eq(node.searchable, true)")
+	}
+
+	first, offset := 50, 0
+	if val := c.QueryParam("first"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 || n > 500 {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("first query param must be between 1 and 500"))
+		}
+		first = n
+	}
+	if val := c.QueryParam("offset"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("offset query param is malformed"))
+		}
+		offset = n
+	}
+
+	// Check cache
+	key := fmt.Sprintf("query-%s", c.QueryParams().Encode())
+	if !private {
+		cachedData, found := memoryCache.Get(key)
+		if found {
+			return c.JSONPretty(http.StatusOK, cachedData, "  ")
+		}
+	}
+
+	filter := ""
+	if len(filters) > 0 {
+		filter = "@filter(" + strings.Join(filters, " AND ") + ")"
+	}
+
+	q := fmt.Sprintf(`
+		query withvar(%s) {
+			%s
+			results(func: %s, orderdesc: node.created_at, first: %d, offset: %d) @normalize %s {
+				node.owner {
+					name: user.name
+					%s
+				}
+				id: node.hashid
+				data: node.xdata
+				search_title: node.search_title
+				search_synopsis: node.search_synopsis
+				created_at: node.created_at
+			}
+		}
+	`, strings.Join(varDecls, ", "), ownerBlock, rootFn, first, offset, filter, ownerProfileFields)
+
+	if stdQueryTimeout != 0 {
+		// Create a max query timeout
+		_ctx, cancel := context.WithTimeout(ctx, time.Duration(stdQueryTimeout)*time.Millisecond)
+		defer cancel()
+		ctx = _ctx
+	}
+
+	txn := dg.NewReadOnlyTxn()
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		if strings.Contains(err.Error(), "context canceled") {
+			return c.NoContent(http.StatusNoContent)
+		} else if strings.Contains(err.Error(), "context deadline exceeded") {
+			return c.NoContent(http.StatusRequestTimeout)
+		}
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Results []searchRef `json:"results"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if root.Results == nil {
+		root.Results = []searchRef{}
+	}
+
+	// Store data in cache
+	if !private {
+		memoryCache.Set(key, root, cache.DefaultExpiration)
+	}
+
+	return c.JSONPretty(http.StatusOK, root, "  ")
+}
@@ -0,0 +1,149 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// rankSignals are the properties of a ref used to score its relevance.
+type rankSignals struct {
+	Title     string
+	Synopsis  string
+	CreatedAt time.Time
+	Citations int // number of refs linking to the ref
+}
+
+// scoreExplanation is the weighted contribution of each signal to a score.
+type scoreExplanation struct {
+	Title     float64 `json:"title"`     // fraction of the search words found in the title
+	Synopsis  float64 `json:"synopsis"`  // fraction of the search words found in the synopsis
+	Proximity float64 `json:"proximity"` // how close together the words of phrases are
+	Citations float64 `json:"citations"` // number of citations relative to the most cited result
+	Freshness float64 `json:"freshness"` // halves every RANK_FRESHNESS_HALF_LIFE days
+}
+
+func (se scoreExplanation) total() float64 {
+	return se.Title + se.Synopsis + se.Proximity + se.Citations + se.Freshness
+}
+
+// scoreRef scores the relevance of a ref for the search terms. Terms are the (non-negated)
+// words and phrases of the search. maxCitations is the highest number of citations of all
+// the refs being ranked.
+func scoreRef(sig rankSignals, terms []string, maxCitations int, now time.Time) scoreExplanation {
+
+	title := searchWords(sig.Title)
+	synopsis := searchWords(sig.Synopsis)
+
+	words := []string{}
+	groups := [][]string{} // words that should appear close together
+	for _, t := range terms {
+		w := searchWords(t)
+		words = append(words, w...)
+		if len(w) > 1 {
+			groups = append(groups, w)
+		}
+	}
+	if len(terms) > 1 && len(words) > 1 {
+		groups = append(groups, words)
+	}
+
+	var se scoreExplanation
+
+	se.Title = rankTitleWeight * wordCoverage(title, words)
+	se.Synopsis = rankSynopsisWeight * wordCoverage(synopsis, words)
+
+	if len(groups) > 0 {
+		var proximity float64
+		for _, g := range groups {
+			proximity = proximity + math.Max(wordProximity(title, g), wordProximity(synopsis, g))
+		}
+		se.Proximity = rankProximityWeight * proximity / float64(len(groups))
+	}
+
+	if maxCitations > 0 {
+		se.Citations = rankCitationWeight * math.Log1p(float64(sig.Citations)) / math.Log1p(float64(maxCitations))
+	}
+
+	if rankFreshnessHalfLife > 0 {
+		age := now.Sub(sig.CreatedAt).Hours() / 24
+		if age < 0 {
+			age = 0
+		}
+		se.Freshness = rankFreshnessWeight * math.Pow(0.5, age/rankFreshnessHalfLife)
+	}
+
+	return se
+}
+
+// wordCoverage returns the fraction of the words that are found in the text.
+func wordCoverage(text []string, words []string) float64 {
+
+	if len(words) == 0 {
+		return 0
+	}
+
+	present := map[string]struct{}{}
+	for _, w := range text {
+		present[w] = struct{}{}
+	}
+
+	found := 0
+	for _, w := range words {
+		if _, exists := present[w]; exists {
+			found++
+		}
+	}
+
+	return float64(found) / float64(len(words))
+}
+
+// wordProximity returns len(words) divided by the length of the shortest span of the text
+// that contains all of the words. It is 1 if the words are adjacent and 0 if they are not
+// all present.
+func wordProximity(text []string, words []string) float64 {
+
+	need := map[string]int{}
+	for _, w := range words {
+		need[w]++
+	}
+
+	window := map[string]int{}
+	satisfied := 0
+	best := 0
+
+	// Sliding window over text
+	left := 0
+	for right, w := range text {
+		if n, exists := need[w]; exists {
+			window[w]++
+			if window[w] == n {
+				satisfied++
+			}
+		}
+
+		for satisfied == len(need) {
+			if span := right - left + 1; best == 0 || span < best {
+				best = span
+			}
+
+			lw := text[left]
+			if n, exists := need[lw]; exists {
+				if window[lw] == n {
+					satisfied--
+				}
+				window[lw]--
+			}
+			left++
+		}
+	}
+
+	if best == 0 {
+		return 0
+	}
+
+	return float64(len(words)) / float64(best)
+}
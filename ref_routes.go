@@ -0,0 +1,138 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/labstack/echo"
+)
+
+// refGetHandler routes GET requests for a ref. A ref's sub-resources are addressed by
+// appending to the ref's id (eg. @owner/hashid/bundle). Everything else is a chain lookup.
+func refGetHandler(c echo.Context) error {
+
+	_, action, _ := splitRefPath(c.Param("*"))
+
+	switch action {
+	case "":
+		return findChainHandler(c)
+	case "bundle":
+		return bundleHandler(c)
+	case "timestamp":
+		return verifyTimestampHandler(c)
+	case "files":
+		return fileHandler(c)
+	}
+
+	return c.JSON(http.StatusNotFound, ErrorFmt("can't find ref"))
+}
+
+// refPostHandler routes POST requests for a ref's sub-resources.
+func refPostHandler(c echo.Context) error {
+
+	_, action, _ := splitRefPath(c.Param("*"))
+
+	switch action {
+	case "report":
+		return reportRefHandler(c)
+	}
+
+	return c.JSON(http.StatusNotFound, ErrorFmt("can't find ref"))
+}
+
+// splitRefPath splits a request path into the ref's id, the sub-resource requested and
+// the sub-resource's argument.
+// eg. "@owner/hashid/files/paper.pdf" returns "@owner/hashid", "files" and "paper.pdf".
+func splitRefPath(path string) (string, string, string) {
+
+	splits := strings.Split(strings.Trim(strings.TrimSpace(path), "/"), "/")
+
+	n := 1
+	if strings.HasPrefix(splits[0], "@") {
+		n = 2
+	}
+
+	if len(splits) <= n {
+		return strings.ToLower(strings.Join(splits, "/")), "", ""
+	}
+
+	nodeID := strings.ToLower(strings.Join(splits[:n], "/"))
+	action := splits[n]
+	arg := strings.Join(splits[n+1:], "/")
+
+	return nodeID, action, arg
+}
+
+// lookupRef returns the uid of the ref with the provided id (@owner/hashid or hashid).
+// Refs imported from another instance can also be found using their original id.
+// An empty uid is returned if the ref does not exist.
+func lookupRef(ctx context.Context, txn *dgo.Txn, nodeID string) (string, error) {
+
+	ownerName, hashID, err := splitNodeID(nodeID)
+	if err != nil {
+		return "", nil
+	}
+
+	vars := map[string]string{
+		"$hashid": hashID,
+		"$id":     nodeID,
+	}
+
+	const q = `
+		query withvar($hashid: string, $id: string) {
+			check(func: eq(node.hashid, $hashid)) @normalize {
+				uid: uid
+				node.owner {
+					name: user.name
+				}
+			}
+
+			alias(func: eq(node.alias, $id), first: 1) {
+				uid
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return "", err
+	}
+
+	type Root struct {
+		Check []struct {
+			UID  string  `json:"uid"`
+			Name *string `json:"name"`
+		} `json:"check"`
+		Alias []struct {
+			UID string `json:"uid"`
+		} `json:"alias"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return "", err
+	}
+
+	for _, n := range root.Check {
+		if ownerName == nil && n.Name == nil {
+			return n.UID, nil
+		}
+		if ownerName != nil && n.Name != nil && *ownerName == *n.Name {
+			return n.UID, nil
+		}
+	}
+
+	if len(root.Alias) == 1 {
+		return root.Alias[0].UID, nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,406 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// Anyone can report a ref that breaks the rules (POST /@owner/hashid/report). Reports are added
+// to a moderation queue that admins work through (see admin_reports.go). A report is open
+// until an admin dismisses it or takes action (hides the ref or suspends its owner). Reporters
+// are emailed when their report is resolved and logged in reporters can follow their reports
+// using GET /reports.
+
+// reportReasons are the categories of a report.
+var reportReasons = []string{"spam", "abuse", "copyright", "illegal", "personal_information", "misleading", "other"}
+
+// The status of a report
+const (
+	reportOpen      = "open"
+	reportDismissed = "dismissed"
+	reportActioned  = "actioned"
+)
+
+type reportInput struct {
+	Reason        string `json:"reason" form:"reason"`                 // Required (see reportReasons)
+	Details       string `json:"details" form:"details"`               // Required if the reason is other
+	Email         string `json:"email" form:"email"`                   // Optional (if not logged in) for status updates
+	RecaptchaCode string `json:"recaptcha_code" form:"recaptcha_code"` // Required if not logged in
+}
+
+// refReport is a report and the ref it is about.
+type refReport struct {
+	UID        string     `json:"uid"`
+	Reason     string     `json:"report.reason"`
+	Details    *string    `json:"report.details"`
+	Status     string     `json:"report.status"`
+	Action     *string    `json:"report.action"`
+	Email      *string    `json:"report.email"`
+	CreatedAt  time.Time  `json:"report.created_at"`
+	ResolvedAt *time.Time `json:"report.resolved_at"`
+	Ref        []struct {
+		UID          string       `json:"uid"`
+		HashID       string       `json:"node.hashid"`
+		Owner        []OwnerModel `json:"node.owner"`
+		SearchTitle  *string      `json:"node.search_title"`
+		HiddenAt     *time.Time   `json:"node.hidden_at"`
+		TombstonedAt *time.Time   `json:"node.tombstoned_at"`
+	} `json:"report.ref"`
+	Reporter []struct {
+		UID   string  `json:"uid"`
+		Name  string  `json:"user.name"`
+		Email *string `json:"user.email"`
+	} `json:"report.reporter"`
+}
+
+// refReportFields are the fields of a refReport. They are used within queries.
+const refReportFields = `
+	uid
+	report.reason
+	report.details
+	report.status
+	report.action
+	report.email
+	report.created_at
+	report.resolved_at
+	report.ref {
+		uid
+		node.hashid
+		node.owner {
+			user.name
+		}
+		node.search_title
+		node.hidden_at
+		node.tombstoned_at
+	}
+	report.reporter {
+		uid
+		user.name
+		user.email
+	}
+`
+
+// refID returns the id of the reported ref.
+func (r *refReport) refID() string {
+	if len(r.Ref) == 0 {
+		return ""
+	}
+	if len(r.Ref[0].Owner) == 1 {
+		return "@" + r.Ref[0].Owner[0].Name + "/" + r.Ref[0].HashID
+	}
+	return r.Ref[0].HashID
+}
+
+// reporterEmail returns the email address that status updates are sent to (if any).
+func (r *refReport) reporterEmail() string {
+	if len(r.Reporter) > 0 && r.Reporter[0].Email != nil {
+		return *r.Reporter[0].Email
+	}
+	if r.Email != nil {
+		return *r.Email
+	}
+	return ""
+}
+
+// view returns the report as shown to its reporter. Admins also see the reporter and the
+// state of the ref.
+func (r *refReport) view(admin bool) (map[string]interface{}, error) {
+
+	id, err := h.EncodeHex(r.UID[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]interface{}{
+		"id":         id,
+		"ref":        r.refID(),
+		"reason":     r.Reason,
+		"status":     r.Status,
+		"created_at": r.CreatedAt,
+	}
+
+	if r.Details != nil {
+		out["details"] = *r.Details
+	}
+	if r.Action != nil {
+		out["action"] = *r.Action
+	}
+	if r.ResolvedAt != nil {
+		out["resolved_at"] = *r.ResolvedAt
+	}
+
+	if admin {
+		if len(r.Reporter) > 0 {
+			out["reporter"] = "@" + r.Reporter[0].Name
+		}
+		if email := r.reporterEmail(); email != "" {
+			out["reporter_email"] = email
+		}
+		if len(r.Ref) > 0 {
+			ref := r.Ref[0]
+			if ref.SearchTitle != nil {
+				out["ref_title"] = *ref.SearchTitle
+			}
+			if ref.HiddenAt != nil {
+				out["ref_hidden_at"] = *ref.HiddenAt
+			}
+			if ref.TombstonedAt != nil {
+				out["ref_tombstoned_at"] = *ref.TombstonedAt
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// reportUID converts the id of a report to its uid.
+func reportUID(id string) (string, error) {
+	decoded, err := h.DecodeHex(strings.TrimSpace(id))
+	if err != nil || decoded == "" {
+		return "", errors.New("can't find report")
+	}
+	return "0x" + decoded, nil
+}
+
+// validateReport checks and normalizes a report.
+func validateReport(r *reportInput) error {
+
+	r.Reason = strings.ToLower(strings.TrimSpace(r.Reason))
+	r.Details = strings.TrimSpace(r.Details)
+	r.Email = strings.ToLower(strings.TrimSpace(r.Email))
+
+	valid := false
+	for _, reason := range reportReasons {
+		if r.Reason == reason {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("reason must be one of: %s", strings.Join(reportReasons, ", "))
+	}
+
+	if r.Reason == "other" && r.Details == "" {
+		return errors.New("details are required if the reason is other")
+	}
+
+	if utf8.RuneCountInString(r.Details) > 1000 {
+		return errors.New("details must be less than 1000 characters")
+	}
+
+	if r.Email != "" {
+		if err := validateEmail(r.Email); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reportRefHandler adds a report about a ref to the moderation queue. A logged in reporter
+// can only have one open report per ref.
+func reportRefHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	nodeID, _, _ := splitRefPath(c.Param("*"))
+
+	r := new(reportInput)
+	if err := c.Bind(r); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	if err := validateReport(r); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		err := recaptchaCheck(r.RecaptchaCode)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("recaptcha invalid"))
+		}
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	refUID, err := lookupRef(ctx, txn, nodeID)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if refUID == "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
+	}
+
+	data := map[string]interface{}{
+		"uid":               "_:report",
+		"report":            true,
+		"report.ref":        map[string]string{"uid": refUID},
+		"report.reason":     r.Reason,
+		"report.status":     reportOpen,
+		"report.created_at": time.Now().UTC(),
+	}
+
+	if r.Details != "" {
+		data["report.details"] = r.Details
+	}
+
+	if loggedInUser != nil {
+		reporterUID := c.Get("logged-in-user-uid").(string)
+
+		existing, err := openReportUID(ctx, txn, refUID, reporterUID)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		if existing != "" {
+			id, err := h.EncodeHex(existing[2:])
+			if err != nil {
+				log.Println(err)
+				return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+			}
+			return c.JSONPretty(http.StatusOK, map[string]interface{}{"id": id, "status": reportOpen}, "  ")
+		}
+
+		data["report.reporter"] = map[string]string{"uid": reporterUID}
+	} else if r.Email != "" {
+		data["report.email"] = r.Email
+	}
+
+	assigned, err := txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	id, err := h.EncodeHex(assigned.Uids["report"][2:])
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	return c.JSONPretty(http.StatusCreated, map[string]interface{}{"id": id, "status": reportOpen}, "  ")
+}
+
+// openReportUID returns the uid of the reporter's open report about a ref (if any).
+func openReportUID(ctx context.Context, txn *dgo.Txn, refUID, reporterUID string) (string, error) {
+
+	vars := map[string]string{
+		"$ref":      refUID,
+		"$reporter": reporterUID,
+	}
+
+	const q = `
+		query withvar($ref: string, $reporter: string) {
+			reports(func: uid($ref)) @normalize {
+				~report.ref @filter(eq(report.status, "open") AND uid_in(report.reporter, $reporter)) {
+					uid: uid
+				}
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return "", err
+	}
+
+	type Root struct {
+		Reports []struct {
+			UID string `json:"uid"`
+		} `json:"reports"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return "", err
+	}
+
+	if len(root.Reports) == 0 {
+		return "", nil
+	}
+
+	return root.Reports[0].UID, nil
+}
+
+// listReportsHandler lists the reports of the logged in account, newest first.
+func listReportsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return c.JSON(http.StatusUnauthorized, ErrorFmt("reports require login"))
+	}
+
+	vars := map[string]string{
+		"$uid": c.Get("logged-in-user-uid").(string),
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($uid: string) {
+			user(func: uid($uid)) {
+				~report.reporter(orderdesc: report.created_at) {
+					%s
+				}
+			}
+		}
+	`, refReportFields)
+
+	resp, err := dg.NewReadOnlyTxn().QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		User []struct {
+			Reports []refReport `json:"~report.reporter"`
+		} `json:"user"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	out := []map[string]interface{}{}
+	if len(root.User) > 0 {
+		for i := range root.User[0].Reports {
+			v, err := root.User[0].Reports[i].view(false)
+			if err != nil {
+				log.Println(err)
+				return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+			}
+			out = append(out, v)
+		}
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"reports": out}, "  ")
+}
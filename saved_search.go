@@ -0,0 +1,1135 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// Logged in users can save a search (terms and filters). New searchable refs are matched
+// against all saved searches and the matches are added to the feed of the search's owner
+// (see feedHandler). Matches can also be emailed as a digest (see SAVED_SEARCH_DIGEST_HOURS)
+// or posted to a webhook.
+//
+// Webhook requests are signed. The X-Lemma-Signature header is "sha256=" followed by the
+// hex encoded HMAC-SHA256 of the request body, keyed by the secret returned when the search
+// was saved.
+
+// savedSearchParams are the search query params that are saved. Sort and pagination are not.
+var savedSearchParams = []string{"q", "owner", "from", "to", "cites", "types", "schema", "lang", "mode"}
+
+// webhookClient only connects to public addresses. The webhook's host is resolved when the
+// request is made (not when the search is saved) and redirects are not followed, so a webhook
+// can't be used to reach the instance's internal network.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !publicIP(net.ParseIP(host)) {
+					return fmt.Errorf("webhook address is not public: %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errors.New("webhook redirects are not followed")
+	},
+}
+
+// nonPublicNetworks are the address ranges that webhooks can't connect to.
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link local (incl. cloud metadata services)
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved (incl. broadcast)
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link local
+	"ff00::/8",       // multicast
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	out := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// publicIP returns true if ip is a public (globally routable) address.
+func publicIP(ip net.IP) bool {
+
+	if ip == nil {
+		return false
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type savedSearchInput struct {
+	Name    string `json:"name" form:"name"`
+	Query   string `json:"query" form:"query"`     // query params of a search. eg. "q=graph+theory&types=cites"
+	Notify  string `json:"notify" form:"notify"`   // none (default), email or webhook
+	Webhook string `json:"webhook" form:"webhook"` // required if notify is webhook
+}
+
+// savedSearch is a saved search as returned by the API.
+type savedSearch struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Query     string    `json:"query"`
+	Notify    string    `json:"notify"`
+	Webhook   *string   `json:"webhook,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// parseSavedSearchQuery keeps the search query params that are saved and checks that they
+// are valid. The returned string is the normalized query.
+func parseSavedSearchQuery(query string) (string, searchQuery, error) {
+
+	params, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(query), "?"))
+	if err != nil {
+		return "", searchQuery{}, errors.New("query is malformed")
+	}
+
+	saved := url.Values{}
+	for _, k := range savedSearchParams {
+		if val := strings.TrimSpace(params.Get(k)); val != "" {
+			saved.Set(k, val)
+		}
+	}
+
+	sq, err := parseSearchParams("", saved)
+	if err != nil {
+		return "", sq, err
+	}
+
+	if sq.Expr == nil && !sq.hasFilters() {
+		return "", sq, errors.New("query must contain search terms or filters")
+	}
+
+	return saved.Encode(), sq, nil
+}
+
+// savedSearchUID converts the id of a saved search to its uid.
+func savedSearchUID(id string) (string, error) {
+	decoded, err := h.DecodeHex(strings.TrimSpace(id))
+	if err != nil || decoded == "" {
+		return "", errors.New("saved search not found")
+	}
+	return "0x" + decoded, nil
+}
+
+// createSavedSearchHandler saves a search for the logged in account.
+func createSavedSearchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return c.JSON(http.StatusUnauthorized, ErrorFmt("saved searches require login"))
+	}
+
+	si := new(savedSearchInput)
+	if err := c.Bind(si); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	si.Name = strings.TrimSpace(si.Name)
+	if si.Name == "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("name must not be empty"))
+	}
+
+	if len(si.Name) > 100 {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("name must be less than 100 characters"))
+	}
+
+	query, _, err := parseSavedSearchQuery(si.Query)
+	if err != nil {
+		if se, ok := err.(*searchSyntaxError); ok {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":  "search query is malformed",
+				"errors": []*searchSyntaxError{se},
+			})
+		}
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	si.Webhook = strings.TrimSpace(si.Webhook)
+
+	switch si.Notify {
+	case "":
+		si.Notify = "none"
+	case "none":
+	case "email":
+		if !emailConfigured() {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("email notifications are not available"))
+		}
+	case "webhook":
+		u, err := url.Parse(si.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || len(si.Webhook) > 500 {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("webhook must be a valid http(s) url"))
+		}
+
+		// Hostnames are checked when the webhook is called (see webhookClient)
+		if ip := net.ParseIP(u.Hostname()); (ip != nil && !publicIP(ip)) || strings.EqualFold(u.Hostname(), "localhost") {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("webhook must be a public address"))
+		}
+	default:
+		return c.JSON(http.StatusBadRequest, ErrorFmt("notify must be none, email or webhook"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$uid": c.Get("logged-in-user-uid").(string),
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			owner(func: uid($uid)) {
+				count: count(~saved_search.owner)
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Owner []struct {
+			Count int `json:"count"`
+		} `json:"owner"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if len(root.Owner) > 0 && root.Owner[0].Count >= maxSavedSearches {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("max %d saved searches permitted", maxSavedSearches)))
+	}
+
+	data := map[string]interface{}{
+		"uid":                     "_:search",
+		"saved_search":            true,
+		"saved_search.name":       si.Name,
+		"saved_search.query":      query,
+		"saved_search.notify":     si.Notify,
+		"saved_search.owner":      map[string]string{"uid": c.Get("logged-in-user-uid").(string)},
+		"saved_search.created_at": time.Now().UTC(),
+	}
+
+	secret := ""
+	if si.Notify == "webhook" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+		secret = hex.EncodeToString(b)
+
+		data["saved_search.webhook"] = si.Webhook
+		data["saved_search.secret"] = secret
+	}
+
+	assigned, err := txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	id, err := h.EncodeHex(assigned.Uids["search"][2:])
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	out := map[string]interface{}{
+		"id": id,
+	}
+	if secret != "" {
+		// The secret is only returned once
+		out["secret"] = secret
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+// listSavedSearchesHandler lists the saved searches of the logged in account.
+func listSavedSearchesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return c.JSON(http.StatusUnauthorized, ErrorFmt("saved searches require login"))
+	}
+
+	txn := dg.NewReadOnlyTxn()
+
+	vars := map[string]string{
+		"$uid": c.Get("logged-in-user-uid").(string),
+	}
+
+	const q = `
+		query withvar($uid: string) {
+			owner(func: uid($uid)) {
+				~saved_search.owner(orderasc: saved_search.created_at) {
+					uid
+					saved_search.name
+					saved_search.query
+					saved_search.notify
+					saved_search.webhook
+					saved_search.created_at
+				}
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Owner []struct {
+			Searches []struct {
+				UID       string    `json:"uid"`
+				Name      string    `json:"saved_search.name"`
+				Query     string    `json:"saved_search.query"`
+				Notify    string    `json:"saved_search.notify"`
+				Webhook   *string   `json:"saved_search.webhook"`
+				CreatedAt time.Time `json:"saved_search.created_at"`
+			} `json:"~saved_search.owner"`
+		} `json:"owner"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	out := []savedSearch{}
+	if len(root.Owner) > 0 {
+		for _, s := range root.Owner[0].Searches {
+			id, err := h.EncodeHex(s.UID[2:])
+			if err != nil {
+				log.Println(err)
+				return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+			}
+
+			out = append(out, savedSearch{
+				ID:        id,
+				Name:      s.Name,
+				Query:     s.Query,
+				Notify:    s.Notify,
+				Webhook:   s.Webhook,
+				CreatedAt: s.CreatedAt,
+			})
+		}
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"searches": out}, "  ")
+}
+
+// deleteSavedSearchHandler deletes a saved search of the logged in account and its feed items.
+func deleteSavedSearchHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return c.JSON(http.StatusUnauthorized, ErrorFmt("saved searches require login"))
+	}
+
+	uid, err := savedSearchUID(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ErrorFmt(err))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$uid":   uid,
+		"$owner": c.Get("logged-in-user-uid").(string),
+	}
+
+	const q = `
+		query withvar($uid: string, $owner: string) {
+			search(func: uid($uid)) @filter(eq(saved_search, true)) @cascade {
+				uid
+				saved_search.owner @filter(uid($owner)) {
+					uid
+				}
+			}
+
+			items(func: uid($uid)) {
+				~feed_item.search {
+					uid
+				}
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type node struct {
+		UID string `json:"uid"`
+	}
+
+	type Root struct {
+		Search []node `json:"search"`
+		Items  []struct {
+			Items []node `json:"~feed_item.search"`
+		} `json:"items"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if len(root.Search) == 0 {
+		return c.JSON(http.StatusNotFound, ErrorFmt("saved search not found"))
+	}
+
+	nodes := []node{{UID: uid}}
+	if len(root.Items) > 0 {
+		nodes = append(nodes, root.Items[0].Items...)
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(nodes)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// feedHandler returns the refs that matched the saved searches of the logged in account,
+// newest first. Results are paginated using first and after (like searchHandler).
+func feedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return c.JSON(http.StatusUnauthorized, ErrorFmt("feed requires login"))
+	}
+
+	first, offset := 20, 0
+	if val := c.QueryParam("first"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 || n > maxSearchResults {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("first query param must be between 1 and %d", maxSearchResults)))
+		}
+		first = n
+	}
+	if val := c.QueryParam("after"); val != "" {
+		n, err := decodeSearchCursor(val)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+		}
+		offset = n
+	}
+
+	txn := dg.NewReadOnlyTxn()
+
+	vars := map[string]string{
+		"$uid": c.Get("logged-in-user-uid").(string),
+	}
+
+	q := fmt.Sprintf(`
+		query withvar($uid: string) {
+			owner(func: uid($uid)) {
+				count: count(~feed_item.owner)
+				~feed_item.owner(orderdesc: feed_item.created_at, first: %d, offset: %d) {
+					feed_item.created_at
+					feed_item.search {
+						uid
+						saved_search.name
+					}
+					feed_item.ref {
+						uid
+					}
+				}
+			}
+		}
+	`, first, offset)
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Owner []struct {
+			Count int `json:"count"`
+			Items []struct {
+				CreatedAt time.Time `json:"feed_item.created_at"`
+				Search    []struct {
+					UID  string `json:"uid"`
+					Name string `json:"saved_search.name"`
+				} `json:"feed_item.search"`
+				Ref []struct {
+					UID string `json:"uid"`
+				} `json:"feed_item.ref"`
+			} `json:"~feed_item.owner"`
+		} `json:"owner"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	items := []map[string]interface{}{}
+	total, count := 0, 0
+
+	if len(root.Owner) > 0 {
+		total = root.Owner[0].Count
+		count = len(root.Owner[0].Items)
+
+		uids := []string{}
+		for _, item := range root.Owner[0].Items {
+			if len(item.Ref) > 0 {
+				uids = append(uids, item.Ref[0].UID)
+			}
+		}
+
+		refs, err := loadSearchRefs(ctx, txn, uids)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+
+		for _, item := range root.Owner[0].Items {
+			if len(item.Search) == 0 || len(item.Ref) == 0 {
+				continue
+			}
+
+			ref, exists := refs[item.Ref[0].UID]
+			if !exists {
+				// Ref has been deleted
+				continue
+			}
+
+			id, err := h.EncodeHex(item.Search[0].UID[2:])
+			if err != nil {
+				log.Println(err)
+				return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+			}
+
+			items = append(items, map[string]interface{}{
+				"search":     map[string]string{"id": id, "name": item.Search[0].Name},
+				"ref":        &ref,
+				"created_at": item.CreatedAt,
+			})
+		}
+	}
+
+	out := map[string]interface{}{
+		"items": items,
+		"total": total,
+	}
+	if offset+count < total {
+		out["next"] = encodeSearchCursor(offset + count)
+	}
+
+	return c.JSONPretty(http.StatusOK, out, "  ")
+}
+
+// storedSearch is a saved search loaded for matching new refs.
+type storedSearch struct {
+	UID     string  `json:"uid"`
+	Name    string  `json:"saved_search.name"`
+	Query   string  `json:"saved_search.query"`
+	Notify  string  `json:"saved_search.notify"`
+	Webhook *string `json:"saved_search.webhook"`
+	Secret  *string `json:"saved_search.secret"`
+	Owner   []struct {
+		UID string `json:"uid"`
+	} `json:"saved_search.owner"`
+}
+
+// savedSearchQueue holds new refs until they are matched against the saved searches. It is
+// consumed by a single worker (see startSavedSearchMatcher) so that bursts of new refs don't
+// run many matches concurrently.
+var savedSearchQueue = make(chan []string, 1000)
+
+// savedSearchPage is the number of saved searches loaded at a time when matching.
+const savedSearchPage = 200
+
+// notifySavedSearches queues new refs to be matched against the saved searches.
+func notifySavedSearches(uids []string) {
+
+	if len(uids) == 0 {
+		return
+	}
+
+	select {
+	case savedSearchQueue <- uids:
+	default:
+		log.Println(fmt.Sprintf("saved searches: queue is full. %d refs were not matched", len(uids)))
+	}
+}
+
+// startSavedSearchMatcher matches queued refs against the saved searches in the background.
+// Refs that are queued while a match is running are matched together.
+func startSavedSearchMatcher() {
+	go func() {
+		for uids := range savedSearchQueue {
+		drain:
+			for len(uids) < 500 {
+				select {
+				case more := <-savedSearchQueue:
+					uids = append(uids, more...)
+				default:
+					break drain
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			if err := matchSavedSearches(ctx, uids); err != nil {
+				log.Println(fmt.Sprintf("saved searches: %v", err))
+			}
+			cancel()
+		}
+	}()
+}
+
+// matchSavedSearches adds new refs to the feeds of the saved searches that they match and
+// calls the webhooks. Refs are not matched against their owner's saved searches. Only
+// searchable refs can match, and the saved searches are loaded a page at a time.
+func matchSavedSearches(ctx context.Context, uids []string) error {
+
+	txn := dg.NewReadOnlyTxn()
+
+	q := fmt.Sprintf(`
+		{
+			refs(func: uid(%s)) @filter(eq(node.searchable, true)) {
+				uid
+				node.owner {
+					uid
+				}
+			}
+		}
+	`, strings.Join(uids, ", "))
+
+	resp, err := txn.Query(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	type Root struct {
+		Refs []struct {
+			UID   string `json:"uid"`
+			Owner []struct {
+				UID string `json:"uid"`
+			} `json:"node.owner"`
+		} `json:"refs"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	if len(root.Refs) == 0 {
+		return nil
+	}
+
+	searchable := []string{}
+	refOwners := map[string]string{} // ref uid => owner uid
+	for _, r := range root.Refs {
+		searchable = append(searchable, r.UID)
+		if len(r.Owner) > 0 {
+			refOwners[r.UID] = r.Owner[0].UID
+		}
+	}
+
+	type match struct {
+		search storedSearch
+		ref    string
+	}
+
+	matches := []match{}
+	items := []map[string]interface{}{}
+	now := time.Now().UTC()
+
+	after := "0x0"
+	for {
+		searches, err := loadStoredSearches(ctx, txn, after)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range searches {
+			if len(s.Owner) == 0 {
+				continue
+			}
+
+			// Skip the search if all the refs belong to its owner
+			candidates := []string{}
+			for _, ref := range searchable {
+				if refOwners[ref] != s.Owner[0].UID {
+					candidates = append(candidates, ref)
+				}
+			}
+
+			if len(candidates) == 0 {
+				continue
+			}
+
+			matched, err := savedSearchMatches(ctx, txn, s.Query, candidates)
+			if err != nil {
+				log.Println(fmt.Sprintf("saved search %s: %v", s.UID, err))
+				continue
+			}
+
+			for _, ref := range matched {
+				matches = append(matches, match{s, ref})
+				items = append(items, map[string]interface{}{
+					"feed_item":            true,
+					"feed_item.owner":      map[string]string{"uid": s.Owner[0].UID},
+					"feed_item.search":     map[string]string{"uid": s.UID},
+					"feed_item.ref":        map[string]string{"uid": ref},
+					"feed_item.created_at": now,
+					"feed_item.emailed":    false,
+				})
+			}
+		}
+
+		if len(searches) < savedSearchPage {
+			break
+		}
+		after = searches[len(searches)-1].UID
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	wtxn := dg.NewTxn()
+	defer wtxn.Discard(ctx)
+
+	_, err = wtxn.Mutate(ctx, &api.Mutation{SetJson: marshal(items)})
+	if err != nil {
+		return err
+	}
+
+	err = wtxn.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Webhooks
+	refs, err := loadSearchRefs(ctx, dg.NewReadOnlyTxn(), searchable)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range matches {
+		if m.search.Notify != "webhook" || m.search.Webhook == nil || m.search.Secret == nil {
+			continue
+		}
+
+		ref, exists := refs[m.ref]
+		if !exists {
+			continue
+		}
+
+		if err := postSavedSearchWebhook(ctx, m.search, ref); err != nil {
+			log.Println(fmt.Sprintf("saved search %s: webhook: %v", m.search.UID, err))
+		}
+	}
+
+	return nil
+}
+
+// loadStoredSearches fetches a page of saved searches ordered by uid, starting after the
+// provided uid.
+func loadStoredSearches(ctx context.Context, txn *dgo.Txn, after string) ([]storedSearch, error) {
+
+	q := fmt.Sprintf(`
+		{
+			searches(func: eq(saved_search, true), first: %d, after: %s) {
+				uid
+				saved_search.name
+				saved_search.query
+				saved_search.notify
+				saved_search.webhook
+				saved_search.secret
+				saved_search.owner {
+					uid
+				}
+			}
+		}
+	`, savedSearchPage, after)
+
+	resp, err := txn.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Searches []storedSearch `json:"searches"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	return root.Searches, nil
+}
+
+// savedSearchMatches returns the refs (of uids) that match a saved search query.
+func savedSearchMatches(ctx context.Context, txn *dgo.Txn, query string, uids []string) ([]string, error) {
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	sq, err := parseSearchParams("", params)
+	if err != nil {
+		return nil, err
+	}
+	sq.Refs = uids
+
+	match, err := buildSearchMatch(ctx, txn, sq)
+	if err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf(`
+		query withvar(%s) {
+			%s
+
+			matched(func: uid(m)) {
+				uid
+			}
+		}
+	`, match.Decls, match.Blocks)
+
+	resp, err := txn.QueryWithVars(ctx, q, match.Vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Matched []struct {
+			UID string `json:"uid"`
+		} `json:"matched"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{}
+	for _, m := range root.Matched {
+		out = append(out, m.UID)
+	}
+
+	return out, nil
+}
+
+// postSavedSearchWebhook posts a ref that matched a saved search to the search's webhook.
+func postSavedSearchWebhook(ctx context.Context, s storedSearch, ref searchRef) error {
+
+	id, err := h.EncodeHex(s.UID[2:])
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"search": map[string]string{"id": id, "name": s.Name},
+		"ref":    &ref,
+	})
+	if err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, []byte(*s.Secret))
+	mac.Write(body)
+
+	req, err := http.NewRequest(http.MethodPost, *s.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Lemma-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// startSavedSearchDigests periodically emails the new matches of saved searches with email
+// notifications.
+func startSavedSearchDigests() {
+
+	if savedSearchDigestHours <= 0 || !emailConfigured() {
+		return
+	}
+
+	go func() {
+		c := time.Tick(time.Duration(savedSearchDigestHours) * time.Hour)
+		for range c {
+			if err := sendSavedSearchDigests(context.Background()); err != nil {
+				log.Println(fmt.Sprintf("saved search digests: %v", err))
+			}
+		}
+	}()
+}
+
+// sendSavedSearchDigests emails each account the feed items that have not been emailed.
+func sendSavedSearchDigests(ctx context.Context) error {
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	const q = `
+		{
+			var(func: eq(saved_search.notify, "email")) {
+				i as ~feed_item.search @filter(eq(feed_item.emailed, false))
+			}
+
+			items(func: uid(i), orderasc: feed_item.created_at, first: 10000) {
+				uid
+				feed_item.owner {
+					user.email
+				}
+				feed_item.search {
+					saved_search.name
+				}
+				feed_item.ref {
+					uid
+				}
+			}
+		}
+	`
+
+	resp, err := txn.Query(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	type Root struct {
+		Items []struct {
+			UID   string `json:"uid"`
+			Owner []struct {
+				Email string `json:"user.email"`
+			} `json:"feed_item.owner"`
+			Search []struct {
+				Name string `json:"saved_search.name"`
+			} `json:"feed_item.search"`
+			Ref []struct {
+				UID string `json:"uid"`
+			} `json:"feed_item.ref"`
+		} `json:"items"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	if len(root.Items) == 0 {
+		return nil
+	}
+
+	uids := []string{}
+	for _, item := range root.Items {
+		if len(item.Ref) > 0 {
+			uids = append(uids, item.Ref[0].UID)
+		}
+	}
+
+	refs, err := loadSearchRefs(ctx, txn, uids)
+	if err != nil {
+		return err
+	}
+
+	type digest struct {
+		items    []string            // uids of the feed items
+		searches map[string][]string // search name => links to refs
+	}
+
+	digests := map[string]*digest{} // key = email
+
+	for _, item := range root.Items {
+		if len(item.Owner) == 0 {
+			continue
+		}
+
+		email := item.Owner[0].Email
+		d, exists := digests[email]
+		if !exists {
+			d = &digest{searches: map[string][]string{}}
+			digests[email] = d
+		}
+		d.items = append(d.items, item.UID)
+
+		if len(item.Search) == 0 || len(item.Ref) == 0 {
+			continue
+		}
+
+		ref, exists := refs[item.Ref[0].UID]
+		if !exists {
+			continue
+		}
+
+		id := ref.refAddress()
+
+		title := id
+		if ref.SearchTitle != nil {
+			title = *ref.SearchTitle
+		}
+
+		link := fmt.Sprintf("%s/%s", serverHostUrl, id)
+		d.searches[item.Search[0].Name] = append(d.searches[item.Search[0].Name], fmt.Sprintf("<a href=\"%s\">%s</a>", link, html.EscapeString(title)))
+	}
+
+	emailed := []map[string]interface{}{}
+
+	for email, d := range digests {
+		if len(d.searches) > 0 {
+			names := []string{}
+			for name := range d.searches {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			var body strings.Builder
+			for _, name := range names {
+				body.WriteString("<h3>" + html.EscapeString(name) + "</h3><ul>")
+				for _, link := range d.searches[name] {
+					body.WriteString("<li>" + link + "</li>")
+				}
+				body.WriteString("</ul>")
+			}
+
+			if err := deliverEmail(email, "New refs matching your saved searches", body.String()); err != nil {
+				log.Println(fmt.Sprintf("saved search digests: %s: %v", email, err))
+				continue
+			}
+		}
+
+		for _, uid := range d.items {
+			emailed = append(emailed, map[string]interface{}{"uid": uid, "feed_item.emailed": true})
+		}
+	}
+
+	if len(emailed) == 0 {
+		return nil
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(emailed)})
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit(ctx)
+}
@@ -6,7 +6,11 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 
 	"github.com/dgraph-io/dgo/protos/api"
 )
@@ -16,23 +20,104 @@ func setSchema() {
 	op := &api.Operation{}
 	op.Schema = `
 		user: bool @index(bool) .
-		user.name: string @index(hash) .
-		user.email: string @index(hash) .
+		user.name: string @index(hash, trigram) .
+		user.email: string @index(hash, trigram) .
 		user.password: password .
 		user.code: string @index(hash) . 
+		user.code_expires_at: dateTime @index(hour) .
+		user.code_sent_at: dateTime .
 		user.created_at: dateTime @index(day) .
 		user.validated: bool @index(bool) .
+		user.pending_email: string @index(hash) .
+		user.deleted_at: dateTime .
+		user.totp_secret: string .
+		user.totp_pending_secret: string .
+		user.totp_last_step: int .
+		user.recovery_codes: [string] .
+		user.display_name: string .
+		user.bio: string .
+		user.affiliation: string .
+		user.orcid: string @index(exact) .
+		user.homepage: string .
+		user.avatar: string .
+		user.attachments_added_at: dateTime .
+		user.admin: bool @index(bool) .
+		user.suspended_at: dateTime @index(hour) .
+		user.suspension_reason: string .
 
 		node: bool @index(bool) .
 		node.hashid: string @index(hash) . 
 		node.owner: uid @reverse . 
-		node.parent: uid . 
+		node.parent: uid @reverse .
 		node.xdata: string . 
 		node.searchable: bool @index(bool) . 
-		node.search_title: string @index(term) .
-		node.search_synopsis: string @index(fulltext) .
-		node.created_at: dateTime .
-	`
+		node.search_title: string @index(term, trigram) .
+		node.search_synopsis: string @index(fulltext, trigram) @lang .
+		node.lang: string @index(exact) .
+		node.created_at: dateTime @index(hour) .
+		node.alias: string @index(exact) .
+		node.content_hash: string @index(exact) .
+		node.timestamp: dateTime .
+		node.timestamp_token: string .
+		node.attachment: uid .
+		node.schema: string @index(exact) .
+		node.tombstoned_at: dateTime .
+		node.hidden_at: dateTime @index(hour) .
+		node.hidden_searchable: bool .
+
+		attachment: bool @index(bool) .
+		attachment.name: string @index(exact) .
+		attachment.content_type: string .
+		attachment.size: int .
+		attachment.sha256: string @index(exact) .
+
+		schema: bool @index(bool) .
+		schema.name: string @index(exact) .
+		schema.definition: string .
+		schema.owner: uid @reverse .
+		schema.created_at: dateTime .
+
+		saved_search: bool @index(bool) .
+		saved_search.name: string .
+		saved_search.query: string .
+		saved_search.owner: uid @reverse .
+		saved_search.notify: string @index(exact) .
+		saved_search.webhook: string .
+		saved_search.secret: string .
+		saved_search.created_at: dateTime .
+
+		feed_item: bool @index(bool) .
+		feed_item.owner: uid @reverse .
+		feed_item.search: uid @reverse .
+		feed_item.ref: uid .
+		feed_item.created_at: dateTime @index(hour) .
+		feed_item.emailed: bool @index(bool) .
+
+		report: bool @index(bool) .
+		report.ref: uid @reverse .
+		report.reporter: uid @reverse .
+		report.email: string .
+		report.reason: string @index(exact) .
+		report.details: string .
+		report.status: string @index(exact) .
+		report.action: string .
+		report.created_at: dateTime @index(hour) .
+		report.resolved_at: dateTime .
+		report.resolved_by: uid .
+
+		audit: bool @index(bool) .
+		audit.admin: uid @reverse .
+		audit.action: string @index(exact) .
+		audit.target: string @index(exact) .
+		audit.reason: string .
+		audit.created_at: dateTime @index(hour) .
+
+		login_throttle: bool @index(bool) .
+		login_throttle.key: string @index(exact) @upsert .
+		login_throttle.failures: int .
+		login_throttle.last_failure: dateTime @index(hour) .
+		login_throttle.blocked_until: dateTime .
+	` + xdataFieldsSchema(xdataFields, xdataFieldTypes)
 
 	// err := dg.Alter(context.Background(), &api.Operation{DropAll: true})
 	err := dg.Alter(context.Background(), op)
@@ -42,20 +127,168 @@ func setSchema() {
 
 }
 
+// requiredIndexes lists indexes that were added to existing predicates. When an index is
+// added, DGraph rebuilds it for the existing data. "reverse" is the @reverse edge.
+var requiredIndexes = map[string][]string{
+	"node.parent":          {"reverse"},
+	"node.created_at":      {"hour"},
+	"node.search_title":    {"term", "trigram"},
+	"node.search_synopsis": {"fulltext", "trigram"},
+	"user.name":            {"hash", "trigram"},
+	"user.email":           {"hash", "trigram"},
+}
+
+// migrateCommand applies the schema (see init) and checks that the indexes required by the
+// current version exist. Run it after upgrading and before starting the server because
+// rebuilding indexes may take a while for a large number of refs.
+func migrateCommand(args []string) error {
+
+	ctx := context.Background()
+
+	preds := []string{}
+	for pred := range requiredIndexes {
+		preds = append(preds, pred)
+	}
+	sort.Strings(preds)
+
+	resp, err := dg.NewReadOnlyTxn().Query(ctx, fmt.Sprintf(`schema(pred: [%s]) { tokenizer reverse }`, strings.Join(preds, ", ")))
+	if err != nil {
+		return err
+	}
+
+	type Root struct {
+		Schema []struct {
+			Predicate string   `json:"predicate"`
+			Tokenizer []string `json:"tokenizer"`
+			Reverse   bool     `json:"reverse"`
+		} `json:"schema"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	tokenizers := map[string]map[string]bool{}
+	for _, s := range root.Schema {
+		tokenizers[s.Predicate] = map[string]bool{}
+		for _, t := range s.Tokenizer {
+			tokenizers[s.Predicate][t] = true
+		}
+		tokenizers[s.Predicate]["reverse"] = s.Reverse
+	}
+
+	for _, pred := range preds {
+		for _, index := range requiredIndexes[pred] {
+			if !tokenizers[pred][index] {
+				return fmt.Errorf("%s is missing the %s index", pred, index)
+			}
+		}
+	}
+
+	log.Println("migrate: schema is up to date")
+
+	return nil
+}
+
 // user: bool @index(bool) .
-// user.name: string @index(hash) . # this should be unique
-// user.email: string @index(hash) . # this should be unique and lower-cased
+// user.name: string @index(hash, trigram) . # this should be unique
+// user.email: string @index(hash, trigram) . # this should be unique and lower-cased
 // user.password: password .
 // user.code: string @index(hash) . # for password recovery (can be null)
+// user.code_expires_at: dateTime @index(hour) . # user.code can't be used after this time (can be null)
+// user.code_sent_at: dateTime . # when the last verification email was sent (can be null)
 // user.created_at: dateTime @index(day) .
 // user.validated: bool @index(bool) . # Check if email validation passed
+// user.pending_email: string @index(hash) . # new email address awaiting verification (can be null)
+// user.deleted_at: dateTime . # the account was deleted (see account_delete.go) (can be null)
+// user.totp_secret: string . # two-factor authentication is enabled (can be null)
+// user.totp_pending_secret: string . # two-factor authentication awaiting confirmation (can be null)
+// user.totp_last_step: int . # time step of the last code used from the authenticator app (can be null)
+// user.recovery_codes: [string] . # sha256 of unused two-factor recovery codes
+// user.display_name: string . # (can be null) see account_profile.go
+// user.bio: string . # (can be null)
+// user.affiliation: string . # (can be null)
+// user.orcid: string @index(exact) . # ORCID iD without the url (can be null)
+// user.homepage: string . # http(s) url (can be null)
+// user.avatar: string . # https url of an image (can be null)
+// user.attachments_added_at: dateTime . # when files were last attached to the account's refs (see checkAttachmentQuotaSize) (can be null)
+// user.admin: bool @index(bool) . # can use the /admin endpoints (see admin.go) (can be null)
+// user.suspended_at: dateTime @index(hour) . # the account can't log in (can be null)
+// user.suspension_reason: string . # (can be null)
 
 // node: bool @index(bool) .
 // node.hashid: string @index(exact) . # @username/hashid
 // node.owner: uid @reverse . # (can be null)
-// node.parent: uid . # [uid] (use facet) (can be null)
+// node.parent: uid @reverse . # [uid] (use facet) (can be null)
 // node.xdata: string . # store custom json data
 // node.searchable: bool @index(bool) .
-// node.search_title: string @index(term) . # (can be null)
-// node.search_synopsis: string @index(fulltext) . # (can be null)
-// node.created_at: dateTime .
+// node.search_title: string @index(term, trigram) . # (can be null)
+// node.search_synopsis: string @index(fulltext, trigram) @lang . # (can be null) also stored with the ref's language tag (see search_lang.go)
+// node.lang: string @index(exact) . # language code (can be null)
+// node.created_at: dateTime @index(hour) .
+// node.alias: string @index(exact) . # original id of a ref imported from another instance (can be null)
+// node.content_hash: string @index(exact) . # sha256 of the ref's content (see bundleRef)
+// node.timestamp: dateTime . # time asserted by the TSA (can be null)
+// node.timestamp_token: string . # base64 RFC 3161 timestamp token for node.content_hash (can be null)
+// node.attachment: uid . # [uid] files uploaded with the ref (can be null)
+// node.schema: string @index(exact) . # id of the JSON Schema the data payload was validated against (can be null)
+// node.tombstoned_at: dateTime . # the content was removed when the owner's account was deleted or by an admin (can be null)
+// node.hidden_at: dateTime @index(hour) . # hidden by an admin (see admin_refs.go) (can be null)
+// node.hidden_searchable: bool . # node.searchable before the ref was hidden (can be null)
+
+// attachment: bool @index(bool) .
+// attachment.name: string @index(exact) . # unique per ref
+// attachment.content_type: string .
+// attachment.size: int . # bytes
+// attachment.sha256: string @index(exact) . # key of the file in the blob store
+
+// schema: bool @index(bool) .
+// schema.name: string @index(exact) . # unique per account
+// schema.definition: string . # JSON Schema
+// schema.owner: uid @reverse .
+// schema.created_at: dateTime .
+
+// saved_search: bool @index(bool) .
+// saved_search.name: string .
+// saved_search.query: string . # url encoded search query params (see savedSearchParams)
+// saved_search.owner: uid @reverse .
+// saved_search.notify: string @index(exact) . # none, email or webhook
+// saved_search.webhook: string . # (can be null)
+// saved_search.secret: string . # key used to sign webhook requests (can be null)
+// saved_search.created_at: dateTime .
+
+// feed_item: bool @index(bool) .
+// feed_item.owner: uid @reverse .
+// feed_item.search: uid @reverse . # the saved search that the ref matched
+// feed_item.ref: uid .
+// feed_item.created_at: dateTime @index(hour) .
+// feed_item.emailed: bool @index(bool) . # included in an email digest
+
+// report: bool @index(bool) .
+// report.ref: uid @reverse . # the reported ref
+// report.reporter: uid @reverse . # (can be null if the reporter was not logged in)
+// report.email: string . # email address of a reporter that was not logged in (can be null)
+// report.reason: string @index(exact) . # see reportReasons
+// report.details: string . # (can be null)
+// report.status: string @index(exact) . # open, dismissed or actioned
+// report.action: string . # dismiss, hide_ref or suspend_owner (can be null)
+// report.created_at: dateTime @index(hour) .
+// report.resolved_at: dateTime . # (can be null)
+// report.resolved_by: uid . # the admin that resolved the report (can be null)
+
+// audit: bool @index(bool) .
+// audit.admin: uid @reverse . # (can be null for actions run from the command line)
+// audit.action: string @index(exact) . # eg. suspend_account or hide_ref
+// audit.target: string @index(exact) . # @name or ref id
+// audit.reason: string . # (can be null)
+// audit.created_at: dateTime @index(hour) .
+
+// login_throttle: bool @index(bool) .
+// login_throttle.key: string @index(exact) @upsert . # "ip:<ip address>" or "account:<uid>" ("account:<name or email>" if the account does not exist)
+// login_throttle.failures: int . # failed logins within LOGIN_FAILURE_WINDOW
+// login_throttle.last_failure: dateTime @index(hour) .
+// login_throttle.blocked_until: dateTime . # logins are refused until this time
+//
+// xdata.<name>: [<type>] @index(<type>) . # one for each field configured in XDATA_INDEX (see xdataFieldTypes)
@@ -0,0 +1,475 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/dgraph-io/dgo"
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// JSON Schemas can be used to validate the data payload of a ref.
+//
+// Instance schemas are loaded from the *.json files in SCHEMAS_DIR. The file name (without
+// extension) is the schema's name. eg. "paper".
+// Account schemas are registered by logged in users and are named after the account.
+// eg. "@alice/paper".
+//
+// Schemas can not be modified once registered so that refs remain valid.
+
+// instanceSchemas are the schemas loaded from SCHEMAS_DIR. The key is the schema name.
+var instanceSchemas = map[string]string{}
+
+// compiledSchemas caches compiled schemas. The key is the schema id.
+var compiledSchemas = struct {
+	sync.RWMutex
+	m map[string]*jsonschema.Schema
+}{m: map[string]*jsonschema.Schema{}}
+
+// maxSchemaSize is the maximum size (in kB) of a schema definition.
+const maxSchemaSize = 64
+
+func init() {
+	if schemasDir == "" {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(schemasDir, "*.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, file := range files {
+		name := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))
+		if err := validateSchemaName(name); err != nil {
+			log.Fatal(fmt.Sprintf("%s: %v", file, err))
+		}
+
+		definition, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if _, err := compileSchema(name, string(definition)); err != nil {
+			log.Fatal(fmt.Sprintf("%s: %v", file, err))
+		}
+
+		instanceSchemas[name] = string(definition)
+	}
+}
+
+// schemaValidationError is a single reason why a data payload does not match a schema.
+type schemaValidationError struct {
+	Path    string `json:"path"`    // JSON pointer to the invalid value within the data payload
+	Keyword string `json:"keyword"` // JSON pointer to the failed keyword within the schema
+	Message string `json:"message"`
+}
+
+// validateSchemaName checks the name of a schema (excluding the account name).
+func validateSchemaName(name string) error {
+
+	if name == "" {
+		return errors.New("schema name must not be empty")
+	}
+
+	if len(name) > 50 {
+		return errors.New("schema name must be less than 50 characters")
+	}
+
+	for _, char := range name {
+		if unicode.IsSpace(char) || char == 34 || char == 64 || char == 47 || char == 58 {
+			return errors.New("schema name must not contain spaces, \", @, / or :")
+		}
+	}
+
+	return nil
+}
+
+// splitSchemaID returns the account name (if any) and the name of a schema.
+// eg. "@alice/paper" returns "alice" and "paper". "paper" returns nil and "paper".
+func splitSchemaID(schemaID string) (*string, string, error) {
+
+	schemaID = strings.ToLower(strings.TrimSpace(schemaID))
+
+	if !strings.HasPrefix(schemaID, "@") {
+		return nil, schemaID, validateSchemaName(schemaID)
+	}
+
+	splits := strings.SplitN(strings.TrimPrefix(schemaID, "@"), "/", 2)
+	if len(splits) != 2 || splits[0] == "" {
+		return nil, "", errors.New("schema is invalid")
+	}
+
+	return &splits[0], splits[1], validateSchemaName(splits[1])
+}
+
+// compileSchema compiles a schema definition. Schemas must be self-contained: references
+// to external documents are not loaded.
+func compileSchema(schemaID, definition string) (*jsonschema.Schema, error) {
+
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, errors.New("schemas must not reference external documents")
+	}
+
+	url := "schema:///" + schemaID
+	err := compiler.AddResource(url, strings.NewReader(definition))
+	if err != nil {
+		return nil, err
+	}
+
+	return compiler.Compile(url)
+}
+
+// loadSchema returns the compiled schema with the provided id.
+// A nil schema is returned if the schema does not exist.
+func loadSchema(ctx context.Context, txn *dgo.Txn, schemaID string) (*jsonschema.Schema, error) {
+
+	compiledSchemas.RLock()
+	s, exists := compiledSchemas.m[schemaID]
+	compiledSchemas.RUnlock()
+	if exists {
+		return s, nil
+	}
+
+	ownerName, name, err := splitSchemaID(schemaID)
+	if err != nil {
+		return nil, nil
+	}
+
+	var definition string
+
+	if ownerName == nil {
+		d, exists := instanceSchemas[name]
+		if !exists {
+			return nil, nil
+		}
+		definition = d
+	} else {
+		d, err := findAccountSchema(ctx, txn, *ownerName, name)
+		if err != nil {
+			return nil, err
+		}
+		if d == nil {
+			return nil, nil
+		}
+		definition = *d
+	}
+
+	s, err = compileSchema(schemaID, definition)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledSchemas.Lock()
+	compiledSchemas.m[schemaID] = s
+	compiledSchemas.Unlock()
+
+	return s, nil
+}
+
+// findAccountSchema returns the definition of a schema registered by an account.
+func findAccountSchema(ctx context.Context, txn *dgo.Txn, ownerName, name string) (*string, error) {
+
+	vars := map[string]string{
+		"$owner": ownerName,
+		"$name":  name,
+	}
+
+	const q = `
+		query withvar($owner: string, $name: string) {
+			var(func: eq(user.name, $owner)) {
+				s as ~schema.owner @filter(eq(schema.name, $name))
+			}
+
+			schemas(func: uid(s), first: 1) {
+				definition: schema.definition
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Schemas []struct {
+			Definition string `json:"definition"`
+		} `json:"schemas"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(root.Schemas) == 0 {
+		return nil, nil
+	}
+
+	return &root.Schemas[0].Definition, nil
+}
+
+// validateAgainstSchema validates a (json encoded) data payload against a compiled schema.
+// It returns the reasons why the data payload does not match.
+func validateAgainstSchema(s *jsonschema.Schema, data string) []schemaValidationError {
+
+	// Numbers are decoded as json.Number so that large integers are not rounded
+	var x interface{}
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&x); err != nil {
+		return []schemaValidationError{{Path: "", Message: "data payload must be valid json object"}}
+	}
+
+	err := s.Validate(x)
+	if err == nil {
+		return nil
+	}
+
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []schemaValidationError{{Path: "", Message: err.Error()}}
+	}
+
+	out := []schemaValidationError{}
+
+	var collect func(*jsonschema.ValidationError)
+	collect = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			out = append(out, schemaValidationError{
+				Path:    jsonPointer(ve.InstanceLocation),
+				Keyword: jsonPointer(ve.KeywordLocation),
+				Message: ve.Message,
+			})
+			return
+		}
+		for _, cause := range ve.Causes {
+			collect(cause)
+		}
+	}
+	collect(ve)
+
+	return out
+}
+
+// jsonPointer converts a location reported by the schema validator to an RFC 6901 JSON pointer.
+func jsonPointer(loc string) string {
+
+	if loc == "" || loc == "#" {
+		return ""
+	}
+
+	if unescaped, err := url.PathUnescape(loc); err == nil {
+		loc = unescaped
+	}
+
+	loc = strings.TrimPrefix(loc, "#")
+	if !strings.HasPrefix(loc, "/") {
+		loc = "/" + loc
+	}
+
+	return loc
+}
+
+type schemaInput struct {
+	Name       string `json:"name" form:"name"`
+	Definition string `json:"definition" form:"definition"`
+}
+
+// createSchemaHandler registers a schema for the logged in account.
+func createSchemaHandler(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	loggedInUser := c.Get("logged-in-user")
+	if loggedInUser == nil {
+		return c.JSON(http.StatusUnauthorized, ErrorFmt("schemas require login"))
+	}
+
+	si := new(schemaInput)
+	if err := c.Bind(si); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	si.Name = strings.ToLower(strings.TrimSpace(si.Name))
+	if err := validateSchemaName(si.Name); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	if len([]byte(si.Definition)) > maxSchemaSize*1024 {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("schema must be less than %dkB", maxSchemaSize)))
+	}
+
+	schemaID := "@" + loggedInUser.(string) + "/" + si.Name
+
+	_, err := compileSchema(schemaID, si.Definition)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(fmt.Sprintf("schema is invalid: %v", err)))
+	}
+
+	compactedJson, err := compactJson(si.Definition)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("schema must be valid json"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	existing, err := findAccountSchema(ctx, txn, loggedInUser.(string), si.Name)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if existing != nil {
+		return c.JSON(http.StatusConflict, ErrorFmt("schema already exists"))
+	}
+
+	data := map[string]interface{}{
+		"schema":            true,
+		"schema.name":       si.Name,
+		"schema.definition": compactedJson,
+		"schema.owner":      map[string]string{"uid": c.Get("logged-in-user-uid").(string)},
+		"schema.created_at": time.Now().UTC(),
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"schema": schemaID,
+	})
+}
+
+// listSchemasHandler lists the names of the instance schemas. If the owner query param is
+// provided, the schemas registered by that account are listed instead.
+func listSchemasHandler(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	owner := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c.QueryParam("owner")), "@"))
+
+	if owner == "" {
+		names := []string{}
+		for name := range instanceSchemas {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		return c.JSONPretty(http.StatusOK, map[string]interface{}{"schemas": names}, "  ")
+	}
+
+	txn := dg.NewReadOnlyTxn()
+
+	vars := map[string]string{
+		"$owner": owner,
+	}
+
+	const q = `
+		query withvar($owner: string) {
+			schemas(func: eq(user.name, $owner)) {
+				~schema.owner(orderasc: schema.name) {
+					schema.name
+				}
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Schemas []struct {
+			Schemas []struct {
+				Name string `json:"schema.name"`
+			} `json:"~schema.owner"`
+		} `json:"schemas"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if len(root.Schemas) == 0 {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	names := []string{}
+	for _, s := range root.Schemas[0].Schemas {
+		names = append(names, "@"+owner+"/"+s.Name)
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{"schemas": names}, "  ")
+}
+
+// showSchemaHandler returns the definition of a schema.
+func showSchemaHandler(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	ownerName, name, err := splitSchemaID(c.Param("*"))
+	if err != nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	var definition string
+
+	if ownerName == nil {
+		d, exists := instanceSchemas[name]
+		if !exists {
+			return c.NoContent(http.StatusNotFound)
+		}
+		definition = d
+	} else {
+		txn := dg.NewReadOnlyTxn()
+
+		d, err := findAccountSchema(ctx, txn, *ownerName, name)
+		if err != nil {
+			log.Println(err)
+			return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		}
+		if d == nil {
+			return c.NoContent(http.StatusNotFound)
+		}
+		definition = *d
+	}
+
+	return c.JSONBlob(http.StatusOK, []byte(definition))
+}
@@ -0,0 +1,31 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"testing"
+)
+
+func TestJSONPointer(t *testing.T) {
+
+	tests := []struct {
+		loc  string
+		want string
+	}{
+		{"", ""},
+		{"#", ""},
+		{"#/authors/0/name", "/authors/0/name"},
+		{"/year", "/year"},
+		{"year", "/year"},
+		{"#/first%20name", "/first name"},
+		{"#/a~1b", "/a~1b"},
+	}
+
+	for _, tt := range tests {
+		if got := jsonPointer(tt.loc); got != tt.want {
+			t.Errorf("jsonPointer(%q) = %q, want %q", tt.loc, got, tt.want)
+		}
+	}
+}
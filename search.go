@@ -6,24 +6,46 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/dgraph-io/dgo"
 	"github.com/labstack/echo"
 	"github.com/patrickmn/go-cache"
 )
 
 type searchRef struct {
+	UID            string    `json:"uid"`
 	Name           *string   `json:"name"`
 	ID             string    `json:"id"`
 	Data           string    `json:"data"`
 	SearchTitle    *string   `json:"search_title"`    // add omitempty
 	SearchSynopsis *string   `json:"search_synopsis"` // add omitempty
 	CreatedAt      time.Time `json:"created_at"`
+	Lang           *string   `json:"lang"`
+
+	// The owner's profile (if any)
+	accountProfile
+
+	// Set when sorted by relevance
+	Score   *float64          `json:"-"`
+	Explain *scoreExplanation `json:"-"`
+
+	// Set by the bleve search backend
+	Highlights map[string][]string `json:"-"`
+
+	// The fields matched by the search terms: title, synopsis or the name of an xdata field
+	Matched []string `json:"-"`
 }
 
 func (s *searchRef) MarshalJSON() ([]byte, error) {
@@ -35,71 +57,815 @@ func (s *searchRef) MarshalJSON() ([]byte, error) {
 		"search_synopsis": s.SearchSynopsis,
 	}
 
-	if s.Name == nil {
-		out["id"] = s.ID
-	} else {
-		out["id"] = "@" + *s.Name + "/" + s.ID
+	if s.Score != nil {
+		out["score"] = *s.Score
+	}
+
+	if s.Explain != nil {
+		out["explain"] = s.Explain
+	}
+
+	if s.Highlights != nil {
+		out["highlights"] = s.Highlights
+	}
+
+	if s.Matched != nil {
+		out["matched"] = s.Matched
+	}
+
+	if s.Lang != nil {
+		out["lang"] = *s.Lang
+	}
+
+	out["id"] = s.refAddress()
+
+	if s.Name != nil {
+		out["owner"] = ownerMetadata(*s.Name, s.accountProfile)
 	}
 
 	return json.Marshal(out)
 }
 
+// refAddress returns the id of the ref including the owner's name (if any).
+func (s *searchRef) refAddress() string {
+	if s.Name == nil {
+		return s.ID
+	}
+	return "@" + *s.Name + "/" + s.ID
+}
+
+// searchRefFields are the fields of a searchRef. They are used within @normalize blocks.
+const searchRefFields = `
+	uid: uid
+	node.owner {
+		name: user.name
+		` + ownerProfileFields + `
+	}
+	id: node.hashid
+	data: node.xdata
+	search_title: node.search_title
+	search_synopsis: node.search_synopsis
+	created_at: node.created_at
+	lang: node.lang
+`
+
+// searchQuery is a parsed search request.
+type searchQuery struct {
+	Terms string
+	Expr  *searchExpr // parsed Terms (nil if there are no terms)
+
+	// Filters
+	Owner  string     // account name
+	From   *time.Time // created at or after
+	To     *time.Time // created at or before
+	Cites  string     // id of a ref that must be a parent
+	Types  []string   // ref types of the outgoing edges (any)
+	Schema string     // id of the JSON Schema the data payload was validated against
+	Lang   string     // language of the ref (see searchLanguages)
+
+	// Refs restricts the search to these uids. It is used to match new refs against
+	// saved searches and is not a query param.
+	Refs []string
+
+	Mode    string // exact, fuzzy or prefix (see searchModes)
+	Sort    string // newest, oldest or relevance
+	Explain bool   // include the breakdown of relevance scores
+	First   int
+	Offset  int
+	After   *searchKeyset // position after the previous page (date sorted results only)
+}
+
+// hasFilters returns true if the search has at least one filter.
+func (sq searchQuery) hasFilters() bool {
+	return sq.Owner != "" || sq.From != nil || sq.To != nil || sq.Cites != "" || len(sq.Types) > 0 || sq.Schema != "" || sq.Lang != ""
+}
+
+// cacheKey returns a key that covers every parameter of the search.
+func (sq searchQuery) cacheKey() string {
+
+	v := url.Values{}
+	v.Set("terms", sq.Terms)
+	v.Set("owner", sq.Owner)
+	if sq.From != nil {
+		v.Set("from", sq.From.Format(time.RFC3339))
+	}
+	if sq.To != nil {
+		v.Set("to", sq.To.Format(time.RFC3339))
+	}
+	v.Set("cites", sq.Cites)
+	v.Set("types", strings.Join(sq.Types, ","))
+	v.Set("schema", sq.Schema)
+	v.Set("lang", sq.Lang)
+	v.Set("mode", sq.Mode)
+	v.Set("sort", sq.Sort)
+	v.Set("explain", strconv.FormatBool(sq.Explain))
+	v.Set("first", strconv.Itoa(sq.First))
+	v.Set("offset", strconv.Itoa(sq.Offset))
+	if sq.After != nil {
+		v.Set("after", encodeSearchKeyset(*sq.After))
+	}
+
+	return "search-" + v.Encode()
+}
+
+// searchResults is a page of search results. Next is the cursor of the following page
+// (null if there are no more results).
+type searchResults struct {
+	Results []searchRef `json:"results"`
+	Total   int         `json:"total"`
+	Next    *string     `json:"next"`
+}
+
+// encodeSearchCursor returns an opaque cursor pointing to a position in the results.
+func encodeSearchCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("o:%d", offset)))
+}
+
+func decodeSearchCursor(cursor string) (int, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), "o:") {
+		return 0, errors.New("after query param is malformed")
+	}
+
+	offset, err := strconv.Atoi(strings.TrimPrefix(string(raw), "o:"))
+	if err != nil || offset < 0 {
+		return 0, errors.New("after query param is malformed")
+	}
+
+	return offset, nil
+}
+
+// searchKeyset is the position after the last result of a page of results sorted by date, so
+// that refs created in the meantime don't shift the following pages. DGraph orders refs
+// created at the same time by uid but can't compare uids, so the uids of the page's last refs
+// with that time are kept and excluded.
+type searchKeyset struct {
+	CreatedAt time.Time
+	UIDs      []string
+}
+
+var searchKeysetUID = regexp.MustCompile(`^0x[0-9a-f]{1,16}$`)
+
+// encodeSearchKeyset returns an opaque cursor pointing after a position in date sorted results.
+func encodeSearchKeyset(k searchKeyset) string {
+	raw := fmt.Sprintf("k:%d:%s", k.CreatedAt.UnixNano(), strings.Join(k.UIDs, ","))
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeSearchAfter decodes a cursor returned by encodeSearchCursor or encodeSearchKeyset.
+func decodeSearchAfter(cursor string) (int, *searchKeyset, error) {
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, nil, errors.New("after query param is malformed")
+	}
+
+	if !strings.HasPrefix(string(raw), "k:") {
+		offset, err := decodeSearchCursor(cursor)
+		return offset, nil, err
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(string(raw), "k:"), ":", 2)
+	if len(parts) != 2 {
+		return 0, nil, errors.New("after query param is malformed")
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, nil, errors.New("after query param is malformed")
+	}
+
+	uids := strings.Split(parts[1], ",")
+	if len(uids) > maxSearchResults {
+		return 0, nil, errors.New("after query param is malformed")
+	}
+	for _, uid := range uids {
+		if !searchKeysetUID.MatchString(uid) {
+			return 0, nil, errors.New("after query param is malformed")
+		}
+	}
+
+	return 0, &searchKeyset{CreatedAt: time.Unix(0, nanos).UTC(), UIDs: uids}, nil
+}
+
+// nextSearchKeyset returns the position after the last of the results.
+func nextSearchKeyset(results []searchRef) searchKeyset {
+
+	last := results[len(results)-1].CreatedAt
+	k := searchKeyset{CreatedAt: last}
+
+	for i := len(results) - 1; i >= 0 && results[i].CreatedAt.Equal(last); i-- {
+		k.UIDs = append(k.UIDs, results[i].UID)
+	}
+
+	return k
+}
+
+// parseSearchQuery reads the search terms (from the path or the q query param), the filters
+// and the pagination and sort query params.
+func parseSearchQuery(c echo.Context) (searchQuery, error) {
+	return parseSearchParams(c.Param("terms"), c.QueryParams())
+}
+
+// parseSearchParams parses the search terms and the query params of a search.
+func parseSearchParams(terms string, params url.Values) (searchQuery, error) {
+
+	sq := searchQuery{
+		Terms: strings.TrimSpace(terms),
+		Mode:  "exact",
+		Sort:  "newest",
+		First: 20,
+	}
+
+	if sq.Terms == "" {
+		sq.Terms = strings.TrimSpace(params.Get("q"))
+	}
+
+	expr, err := parseSearchExpr(sq.Terms, xdataFields)
+	if err != nil {
+		return sq, err
+	}
+	sq.Expr = expr
+
+	// Filters
+	sq.Owner = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(params.Get("owner")), "@"))
+
+	for _, p := range []struct {
+		param string
+		dst   **time.Time
+	}{{"from", &sq.From}, {"to", &sq.To}} {
+		val := strings.TrimSpace(params.Get(p.param))
+		if val == "" {
+			continue
+		}
+
+		t, err := parseXDataTime(val)
+		if err != nil {
+			return sq, fmt.Errorf("%s query param must be a date", p.param)
+		}
+		*p.dst = &t
+	}
+
+	if val := strings.TrimSpace(params.Get("cites")); val != "" {
+		if _, _, err := splitNodeID(val); err != nil {
+			return sq, errors.New("cites query param is malformed")
+		}
+		sq.Cites = strings.ToLower(val)
+	}
+
+	for _, val := range strings.Split(params.Get("types"), ",") {
+		val = strings.TrimSpace(val)
+		if val == "" {
+			continue
+		}
+		if len(val) > 75 || strings.ContainsAny(val, "\"@/\\") {
+			return sq, errors.New("types query param is malformed")
+		}
+		sq.Types = append(sq.Types, val)
+	}
+	sort.Strings(sq.Types)
+
+	sq.Schema = strings.TrimSpace(params.Get("schema"))
+
+	if val := strings.ToLower(strings.TrimSpace(params.Get("lang"))); val != "" {
+		if _, exists := searchLanguages[val]; !exists {
+			return sq, errors.New("lang query param is not a supported language")
+		}
+		sq.Lang = val
+	}
+
+	if val := params.Get("mode"); val != "" {
+		if _, exists := searchModes[val]; !exists {
+			return sq, errors.New("mode query param must be exact, fuzzy or prefix")
+		}
+		sq.Mode = val
+	}
+
+	// Sort and pagination
+	if val := params.Get("sort"); val != "" {
+		switch val {
+		case "newest", "oldest", "relevance":
+			sq.Sort = val
+		default:
+			return sq, errors.New("sort query param must be newest, oldest or relevance")
+		}
+	}
+
+	if val := params.Get("explain"); val != "" {
+		explain, err := strconv.ParseBool(val)
+		if err != nil {
+			return sq, errors.New("explain query param must be true or false")
+		}
+		sq.Explain = explain
+	}
+
+	if val := params.Get("first"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil || n <= 0 || n > maxSearchResults {
+			return sq, fmt.Errorf("first query param must be between 1 and %d", maxSearchResults)
+		}
+		sq.First = n
+	}
+
+	if val := params.Get("after"); val != "" {
+		offset, after, err := decodeSearchAfter(val)
+		if err != nil {
+			return sq, err
+		}
+		sq.Offset = offset
+		sq.After = after
+	}
+
+	return sq, nil
+}
+
 // searchHandler provides search functionality. It returns all refs that may contain
 // the search terms be in the title or synopsis. It only returns refs that have "searchable"
 // set to true.
+//
+// The search terms are provided in the path (/search/:terms) or with the q query param (/search).
+// The results can be filtered by:
+//
+//	owner: the account that owns the ref (eg. @alice)
+//	from, to: the range of the ref's creation date (eg. 2018 or 2018-06-30)
+//	cites: the id of a ref that the ref links to
+//	types: comma separated ref types of the ref's links (eg. extends,cites). When combined with
+//	       cites, the link to the cited ref must have one of the types.
+//	schema: the id of the JSON Schema that the ref's data payload was validated against
+//	lang: the language of the ref (eg. de). The synopsis is matched using the language's stemmer.
+//
+// Results are paginated using first (page size) and after (the next cursor of the previous page).
+// They are sorted by sort: newest (default), oldest or relevance (see scoreRef). Relevance scores
+// are returned with each result and explain=true adds the contribution of each signal.
+// Each result lists the fields that were matched by the search terms.
+// With mode=fuzzy or mode=prefix, misspelled and partial words also match but exact matches
+// are ranked first.
+//
+// format=csv, ndjson or bibtex downloads all the results (see exportSearch) instead of a page.
+//
+// See search_query.go for the syntax of the search terms.
 func searchHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	terms := strings.TrimSpace(c.Param("terms"))
-	if terms == "" {
-		return c.JSON(http.StatusOK, map[string]interface{}{"results": []int{}})
+	sq, err := parseSearchQuery(c)
+	if err != nil {
+		if se, ok := err.(*searchSyntaxError); ok {
+			return c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"error":  "search query is malformed",
+				"errors": []*searchSyntaxError{se},
+			})
+		}
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err.Error()))
+	}
+
+	search := runSearch
+	if searchBackend == "bleve" {
+		search = runBleveSearch
+	}
+
+	if format := c.QueryParam("format"); format != "" && format != "json" {
+		if _, exists := searchExportFormats[format]; !exists {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("format query param must be json, csv, ndjson or bibtex"))
+		}
+
+		err := exportSearch(c, sq, format, search)
+		if err != nil {
+			return searchErrorResponse(c, err)
+		}
+		return nil
+	}
+
+	if sq.Expr == nil && !sq.hasFilters() {
+		return c.JSON(http.StatusOK, searchResults{Results: []searchRef{}})
 	}
 
 	// Check cache
-	key := fmt.Sprintf("search-%s", terms)
+	key := sq.cacheKey()
 	cachedData, found := memoryCache.Get(key)
 	if found {
 		// log.Println("Using cache:" + key)
 		return c.JSONPretty(http.StatusOK, cachedData, "  ")
 	}
 
-	txn := dg.NewReadOnlyTxn()
+	if stdQueryTimeout != 0 {
+		// Create a max query timeout
+		_ctx, cancel := context.WithTimeout(ctx, time.Duration(stdQueryTimeout)*time.Millisecond)
+		defer cancel()
+		ctx = _ctx
+	}
+
+	results, err := search(ctx, sq)
+	if err != nil {
+		return searchErrorResponse(c, err)
+	}
+
+	// Store data in cache
+	memoryCache.Set(key, results, cache.DefaultExpiration)
+
+	return c.JSONPretty(http.StatusOK, results, "  ")
+}
+
+// searchErrorResponse responds with the reason why a search failed.
+func searchErrorResponse(c echo.Context, err error) error {
+	if se, ok := err.(*searchSyntaxError); ok {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":  "search query is malformed",
+			"errors": []*searchSyntaxError{se},
+		})
+	} else if err == errCitedRefNotFound {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err.Error()))
+	} else if strings.Contains(err.Error(), "context canceled") {
+		return c.NoContent(http.StatusNoContent)
+	} else if strings.Contains(err.Error(), "context deadline exceeded") {
+		return c.NoContent(http.StatusRequestTimeout)
+	}
+	log.Println(err)
+	return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+}
+
+var errCitedRefNotFound = errors.New("can't find cited ref")
+
+// searchMatch is the DQL that finds the refs matching a search. Blocks assigns the
+// matching refs to the variable m.
+type searchMatch struct {
+	Decls  string // variable declarations
+	Blocks string
+	Vars   map[string]string
+
+	// Exact is a filter for the refs that match the search terms exactly. It is only
+	// set for fuzzy and prefix searches.
+	Exact string
+}
+
+// buildSearchMatch converts the search terms and filters to DQL. All values are passed as variables.
+func buildSearchMatch(ctx context.Context, txn *dgo.Txn, sq searchQuery) (searchMatch, error) {
+
+	vars := map[string]string{}
+	decls := []string{}
+	blocks := []string{}
+	filters := []string{}
+
+	addVar := func(name, typ, val string) string {
+		vars[name] = val
+		decls = append(decls, name+": "+typ)
+		return name
+	}
+
+	exact := ""
+	if sq.Expr != nil {
+		if sq.Mode == "fuzzy" {
+			err := resolveFuzzyTerms(ctx, txn, sq.Expr, xdataFields, sq.Refs)
+			if err != nil {
+				return searchMatch{}, err
+			}
+		}
+
+		n := 0
+		filters = append(filters, sq.Expr.dql(xdataFields, sq.Mode, sq.Lang, func(typ, val string) string {
+			n++
+			return addVar(fmt.Sprintf("$q%d", n), typ, val)
+		}))
+
+		if sq.Mode != "exact" {
+			n = 0
+			exact = sq.Expr.dql(xdataFields, "exact", sq.Lang, func(typ, val string) string {
+				n++
+				return addVar(fmt.Sprintf("$e%d", n), typ, val)
+			})
+		}
+	}
+
+	if sq.Owner != "" {
+		addVar("$owner", "string", sq.Owner)
+		blocks = append(blocks, `
+			var(func: eq(user.name, $owner)) {
+				o as ~node.owner
+			}
+		`)
+		filters = append(filters, "uid(o)")
+	}
+
+	if sq.From != nil {
+		filters = append(filters, "ge(node.created_at, "+addVar("$from", "string", sq.From.Format(time.RFC3339))+")")
+	}
+
+	if sq.To != nil {
+		filters = append(filters, "le(node.created_at, "+addVar("$to", "string", sq.To.Format(time.RFC3339))+")")
+	}
+
+	if sq.Schema != "" {
+		filters = append(filters, "eq(node.schema, "+addVar("$schema", "string", sq.Schema)+")")
+	}
+
+	if sq.Lang != "" {
+		filters = append(filters, "eq(node.lang, "+addVar("$lang", "string", sq.Lang)+")")
+	}
+
+	root := "eq(node.searchable, true)"
+	if len(sq.Refs) > 0 {
+		root = "uid(" + strings.Join(sq.Refs, ", ") + ")"
+		filters = append(filters, "eq(node.searchable, true)")
+	}
 
-	vars := map[string]string{
-		"$terms": terms,
+	filter := ""
+	if len(filters) > 0 {
+		filter = "@filter(" + strings.Join(filters, " AND ") + ")"
 	}
 
-	q := `
-		query withvar($terms: string) {
-			results(func: eq(node.searchable, true), orderdesc: node.created_at) @normalize @filter(allofterms(node.search_title, $terms) OR alloftext(node.search_synopsis, $terms)) {
-				node.owner {
-					name: user.name
+	if sq.Cites == "" && len(sq.Types) == 0 {
+		blocks = append(blocks, fmt.Sprintf(`
+			m as var(func: %s) %s
+		`, root, filter))
+	} else {
+		// Outgoing edges
+		edgeFilter := ""
+		if sq.Cites != "" {
+			uid, err := lookupRef(ctx, txn, sq.Cites)
+			if err != nil {
+				return searchMatch{}, err
+			}
+			if uid == "" {
+				return searchMatch{}, errCitedRefNotFound
+			}
+			edgeFilter = "@filter(uid(" + addVar("$cites", "string", uid) + "))"
+		}
+
+		facetFilter := ""
+		if len(sq.Types) > 0 {
+			types := []string{}
+			for i, t := range sq.Types {
+				types = append(types, "eq(facet, "+addVar(fmt.Sprintf("$type%d", i), "string", t)+")")
+			}
+			facetFilter = "@facets(" + strings.Join(types, " OR ") + ")"
+		}
+
+		blocks = append(blocks, fmt.Sprintf(`
+			f as var(func: %s) %s
+
+			m as var(func: uid(f)) @cascade {
+				node.parent %s %s {
+					uid
 				}
-				id: node.hashid
-				data: node.xdata
-				search_title: node.search_title
-				search_synopsis: node.search_synopsis
-				created_at: node.created_at
 			}
+		`, root, filter, edgeFilter, facetFilter))
+	}
+
+	return searchMatch{
+		Decls:  strings.Join(decls, ", "),
+		Blocks: strings.Join(blocks, "\n"),
+		Vars:   vars,
+		Exact:  exact,
+	}, nil
+}
+
+// runSearch returns a page of refs matching the search.
+func runSearch(ctx context.Context, sq searchQuery) (searchResults, error) {
+
+	txn := dg.NewReadOnlyTxn()
+
+	match, err := buildSearchMatch(ctx, txn, sq)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	if sq.Expr != nil && (sq.Sort == "relevance" || match.Exact != "") {
+		out, err := runRankedSearch(ctx, txn, sq, match)
+		if err != nil {
+			return searchResults{}, err
 		}
-	`
+		return out, markMatchedFields(ctx, txn, sq, out.Results)
+	}
 
-	if stdQueryTimeout != 0 {
-		// Create a max query timeout
-		_ctx, cancel := context.WithTimeout(ctx, time.Duration(stdQueryTimeout)*time.Millisecond)
-		defer cancel()
-		ctx = _ctx
+	order, cmp := "orderdesc", "lt"
+	if sq.Sort == "oldest" {
+		order, cmp = "orderasc", "gt"
 	}
 
-	resp, err := txn.QueryWithVars(ctx, q, vars)
+	// Results after the previous page
+	keyset := ""
+	if sq.After != nil {
+		match.Vars["$after"] = sq.After.CreatedAt.Format(time.RFC3339Nano)
+		match.Decls = strings.Join([]string{match.Decls, "$after: string"}, ", ")
+		keyset = fmt.Sprintf("@filter(%s(node.created_at, $after) OR (eq(node.created_at, $after) AND NOT uid(%s)))",
+			cmp, strings.Join(sq.After.UIDs, ", "))
+	}
+
+	// One extra result is fetched to find out if there is a following page
+	q := fmt.Sprintf(`
+		query withvar(%s) {
+			%s
+
+			total(func: uid(m)) {
+				count: count(uid)
+			}
+
+			results(func: uid(m), %s: node.created_at, first: %d, offset: %d) %s @normalize {
+				%s
+			}
+		}
+	`, strings.TrimPrefix(match.Decls, ", "), match.Blocks, order, sq.First+1, sq.Offset, keyset, searchRefFields)
+
+	resp, err := txn.QueryWithVars(ctx, q, match.Vars)
 	if err != nil {
-		if strings.Contains(err.Error(), "context canceled") {
-			return c.NoContent(http.StatusNoContent)
-		} else if strings.Contains(err.Error(), "context deadline exceeded") {
-			return c.NoContent(http.StatusRequestTimeout)
+		return searchResults{}, err
+	}
+
+	type Root struct {
+		Total []struct {
+			Count int `json:"count"`
+		} `json:"total"`
+		Results []searchRef `json:"results"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	out := searchResults{Results: root.Results}
+	if out.Results == nil {
+		out.Results = []searchRef{}
+	}
+	if len(root.Total) > 0 {
+		out.Total = root.Total[0].Count
+	}
+
+	if len(out.Results) > sq.First {
+		out.Results = out.Results[:sq.First]
+		next := encodeSearchKeyset(nextSearchKeyset(out.Results))
+		out.Next = &next
+	}
+
+	return out, markMatchedFields(ctx, txn, sq, out.Results)
+}
+
+// runRankedSearch ranks the results. For fuzzy and prefix searches, exact matches are ranked first.
+// Results are then sorted by relevance score (see scoreRef) or by date. DGraph can't sort by score
+// so the first maxSearchCandidates matching refs are ranked here and then the requested page is fetched.
+func runRankedSearch(ctx context.Context, txn *dgo.Txn, sq searchQuery, match searchMatch) (searchResults, error) {
+
+	order := "orderdesc"
+	if sq.Sort == "oldest" {
+		order = "orderasc"
+	}
+
+	// Refs with exact matches
+	exactBlock := ""
+	if match.Exact != "" {
+		exactBlock = fmt.Sprintf(`
+			exact(func: uid(m)) @filter(%s) {
+				uid
+			}
+		`, match.Exact)
+	}
+
+	q := fmt.Sprintf(`
+		query withvar(%s) {
+			%s
+
+			total(func: uid(m)) {
+				count: count(uid)
+			}
+
+			candidates(func: uid(m), %s: node.created_at, first: %d) {
+				uid
+				node.search_title
+				node.search_synopsis
+				node.created_at
+				citations: count(~node.parent)
+			}
+
+			%s
 		}
-		log.Println(err)
-		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	`, match.Decls, match.Blocks, order, maxSearchCandidates, exactBlock)
+
+	resp, err := txn.QueryWithVars(ctx, q, match.Vars)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	type Root struct {
+		Total []struct {
+			Count int `json:"count"`
+		} `json:"total"`
+		Candidates []struct {
+			UID       string    `json:"uid"`
+			Title     string    `json:"node.search_title"`
+			Synopsis  string    `json:"node.search_synopsis"`
+			CreatedAt time.Time `json:"node.created_at"`
+			Citations int       `json:"citations"`
+		} `json:"candidates"`
+		Exact []struct {
+			UID string `json:"uid"`
+		} `json:"exact"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	out := searchResults{Results: []searchRef{}}
+	if len(root.Total) > 0 {
+		out.Total = root.Total[0].Count
+	}
+
+	exactMatches := map[string]struct{}{}
+	for _, n := range root.Exact {
+		exactMatches[n.UID] = struct{}{}
+	}
+
+	// Score candidates
+	scores := map[string]scoreExplanation{}
+	if sq.Sort == "relevance" {
+		maxCitations := 0
+		for _, n := range root.Candidates {
+			if n.Citations > maxCitations {
+				maxCitations = n.Citations
+			}
+		}
+
+		terms := sq.Expr.textTerms()
+		now := time.Now()
+		for _, n := range root.Candidates {
+			scores[n.UID] = scoreRef(rankSignals{n.Title, n.Synopsis, n.CreatedAt, n.Citations}, terms, maxCitations, now)
+		}
+	}
+
+	// Candidates are already sorted by date
+	ranked := []string{}
+	for _, n := range root.Candidates {
+		ranked = append(ranked, n.UID)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if match.Exact != "" {
+			_, ei := exactMatches[ranked[i]]
+			_, ej := exactMatches[ranked[j]]
+			if ei != ej {
+				return ei
+			}
+		}
+		return scores[ranked[i]].total() > scores[ranked[j]].total()
+	})
+
+	if sq.Offset >= len(ranked) {
+		return out, nil
+	}
+
+	end := sq.Offset + sq.First
+	if end > len(ranked) {
+		end = len(ranked)
+	}
+	page := ranked[sq.Offset:end]
+
+	refs, err := loadSearchRefs(ctx, txn, page)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	for _, uid := range page {
+		if r, exists := refs[uid]; exists {
+			if se, scored := scores[uid]; scored {
+				score := se.total()
+				r.Score = &score
+				if sq.Explain {
+					r.Explain = &se
+				}
+			}
+			out.Results = append(out.Results, r)
+		}
+	}
+
+	if end < len(ranked) {
+		next := encodeSearchCursor(end)
+		out.Next = &next
+	}
+
+	return out, nil
+}
+
+// loadSearchRefs fetches refs by uid. Refs hidden by a moderator are omitted. The returned map's key is the uid.
+func loadSearchRefs(ctx context.Context, txn *dgo.Txn, uids []string) (map[string]searchRef, error) {
+
+	out := map[string]searchRef{}
+	if len(uids) == 0 {
+		return out, nil
+	}
+
+	q := fmt.Sprintf(`
+		{
+			results(func: uid(%s)) @filter(NOT has(node.hidden_at)) @normalize {
+				%s
+			}
+		}
+	`, strings.Join(uids, ", "), searchRefFields)
+
+	resp, err := txn.Query(ctx, q)
+	if err != nil {
+		return nil, err
 	}
 
 	type Root struct {
@@ -109,12 +875,108 @@ func searchHandler(c echo.Context) error {
 	var root Root
 	err = json.Unmarshal(resp.Json, &root)
 	if err != nil {
-		log.Println(err)
-		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+		return nil, err
 	}
 
-	// Store data in cache
-	memoryCache.Set(key, root, cache.DefaultExpiration)
+	for _, r := range root.Results {
+		out[r.UID] = r
+	}
+
+	return out, nil
+}
+
+// markMatchedFields sets the fields of each result that are matched by the search terms.
+// Each field is checked by restricting the terms to it.
+func markMatchedFields(ctx context.Context, txn *dgo.Txn, sq searchQuery, results []searchRef) error {
+
+	if sq.Expr == nil || len(results) == 0 {
+		return nil
+	}
+
+	uids := []string{}
+	for i := range results {
+		results[i].Matched = []string{}
+		uids = append(uids, results[i].UID)
+	}
+
+	fields := []string{"title", "synopsis"}
+	for _, f := range xdataFields {
+		fields = append(fields, f.Name)
+	}
+
+	vars := map[string]string{}
+	decls := []string{}
+	blocks := []string{}
+	blockFields := map[string]string{}
+
+	addVar := func(typ, val string) string {
+		name := fmt.Sprintf("$q%d", len(vars)+1)
+		vars[name] = val
+		decls = append(decls, name+": "+typ)
+		return name
+	}
+
+	for _, field := range fields {
+		terms := sq.Expr.fieldTerms(field, xdataFields)
+		if len(terms) == 0 {
+			continue
+		}
+
+		filters := []string{}
+		for _, t := range terms {
+			filters = append(filters, t.dql(xdataFields, sq.Mode, sq.Lang, addVar))
+		}
+
+		name := fmt.Sprintf("f%d", len(blocks))
+		blockFields[name] = field
+		blocks = append(blocks, fmt.Sprintf(`
+			%s(func: uid(%s)) @filter(%s) {
+				uid
+			}
+		`, name, strings.Join(uids, ", "), strings.Join(filters, " OR ")))
+	}
+
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	q := fmt.Sprintf(`
+		query withvar(%s) {
+			%s
+		}
+	`, strings.Join(decls, ", "), strings.Join(blocks, "\n"))
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		return err
+	}
+
+	var root map[string][]struct {
+		UID string `json:"uid"`
+	}
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	matched := map[string]map[string]struct{}{} // uid => fields
+	for name, nodes := range root {
+		for _, n := range nodes {
+			if matched[n.UID] == nil {
+				matched[n.UID] = map[string]struct{}{}
+			}
+			matched[n.UID][blockFields[name]] = struct{}{}
+		}
+	}
+
+	// Keep the order of fields
+	for i := range results {
+		for _, field := range fields {
+			if _, exists := matched[results[i].UID][field]; exists {
+				results[i].Matched = append(results[i].Matched, field)
+			}
+		}
+	}
 
-	return c.JSONPretty(http.StatusOK, root, "  ")
+	return nil
 }
@@ -0,0 +1,601 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	_ "github.com/blevesearch/bleve/analysis/lang/da"
+	_ "github.com/blevesearch/bleve/analysis/lang/de"
+	"github.com/blevesearch/bleve/analysis/lang/en"
+	_ "github.com/blevesearch/bleve/analysis/lang/es"
+	_ "github.com/blevesearch/bleve/analysis/lang/fi"
+	_ "github.com/blevesearch/bleve/analysis/lang/fr"
+	_ "github.com/blevesearch/bleve/analysis/lang/hu"
+	_ "github.com/blevesearch/bleve/analysis/lang/it"
+	_ "github.com/blevesearch/bleve/analysis/lang/nl"
+	_ "github.com/blevesearch/bleve/analysis/lang/no"
+	_ "github.com/blevesearch/bleve/analysis/lang/pt"
+	_ "github.com/blevesearch/bleve/analysis/lang/ro"
+	_ "github.com/blevesearch/bleve/analysis/lang/ru"
+	_ "github.com/blevesearch/bleve/analysis/lang/sv"
+	_ "github.com/blevesearch/bleve/analysis/lang/tr"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/dgraph-io/dgo"
+)
+
+// bleve is an embedded full-text search engine that can be used instead of DGraph's indexes
+// (see SEARCH_BACKEND). It supports stemming, relevance scoring and highlighting.
+// Refs are indexed when they are created. reindexSearchCommand rebuilds the index. It must be
+// run after the text fields of XDATA_INDEX are changed.
+
+var bleveIndex bleve.Index
+
+// bleveSearchDoc is the document indexed for a searchable ref. The document's id is the ref's uid.
+type bleveSearchDoc struct {
+	Title     string    `json:"title"`
+	Synopsis  string    `json:"synopsis"`
+	Owner     string    `json:"owner"`
+	CreatedAt time.Time `json:"created_at"`
+	Schema    string    `json:"schema"`
+	Cites     []string  `json:"cites"` // uids of the ref's parents
+	Types     []string  `json:"types"` // ref types of the ref's links
+	Links     []string  `json:"links"` // "<uid> <ref type>" of each link
+	Lang      string    `json:"lang"`
+
+	XData map[string][]string `json:"xdata"` // values of the text fields of XDATA_INDEX
+}
+
+func init() {
+	switch searchBackend {
+	case "dgraph", "bleve":
+	default:
+		log.Fatal(fmt.Sprintf("unknown SEARCH_BACKEND: %s", searchBackend))
+	}
+}
+
+// bleveMapping describes how the fields of a bleveSearchDoc are indexed. The text of refs
+// with a language is analyzed using the language's analyzer (whose name is the language code).
+func bleveMapping() mapping.IndexMapping {
+
+	im := bleve.NewIndexMapping()
+	im.DefaultMapping = bleveDocMapping(en.AnalyzerName)
+	im.DefaultAnalyzer = en.AnalyzerName
+	im.TypeField = "lang"
+
+	for lang := range searchLanguages {
+		im.AddDocumentMapping(lang, bleveDocMapping(lang))
+	}
+
+	return im
+}
+
+// bleveDocMapping describes how the fields of a bleveSearchDoc are indexed using a text analyzer.
+func bleveDocMapping(analyzer string) *mapping.DocumentMapping {
+
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = analyzer
+	text.Store = true // required for highlighting
+	text.IncludeTermVectors = true
+
+	keyword := bleve.NewTextFieldMapping()
+	keyword.Analyzer = "keyword"
+	keyword.Store = false
+	keyword.IncludeInAll = false
+
+	date := bleve.NewDateTimeFieldMapping()
+	date.IncludeInAll = false
+
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("title", text)
+	doc.AddFieldMappingsAt("synopsis", text)
+	doc.AddFieldMappingsAt("owner", keyword)
+	doc.AddFieldMappingsAt("created_at", date)
+	doc.AddFieldMappingsAt("schema", keyword)
+	doc.AddFieldMappingsAt("cites", keyword)
+	doc.AddFieldMappingsAt("types", keyword)
+	doc.AddFieldMappingsAt("links", keyword)
+	doc.AddFieldMappingsAt("lang", keyword)
+
+	xdata := bleve.NewDocumentStaticMapping()
+	for _, f := range xdataTextFields(xdataFields) {
+		xdata.AddFieldMappingsAt(f.Name, text)
+	}
+	doc.AddSubDocumentMapping("xdata", xdata)
+
+	return doc
+}
+
+// openBleveIndex opens the index or creates it if it does not exist.
+func openBleveIndex(dir string) (bleve.Index, error) {
+
+	index, err := bleve.Open(dir)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		return bleve.New(dir, bleveMapping())
+	}
+
+	return index, err
+}
+
+// startSearchBackend opens the bleve index if it is the configured search backend.
+func startSearchBackend() {
+
+	if searchBackend != "bleve" {
+		return
+	}
+
+	index, err := openBleveIndex(bleveIndexDir)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("BLEVE_INDEX_DIR: %v", err))
+	}
+	bleveIndex = index
+}
+
+// bleveExprQuery converts a parsed search query to a bleve query. If lang is set, text is
+// analyzed using the language's analyzer.
+func bleveExprQuery(e *searchExpr, mode, lang string) (query.Query, error) {
+
+	switch e.Op {
+	case "and", "or":
+		children := []query.Query{}
+		for _, child := range e.Children {
+			q, err := bleveExprQuery(child, mode, lang)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, q)
+		}
+		if e.Op == "and" {
+			return bleve.NewConjunctionQuery(children...), nil
+		}
+		return bleve.NewDisjunctionQuery(children...), nil
+	case "not":
+		child, err := bleveExprQuery(e.Children[0], "exact", lang)
+		if err != nil {
+			return nil, err
+		}
+		q := bleve.NewBooleanQuery()
+		q.AddMust(bleve.NewMatchAllQuery())
+		q.AddMustNot(child)
+		return q, nil
+	}
+
+	fields := []string{}
+	switch e.Field {
+	case "":
+		fields = bleveResultFields()
+	case "title", "synopsis":
+		fields = []string{e.Field}
+	default:
+		if !containsXDataField(xdataTextFields(xdataFields), e.Field) {
+			return nil, &searchSyntaxError{e.Pos, fmt.Sprintf("field %s is not supported by the search backend", e.Field)}
+		}
+		fields = []string{"xdata." + e.Field}
+	}
+
+	alternatives := []query.Query{}
+	for _, field := range fields {
+		if e.Phrase {
+			q := bleve.NewMatchPhraseQuery(e.Value)
+			q.SetField(field)
+			q.Analyzer = lang
+			alternatives = append(alternatives, q)
+			continue
+		}
+
+		q := bleve.NewMatchQuery(e.Value)
+		q.SetField(field)
+		q.Analyzer = lang
+		q.SetOperator(query.MatchQueryOperatorAnd)
+		q.SetBoost(2) // exact matches are ranked first
+		alternatives = append(alternatives, q)
+
+		switch mode {
+		case "fuzzy":
+			fq := bleve.NewMatchQuery(e.Value)
+			fq.SetField(field)
+			fq.Analyzer = lang
+			fq.SetOperator(query.MatchQueryOperatorAnd)
+			fq.SetFuzziness(fuzzyDistance(e.Value))
+			alternatives = append(alternatives, fq)
+		case "prefix":
+			if searchPrefixWord.MatchString(e.Value) {
+				pq := bleve.NewPrefixQuery(strings.ToLower(e.Value))
+				pq.SetField(field)
+				alternatives = append(alternatives, pq)
+			}
+		}
+	}
+
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return bleve.NewDisjunctionQuery(alternatives...), nil
+}
+
+// bleveSearchQuery converts the search terms and filters to a bleve query. citesUID is the uid
+// of the cited ref (if any).
+func bleveSearchQuery(sq searchQuery, citesUID string) (query.Query, error) {
+
+	musts := []query.Query{}
+
+	if sq.Expr != nil {
+		q, err := bleveExprQuery(sq.Expr, sq.Mode, sq.Lang)
+		if err != nil {
+			return nil, err
+		}
+		musts = append(musts, q)
+	}
+
+	term := func(field, value string) query.Query {
+		q := bleve.NewTermQuery(value)
+		q.SetField(field)
+		return q
+	}
+
+	if sq.Owner != "" {
+		musts = append(musts, term("owner", sq.Owner))
+	}
+
+	if sq.From != nil || sq.To != nil {
+		var from, to time.Time // zero is unbounded
+		if sq.From != nil {
+			from = *sq.From
+		}
+		if sq.To != nil {
+			to = *sq.To
+		}
+		inclusive := true
+		q := bleve.NewDateRangeInclusiveQuery(from, to, &inclusive, &inclusive)
+		q.SetField("created_at")
+		musts = append(musts, q)
+	}
+
+	if sq.Schema != "" {
+		musts = append(musts, term("schema", sq.Schema))
+	}
+
+	if sq.Lang != "" {
+		musts = append(musts, term("lang", sq.Lang))
+	}
+
+	switch {
+	case citesUID != "" && len(sq.Types) > 0:
+		links := []query.Query{}
+		for _, t := range sq.Types {
+			links = append(links, term("links", citesUID+" "+t))
+		}
+		musts = append(musts, bleve.NewDisjunctionQuery(links...))
+	case citesUID != "":
+		musts = append(musts, term("cites", citesUID))
+	case len(sq.Types) > 0:
+		types := []query.Query{}
+		for _, t := range sq.Types {
+			types = append(types, term("types", t))
+		}
+		musts = append(musts, bleve.NewDisjunctionQuery(types...))
+	}
+
+	if len(musts) == 0 {
+		return bleve.NewMatchAllQuery(), nil
+	}
+	return bleve.NewConjunctionQuery(musts...), nil
+}
+
+// runBleveSearch returns a page of refs matching the search using the bleve index.
+func runBleveSearch(ctx context.Context, sq searchQuery) (searchResults, error) {
+
+	txn := dg.NewReadOnlyTxn()
+
+	citesUID := ""
+	if sq.Cites != "" {
+		uid, err := lookupRef(ctx, txn, sq.Cites)
+		if err != nil {
+			return searchResults{}, err
+		}
+		if uid == "" {
+			return searchResults{}, errCitedRefNotFound
+		}
+		citesUID = uid
+	}
+
+	q, err := bleveSearchQuery(sq, citesUID)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	req := bleve.NewSearchRequestOptions(q, sq.First, sq.Offset, false)
+	switch sq.Sort {
+	case "oldest":
+		req.SortBy([]string{"created_at", "-_score"})
+	case "relevance":
+		req.SortBy([]string{"-_score", "-created_at"})
+	default:
+		req.SortBy([]string{"-created_at", "-_score"})
+	}
+	req.IncludeLocations = true
+	req.Highlight = bleve.NewHighlightWithStyle("html")
+	for _, field := range bleveResultFields() {
+		req.Highlight.AddField(field)
+	}
+
+	res, err := bleveIndex.SearchInContext(ctx, req)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	uids := []string{}
+	for _, hit := range res.Hits {
+		uids = append(uids, hit.ID)
+	}
+
+	refs, err := loadSearchRefs(ctx, txn, uids)
+	if err != nil {
+		return searchResults{}, err
+	}
+
+	out := searchResults{Results: []searchRef{}, Total: int(res.Total)}
+
+	for _, hit := range res.Hits {
+		r, exists := refs[hit.ID]
+		if !exists {
+			// The index is out of date
+			continue
+		}
+
+		if sq.Sort == "relevance" {
+			score := hit.Score
+			r.Score = &score
+		}
+
+		// Fields are named as in the search query language
+		if len(hit.Fragments) > 0 {
+			r.Highlights = map[string][]string{}
+			for field, fragments := range hit.Fragments {
+				r.Highlights[strings.TrimPrefix(field, "xdata.")] = fragments
+			}
+		}
+
+		if sq.Expr != nil {
+			r.Matched = []string{}
+			for _, field := range bleveResultFields() {
+				if _, exists := hit.Locations[field]; exists {
+					r.Matched = append(r.Matched, strings.TrimPrefix(field, "xdata."))
+				}
+			}
+		}
+
+		out.Results = append(out.Results, r)
+	}
+
+	if sq.Offset+len(res.Hits) < out.Total {
+		next := encodeSearchCursor(sq.Offset + len(res.Hits))
+		out.Next = &next
+	}
+
+	return out, nil
+}
+
+// bleveResultFields returns the text fields of a bleveSearchDoc that search terms can match.
+func bleveResultFields() []string {
+	fields := []string{"title", "synopsis"}
+	for _, f := range xdataTextFields(xdataFields) {
+		fields = append(fields, "xdata."+f.Name)
+	}
+	return fields
+}
+
+// loadBleveSearchDocs fetches the documents to index for refs. Refs that are not
+// searchable (or don't exist) are omitted. The returned map's key is the uid.
+func loadBleveSearchDocs(ctx context.Context, txn *dgo.Txn, uids []string) (map[string]bleveSearchDoc, error) {
+
+	out := map[string]bleveSearchDoc{}
+	if len(uids) == 0 {
+		return out, nil
+	}
+
+	q := fmt.Sprintf(`
+		{
+			refs(func: uid(%s)) @filter(eq(node.searchable, true)) {
+				uid
+				node.search_title
+				node.search_synopsis
+				node.created_at
+				node.schema
+				node.lang
+				node.xdata
+				node.owner {
+					user.name
+				}
+				node.parent @facets(facet) {
+					uid
+				}
+			}
+		}
+	`, strings.Join(uids, ", "))
+
+	resp, err := txn.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	type Root struct {
+		Refs []struct {
+			UID       string       `json:"uid"`
+			Title     string       `json:"node.search_title"`
+			Synopsis  string       `json:"node.search_synopsis"`
+			CreatedAt time.Time    `json:"node.created_at"`
+			Schema    string       `json:"node.schema"`
+			Lang      string       `json:"node.lang"`
+			XData     string       `json:"node.xdata"`
+			Owner     []OwnerModel `json:"node.owner"`
+			Parents   []struct {
+				UID   string      `json:"uid"`
+				Facet interface{} `json:"node.parent|facet"`
+			} `json:"node.parent"`
+		} `json:"refs"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range root.Refs {
+		doc := bleveSearchDoc{
+			Title:     r.Title,
+			Synopsis:  r.Synopsis,
+			CreatedAt: r.CreatedAt,
+			Schema:    r.Schema,
+			Lang:      r.Lang,
+			Cites:     []string{},
+			Types:     []string{},
+			Links:     []string{},
+			XData:     map[string][]string{},
+		}
+
+		textFields := xdataTextFields(xdataFields)
+		values := xdataFieldValues(textFields, r.XData)
+		for _, f := range textFields {
+			for _, v := range values[f.predicate()] {
+				doc.XData[f.Name] = append(doc.XData[f.Name], v.(string))
+			}
+		}
+
+		if len(r.Owner) > 0 {
+			doc.Owner = r.Owner[0].Name
+		}
+
+		for _, p := range r.Parents {
+			doc.Cites = append(doc.Cites, p.UID)
+			if refType, exists := facetRefType(p.Facet); exists {
+				doc.Types = append(doc.Types, refType)
+				doc.Links = append(doc.Links, p.UID+" "+refType)
+			}
+		}
+
+		out[r.UID] = doc
+	}
+
+	return out, nil
+}
+
+// indexSearchRefs updates the bleve index (if enabled) for refs that have been created or modified.
+func indexSearchRefs(ctx context.Context, uids []string) error {
+
+	if bleveIndex == nil || len(uids) == 0 {
+		return nil
+	}
+
+	docs, err := loadBleveSearchDocs(ctx, dg.NewReadOnlyTxn(), uids)
+	if err != nil {
+		return err
+	}
+
+	batch := bleveIndex.NewBatch()
+	for _, uid := range uids {
+		if doc, exists := docs[uid]; exists {
+			if err := batch.Index(uid, doc); err != nil {
+				return err
+			}
+		} else {
+			batch.Delete(uid)
+		}
+	}
+
+	return bleveIndex.Batch(batch)
+}
+
+// reindexSearchCommand rebuilds the bleve index from all searchable refs.
+// The server must be stopped because the index can only be opened by one process.
+func reindexSearchCommand(args []string) error {
+
+	ctx := context.Background()
+
+	err := os.RemoveAll(bleveIndexDir)
+	if err != nil {
+		return err
+	}
+
+	index, err := openBleveIndex(bleveIndexDir)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	after := "0x0"
+	total := 0
+
+	for {
+		txn := dg.NewReadOnlyTxn()
+
+		q := `
+			{
+				refs(func: eq(node.searchable, true), first: 500, after: %s) {
+					uid
+				}
+			}
+		`
+
+		resp, err := txn.Query(ctx, fmt.Sprintf(q, after))
+		if err != nil {
+			return err
+		}
+
+		type Root struct {
+			Refs []struct {
+				UID string `json:"uid"`
+			} `json:"refs"`
+		}
+
+		var root Root
+		err = json.Unmarshal(resp.Json, &root)
+		if err != nil {
+			return err
+		}
+
+		if len(root.Refs) == 0 {
+			break
+		}
+
+		uids := []string{}
+		for _, r := range root.Refs {
+			uids = append(uids, r.UID)
+		}
+
+		docs, err := loadBleveSearchDocs(ctx, txn, uids)
+		if err != nil {
+			return err
+		}
+
+		batch := index.NewBatch()
+		for uid, doc := range docs {
+			if err := batch.Index(uid, doc); err != nil {
+				return err
+			}
+		}
+
+		err = index.Batch(batch)
+		if err != nil {
+			return err
+		}
+
+		total = total + len(root.Refs)
+		after = root.Refs[len(root.Refs)-1].UID
+
+		log.Println(fmt.Sprintf("reindex-search: %d refs indexed", total))
+	}
+
+	return nil
+}
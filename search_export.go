@@ -0,0 +1,306 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// searchExportFormats are the supported export formats.
+var searchExportFormats = map[string]struct {
+	contentType string
+	extension   string
+}{
+	"csv":    {"text/csv; charset=utf-8", "csv"},
+	"ndjson": {"application/x-ndjson", "ndjson"},
+	"bibtex": {"application/x-bibtex; charset=utf-8", "bib"},
+}
+
+// searchExporter writes search results in an export format.
+type searchExporter interface {
+	header() error
+	write(r searchRef) error
+	flush() error
+}
+
+func newSearchExporter(format string, w io.Writer) searchExporter {
+	switch format {
+	case "csv":
+		return &csvExporter{w: csv.NewWriter(w)}
+	case "ndjson":
+		return &ndjsonExporter{w: w}
+	}
+	return &bibtexExporter{w: w, keys: map[string]struct{}{}}
+}
+
+// exportSearch streams all the results of a search (up to maxSearchExport) page by page.
+// The results start at the after cursor (if any).
+func exportSearch(c echo.Context, sq searchQuery, format string, search func(context.Context, searchQuery) (searchResults, error)) error {
+	ctx := c.Request().Context()
+
+	// Pages are fetched until there are no more results
+	sq.First = maxSearchResults
+	sq.Explain = false
+
+	// The first page is fetched before writing the response so that errors can be returned
+	var page searchResults
+	if sq.Expr != nil || sq.hasFilters() {
+		results, err := exportSearchPage(ctx, sq, search)
+		if err != nil {
+			return err
+		}
+		page = results
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, searchExportFormats[format].contentType)
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"search.%s\"", searchExportFormats[format].extension))
+	res.WriteHeader(http.StatusOK)
+
+	exporter := newSearchExporter(format, res)
+	if err := exporter.header(); err != nil {
+		return nil
+	}
+
+	exported := 0
+	for {
+		for _, r := range page.Results {
+			if exported == maxSearchExport {
+				return exporter.flush()
+			}
+			if err := exporter.write(r); err != nil {
+				// Client has gone away
+				return nil
+			}
+			exported++
+		}
+
+		if err := exporter.flush(); err != nil {
+			return nil
+		}
+		res.Flush()
+
+		if page.Next == nil {
+			return nil
+		}
+
+		// Follow the cursor so that refs created during the export don't shift the pages
+		offset, after, err := decodeSearchAfter(*page.Next)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		sq.Offset, sq.After = offset, after
+
+		results, err := exportSearchPage(ctx, sq, search)
+		if err != nil {
+			// The response has already started
+			log.Println(err)
+			return nil
+		}
+		page = results
+	}
+}
+
+// exportSearchPage fetches a page of results. Each page has its own query timeout.
+func exportSearchPage(ctx context.Context, sq searchQuery, search func(context.Context, searchQuery) (searchResults, error)) (searchResults, error) {
+
+	if stdQueryTimeout != 0 {
+		// Create a max query timeout
+		_ctx, cancel := context.WithTimeout(ctx, time.Duration(stdQueryTimeout)*time.Millisecond)
+		defer cancel()
+		ctx = _ctx
+	}
+
+	return search(ctx, sq)
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) header() error {
+	return e.w.Write([]string{"id", "title", "synopsis", "created_at", "data"})
+}
+
+func (e *csvExporter) write(r searchRef) error {
+
+	title, synopsis := "", ""
+	if r.SearchTitle != nil {
+		title = *r.SearchTitle
+	}
+	if r.SearchSynopsis != nil {
+		synopsis = *r.SearchSynopsis
+	}
+
+	return e.w.Write([]string{csvText(r.refAddress()), csvText(title), csvText(synopsis), r.CreatedAt.Format(time.RFC3339), r.Data})
+}
+
+// csvText prevents text from being interpreted as a formula by spreadsheets.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func (e *csvExporter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExporter struct {
+	w io.Writer
+}
+
+func (e *ndjsonExporter) header() error { return nil }
+
+func (e *ndjsonExporter) write(r searchRef) error {
+
+	line, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+func (e *ndjsonExporter) flush() error { return nil }
+
+// bibtexExporter writes each ref as a @misc entry. Common bibliographic fields of the data
+// payload (authors, year, doi, journal and publisher) are used if present.
+type bibtexExporter struct {
+	w    io.Writer
+	keys map[string]struct{} // keys that have been used
+}
+
+func (e *bibtexExporter) header() error { return nil }
+
+var bibtexKeyChars = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+func (e *bibtexExporter) write(r searchRef) error {
+
+	// Citation keys must be unique within the file
+	base := strings.Trim(bibtexKeyChars.ReplaceAllString(r.refAddress(), "_"), "_")
+	key := base
+	for n := 2; ; n++ {
+		if _, exists := e.keys[key]; !exists {
+			break
+		}
+		key = fmt.Sprintf("%s_%d", base, n)
+	}
+	e.keys[key] = struct{}{}
+
+	fields := [][2]string{}
+	add := func(name, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			fields = append(fields, [2]string{name, value})
+		}
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Data), &data); err != nil {
+		// The data payload is not a json object
+		data = nil
+	}
+
+	if r.SearchTitle != nil {
+		add("title", *r.SearchTitle)
+	}
+	add("author", strings.Join(bibtexAuthors(data["authors"]), " and "))
+
+	year := fmt.Sprintf("%d", r.CreatedAt.Year())
+	switch y := data["year"].(type) {
+	case float64:
+		year = fmt.Sprintf("%d", int(y))
+	case string:
+		if strings.TrimSpace(y) != "" {
+			year = y
+		}
+	}
+	add("year", year)
+
+	for _, name := range []string{"journal", "publisher", "doi"} {
+		if v, ok := data[name].(string); ok {
+			add(name, v)
+		}
+	}
+
+	if r.SearchSynopsis != nil {
+		add("abstract", *r.SearchSynopsis)
+	}
+	add("url", fmt.Sprintf("%s/%s", serverHostUrl, r.refAddress()))
+
+	var b strings.Builder
+	b.WriteString("@misc{" + key)
+	for _, f := range fields {
+		value := bibtexEscape(f[1])
+		if f[0] == "url" || f[0] == "doi" {
+			// Verbatim fields
+			value = strings.NewReplacer("{", "", "}", "").Replace(f[1])
+		}
+		b.WriteString(",\n  " + f[0] + " = {" + value + "}")
+	}
+	b.WriteString("\n}\n\n")
+
+	_, err := io.WriteString(e.w, b.String())
+	return err
+}
+
+func (e *bibtexExporter) flush() error { return nil }
+
+// bibtexAuthors returns the names of authors from a list of names or of objects with a name.
+func bibtexAuthors(v interface{}) []string {
+
+	out := []string{}
+
+	authors, ok := v.([]interface{})
+	if !ok {
+		return out
+	}
+
+	for _, a := range authors {
+		switch x := a.(type) {
+		case string:
+			out = append(out, x)
+		case map[string]interface{}:
+			if name, ok := x["name"].(string); ok {
+				out = append(out, name)
+			}
+		}
+	}
+
+	return out
+}
+
+var bibtexReplacer = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`&`, `\&`,
+	`%`, `\%`,
+	`$`, `\$`,
+	`#`, `\#`,
+	`_`, `\_`,
+	"\r\n", " ",
+	"\n", " ",
+)
+
+// bibtexEscape escapes the characters that are special in BibTeX (and LaTeX).
+func bibtexEscape(s string) string {
+	return bibtexReplacer.Replace(s)
+}
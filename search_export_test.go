@@ -0,0 +1,54 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestCSVExporterEscapesFormulas(t *testing.T) {
+
+	var buf bytes.Buffer
+	e := &csvExporter{w: csv.NewWriter(&buf)}
+
+	name := "alice"
+	title := "=HYPERLINK(\"http://example.com\")"
+	synopsis := "-1+1"
+
+	err := e.write(searchRef{
+		Name:           &name,
+		ID:             "3a5c",
+		Data:           `{"year":2019}`,
+		SearchTitle:    &title,
+		SearchSynopsis: &synopsis,
+		CreatedAt:      time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"'@alice/3a5c", "'" + title, "'" + synopsis, "2019-01-02T03:04:05Z", `{"year":2019}`}
+	if len(records) != 1 || len(records[0]) != len(want) {
+		t.Fatalf("records = %q, want %q", records, want)
+	}
+
+	for i := range want {
+		if records[0][i] != want[i] {
+			t.Errorf("column %d = %q, want %q", i, records[0][i], want[i])
+		}
+	}
+}
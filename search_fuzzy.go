@@ -0,0 +1,241 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/dgo"
+)
+
+// Fuzzy search terms match text containing each of their words within an edit distance (see
+// fuzzyDistance). DGraph's match function compares the edit distance with the whole value of
+// a predicate, so a misspelled word would never match a title or synopsis with more than one
+// word. Instead, the refs sharing a trigram with a fuzzy term are found using the trigram
+// indexes and their words are compared here. Like the match function, a misspelled word must
+// share at least one trigram with the word it is meant to be. Words shorter than 3 characters
+// must match exactly.
+
+// searchWords splits text into lower-cased words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// fuzzyTrigramRegexp returns a regular expression matching text that contains a trigram of
+// the words. "" is returned if no word has at least 3 characters. The words only contain
+// letters and digits, so they can be embedded within the regular expression.
+func fuzzyTrigramRegexp(words []string) string {
+
+	trigrams := []string{}
+	seen := map[string]struct{}{}
+
+	for _, w := range words {
+		r := []rune(w)
+		for i := 0; i+3 <= len(r); i++ {
+			t := string(r[i : i+3])
+			if _, exists := seen[t]; exists {
+				continue
+			}
+			seen[t] = struct{}{}
+			trigrams = append(trigrams, t)
+		}
+	}
+
+	if len(trigrams) == 0 {
+		return ""
+	}
+
+	return "/(" + strings.Join(trigrams, "|") + ")/i"
+}
+
+// fuzzyWordMatch returns true if a word of the text is within the edit distance of a search word.
+func fuzzyWordMatch(word, searchWord string) bool {
+	if utf8.RuneCountInString(searchWord) < 3 {
+		return word == searchWord
+	}
+	return levenshtein([]rune(word), []rune(searchWord)) <= fuzzyDistance(searchWord)
+}
+
+// fuzzyMatch returns true if every search word is within its edit distance of a word of the
+// text. The words of a phrase must also be next to each other and in order.
+func fuzzyMatch(text string, words []string, phrase bool) bool {
+
+	textWords := searchWords(text)
+
+	if phrase {
+	next:
+		for i := 0; i+len(words) <= len(textWords); i++ {
+			for j, w := range words {
+				if !fuzzyWordMatch(textWords[i+j], w) {
+					continue next
+				}
+			}
+			return true
+		}
+		return false
+	}
+
+	for _, w := range words {
+		found := false
+		for _, tw := range textWords {
+			if fuzzyWordMatch(tw, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// levenshtein returns the edit distance between two words.
+func levenshtein(a, b []rune) int {
+
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// fuzzyTerms returns the (non-negated) terms of text fields.
+func (e *searchExpr) fuzzyTerms(fields []xdataField) []*searchExpr {
+
+	switch e.Op {
+	case "and", "or":
+		out := []*searchExpr{}
+		for _, child := range e.Children {
+			out = append(out, child.fuzzyTerms(fields)...)
+		}
+		return out
+	case "not":
+		return nil
+	}
+
+	if len(e.textPredicates(fields, "")) == 0 {
+		return nil
+	}
+	return []*searchExpr{e}
+}
+
+// resolveFuzzyTerms finds the refs matched by each fuzzy term of a search and sets the term's
+// Fuzzy field. If refs is not empty, only those refs are considered. At most
+// maxSearchCandidates refs sharing a trigram with the term are compared per predicate.
+func resolveFuzzyTerms(ctx context.Context, txn *dgo.Txn, expr *searchExpr, fields []xdataField, refs []string) error {
+
+	type fuzzyBlock struct {
+		term  *searchExpr
+		pred  string
+		words []string
+	}
+
+	blocks := map[string]fuzzyBlock{}
+	dql := []string{}
+
+	for _, t := range expr.fuzzyTerms(fields) {
+		t.Fuzzy = map[string][]string{}
+
+		words := searchWords(t.Value)
+		re := fuzzyTrigramRegexp(words)
+		if re == "" {
+			continue
+		}
+
+		for _, pred := range t.textPredicates(fields, "") {
+			name := fmt.Sprintf("t%d", len(blocks))
+			blocks[name] = fuzzyBlock{t, pred, words}
+
+			fn := fmt.Sprintf("regexp(%s, %s)", pred, re)
+			filter := "eq(node.searchable, true)"
+			if len(refs) > 0 {
+				filter = filter + " AND " + fn
+				fn = "uid(" + strings.Join(refs, ", ") + ")"
+			}
+
+			dql = append(dql, fmt.Sprintf(`
+				%s(func: %s, first: %d) @filter(%s) {
+					uid
+					value: %s
+				}
+			`, name, fn, maxSearchCandidates, filter, pred))
+		}
+	}
+
+	if len(dql) == 0 {
+		return nil
+	}
+
+	resp, err := txn.Query(ctx, "{"+strings.Join(dql, "\n")+"}")
+	if err != nil {
+		return err
+	}
+
+	var root map[string][]struct {
+		UID   string          `json:"uid"`
+		Value json.RawMessage `json:"value"`
+	}
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	for name, nodes := range root {
+		b := blocks[name]
+
+		for _, n := range nodes {
+			// xdata text fields are lists
+			values := []string{}
+			if err := json.Unmarshal(n.Value, &values); err != nil {
+				var value string
+				if err := json.Unmarshal(n.Value, &value); err != nil {
+					return err
+				}
+				values = []string{value}
+			}
+
+			for _, v := range values {
+				if fuzzyMatch(v, b.words, b.term.Phrase) {
+					b.term.Fuzzy[b.pred] = append(b.term.Fuzzy[b.pred], n.UID)
+					break
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"strings"
+)
+
+// Refs can have a language. It is provided when the ref is created or detected from the
+// search title and synopsis. The synopsis of a ref with a language is also stored with a
+// language tag (eg. node.search_synopsis@de) so that it is indexed using the language's
+// stemmer. Searches with the lang query param only match refs in that language and match
+// the synopsis using the language's stemmer.
+
+// searchLanguages are the languages that DGraph's fulltext index can stem.
+var searchLanguages = map[string]string{
+	"da": "Danish",
+	"de": "German",
+	"en": "English",
+	"es": "Spanish",
+	"fi": "Finnish",
+	"fr": "French",
+	"hu": "Hungarian",
+	"it": "Italian",
+	"nl": "Dutch",
+	"no": "Norwegian",
+	"pt": "Portuguese",
+	"ro": "Romanian",
+	"ru": "Russian",
+	"sv": "Swedish",
+	"tr": "Turkish",
+}
+
+// languageStopWords are common words used to detect the language of text.
+var languageStopWords = map[string][]string{
+	"da": {"og", "at", "det", "er", "en", "af", "ikke", "den", "til", "med", "har", "som", "jeg", "vi", "hvor"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "mit", "ein", "eine", "den", "von", "zu", "auf", "für", "wir"},
+	"en": {"the", "and", "of", "to", "in", "is", "that", "for", "with", "this", "are", "on", "we", "by", "from"},
+	"es": {"el", "la", "los", "las", "y", "es", "una", "del", "en", "que", "para", "con", "por", "se", "como"},
+	"fi": {"ja", "on", "ei", "se", "että", "oli", "ovat", "kun", "mutta", "tai", "myös", "joka", "sen", "tämä", "mukaan"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "du", "dans", "pour", "que", "nous", "sur", "pas", "avec"},
+	"it": {"il", "di", "che", "e", "è", "una", "per", "del", "della", "con", "sono", "non", "gli", "nel", "alla"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "met", "voor", "op", "zijn", "ook", "te", "wordt"},
+	"no": {"og", "å", "det", "er", "en", "av", "ikke", "den", "til", "med", "har", "som", "jeg", "vi", "hvor"},
+	"pt": {"os", "as", "e", "do", "da", "um", "uma", "que", "para", "com", "não", "é", "em", "dos", "das"},
+	"sv": {"och", "att", "det", "som", "är", "av", "för", "med", "på", "inte", "den", "till", "vi", "har", "ett"},
+}
+
+// languageStopWordIndex maps each stop word to its languages.
+var languageStopWordIndex = map[string][]string{}
+
+func init() {
+	for lang, words := range languageStopWords {
+		for _, w := range words {
+			languageStopWordIndex[w] = append(languageStopWordIndex[w], lang)
+		}
+	}
+}
+
+// detectLanguage returns the language of text based on the number of stop words of each
+// language. It returns "" if the language can't be determined.
+func detectLanguage(text string) string {
+
+	counts := map[string]int{}
+	for _, w := range searchWords(text) {
+		for _, lang := range languageStopWordIndex[w] {
+			counts[lang]++
+		}
+	}
+
+	best, bestCount, tie := "", 0, false
+	for lang, n := range counts {
+		switch {
+		case n > bestCount:
+			best, bestCount, tie = lang, n, false
+		case n == bestCount:
+			tie = true
+		}
+	}
+
+	// Short or ambiguous text
+	if bestCount < 2 || tie {
+		return ""
+	}
+
+	return best
+}
+
+// refLanguage returns the language of a ref. If lang is empty, it is detected from the search
+// title and synopsis.
+func refLanguage(lang string, title, synopsis *string) string {
+
+	if lang = strings.ToLower(strings.TrimSpace(lang)); lang != "" {
+		return lang
+	}
+
+	text := []string{}
+	if title != nil {
+		text = append(text, *title)
+	}
+	if synopsis != nil {
+		text = append(text, *synopsis)
+	}
+
+	return detectLanguage(strings.Join(text, " "))
+}
+
+// languagePredicates returns the predicates to set for a ref's language.
+func languagePredicates(lang string, synopsis *string) map[string]interface{} {
+
+	out := map[string]interface{}{}
+	if lang == "" {
+		return out
+	}
+
+	out["node.lang"] = lang
+	if synopsis != nil {
+		out["node.search_synopsis@"+lang] = *synopsis
+	}
+
+	return out
+}
+
+// synopsisPredicate returns the synopsis predicate that is matched by a search in a language.
+func synopsisPredicate(lang string) string {
+	if lang == "" {
+		return "node.search_synopsis"
+	}
+	return "node.search_synopsis@" + lang
+}
+
+// backfillLangCommand detects the language of existing refs that don't have one.
+func backfillLangCommand(args []string) error {
+	return backfillRefs("backfill-lang", func(n backfillNode) (map[string]interface{}, map[string]interface{}) {
+
+		set := map[string]interface{}{"uid": n.UID}
+
+		if n.Lang == nil {
+			for pred, value := range languagePredicates(refLanguage("", n.Title, n.Synopsis), n.Synopsis) {
+				set[pred] = value
+			}
+		}
+
+		return nil, set
+	})
+}
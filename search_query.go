@@ -0,0 +1,558 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The search query language:
+//
+//	graph theory             both words (in the title, synopsis or a text field of XDATA_INDEX)
+//	"graph theory"           the phrase (its words next to each other and in order)
+//	graph OR network         either word
+//	-survey, NOT survey      excludes refs containing the word
+//	(graph OR network) flow  grouping
+//	title:graph              field prefix: title, synopsis or a field configured in XDATA_INDEX
+//	title:"graph theory"     field prefix with a phrase
+//
+// AND is implied between words. AND, OR and NOT must be upper case.
+
+// maxSearchTerms limits the complexity of a search query.
+const maxSearchTerms = 20
+
+// searchSyntaxError describes why a search query can't be parsed.
+type searchSyntaxError struct {
+	Position int    `json:"position"` // byte offset within the query
+	Message  string `json:"message"`
+}
+
+func (e *searchSyntaxError) Error() string {
+	return fmt.Sprintf("%s (at position %d)", e.Message, e.Position)
+}
+
+// searchExpr is a node of a parsed search query.
+type searchExpr struct {
+	Op       string // and, or, not or term
+	Children []*searchExpr
+
+	// term
+	Field   string // "" (any text field), title, synopsis or the name of an xdata field
+	Value   string
+	Phrase  bool
+	VarType string
+	Pos     int // position within the query
+
+	// Fuzzy holds the refs matched by a fuzzy term for each of its predicates (see
+	// resolveFuzzyTerms).
+	Fuzzy map[string][]string
+}
+
+type searchToken struct {
+	kind  string // word, phrase, (, ), AND, OR or NOT
+	field string
+	value string
+	pos   int
+}
+
+var searchFieldPrefix = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// tokenizeSearchQuery splits a search query into tokens.
+func tokenizeSearchQuery(query string) ([]searchToken, error) {
+
+	tokens := []searchToken{}
+	i := 0
+
+	readPhrase := func(start int) (string, int, error) {
+		end := strings.IndexByte(query[start+1:], '"')
+		if end == -1 {
+			return "", 0, &searchSyntaxError{start, "phrase is not terminated"}
+		}
+		return query[start+1 : start+1+end], start + 1 + end + 1, nil
+	}
+
+	for i < len(query) {
+		ch := rune(query[i])
+
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, searchToken{kind: string(ch), pos: i})
+			i++
+		case ch == '"':
+			phrase, next, err := readPhrase(i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, searchToken{kind: "phrase", value: phrase, pos: i})
+			i = next
+		case ch == '-':
+			if i+1 < len(query) && !unicode.IsSpace(rune(query[i+1])) && query[i+1] != ')' {
+				tokens = append(tokens, searchToken{kind: "NOT", pos: i})
+			}
+			i++
+		default:
+			start := i
+			for i < len(query) && !unicode.IsSpace(rune(query[i])) && !strings.ContainsRune(`()"`, rune(query[i])) {
+				i++
+			}
+			word := query[start:i]
+
+			switch word {
+			case "AND", "OR", "NOT":
+				tokens = append(tokens, searchToken{kind: word, pos: start})
+				continue
+			}
+
+			// Field prefix
+			if j := strings.Index(word, ":"); j > 0 && searchFieldPrefix.MatchString(word[:j]) && !strings.HasPrefix(word[j+1:], "/") {
+				field, value := word[:j], word[j+1:]
+
+				if value != "" {
+					tokens = append(tokens, searchToken{kind: "word", field: field, value: value, pos: start})
+					continue
+				}
+
+				if i < len(query) && query[i] == '"' {
+					phrase, next, err := readPhrase(i)
+					if err != nil {
+						return nil, err
+					}
+					tokens = append(tokens, searchToken{kind: "phrase", field: field, value: phrase, pos: start})
+					i = next
+					continue
+				}
+
+				return nil, &searchSyntaxError{start, fmt.Sprintf("%s: must be followed by a word or phrase", field)}
+			}
+
+			tokens = append(tokens, searchToken{kind: "word", value: word, pos: start})
+		}
+	}
+
+	return tokens, nil
+}
+
+// searchParser is a recursive descent parser:
+//
+//	or      = and { "OR" and }
+//	and     = unary { [ "AND" ] unary }
+//	unary   = ( "NOT" | "-" ) unary | primary
+//	primary = "(" or ")" | word | phrase
+type searchParser struct {
+	query  string
+	tokens []searchToken
+	i      int
+	terms  int
+	fields map[string]xdataField
+}
+
+// parseSearchExpr parses a search query. A nil expression is returned if the query is empty.
+func parseSearchExpr(query string, fields []xdataField) (*searchExpr, error) {
+
+	tokens, err := tokenizeSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	p := &searchParser{query: query, tokens: tokens, fields: map[string]xdataField{}}
+	for _, f := range fields {
+		p.fields[f.Name] = f
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.i < len(p.tokens) {
+		return nil, &searchSyntaxError{p.tokens[p.i].pos, fmt.Sprintf("unexpected %s", p.tokens[p.i].describe())}
+	}
+
+	return expr, nil
+}
+
+func (t searchToken) describe() string {
+	switch t.kind {
+	case "word", "phrase":
+		return t.kind
+	}
+	return fmt.Sprintf("%q", t.kind)
+}
+
+func (p *searchParser) peek() *searchToken {
+	if p.i < len(p.tokens) {
+		return &p.tokens[p.i]
+	}
+	return nil
+}
+
+func (p *searchParser) parseOr() (*searchExpr, error) {
+
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*searchExpr{left}
+	for t := p.peek(); t != nil && t.kind == "OR"; t = p.peek() {
+		p.i++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &searchExpr{Op: "or", Children: children}, nil
+}
+
+func (p *searchParser) parseAnd() (*searchExpr, error) {
+
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	children := []*searchExpr{left}
+	for t := p.peek(); t != nil && t.kind != "OR" && t.kind != ")"; t = p.peek() {
+		if t.kind == "AND" {
+			p.i++
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, right)
+	}
+
+	if len(children) == 1 {
+		return left, nil
+	}
+	return &searchExpr{Op: "and", Children: children}, nil
+}
+
+func (p *searchParser) parseUnary() (*searchExpr, error) {
+
+	t := p.peek()
+	if t != nil && t.kind == "NOT" {
+		p.i++
+		child, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &searchExpr{Op: "not", Children: []*searchExpr{child}}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *searchParser) parsePrimary() (*searchExpr, error) {
+
+	t := p.peek()
+	if t == nil {
+		return nil, &searchSyntaxError{len(p.query), "unexpected end of query"}
+	}
+	p.i++
+
+	switch t.kind {
+	case "(":
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.peek(); closing == nil || closing.kind != ")" {
+			return nil, &searchSyntaxError{t.pos, "parenthesis is not closed"}
+		}
+		p.i++
+		return expr, nil
+	case "word", "phrase":
+		return p.term(*t)
+	}
+
+	return nil, &searchSyntaxError{t.pos, fmt.Sprintf("unexpected %s", t.describe())}
+}
+
+// term validates a word or phrase against its field.
+func (p *searchParser) term(t searchToken) (*searchExpr, error) {
+
+	p.terms++
+	if p.terms > maxSearchTerms {
+		return nil, &searchSyntaxError{t.pos, fmt.Sprintf("max %d words or phrases permitted", maxSearchTerms)}
+	}
+
+	value := strings.TrimSpace(t.value)
+	if value == "" {
+		return nil, &searchSyntaxError{t.pos, "phrase must not be empty"}
+	}
+
+	expr := &searchExpr{Op: "term", Field: t.field, Value: value, Phrase: t.kind == "phrase", VarType: "string", Pos: t.pos}
+
+	switch t.field {
+	case "", "title", "synopsis":
+		return expr, nil
+	}
+
+	f, exists := p.fields[t.field]
+	if !exists {
+		return nil, &searchSyntaxError{t.pos, fmt.Sprintf("unknown field %s", t.field)}
+	}
+
+	switch f.Type {
+	case "term", "exact", "text":
+	case "bool":
+		if value != "true" && value != "false" {
+			return nil, &searchSyntaxError{t.pos, fmt.Sprintf("%s must be true or false", t.field)}
+		}
+		expr.VarType = "bool"
+	default:
+		v, ok := convertXDataValue(f.Type, value)
+		if !ok {
+			return nil, &searchSyntaxError{t.pos, fmt.Sprintf("%s must be a valid %s", t.field, f.Type)}
+		}
+		if tm, isTime := v.(time.Time); isTime {
+			expr.Value = tm.Format(time.RFC3339)
+		} else {
+			expr.Value = fmt.Sprintf("%v", v)
+			expr.VarType = queryVarTypes[f.Type]
+		}
+	}
+
+	return expr, nil
+}
+
+// searchModes are the ways that words of the title, synopsis and text fields can match:
+//
+//	exact:  the word (default)
+//	fuzzy:  also words within an edit distance of each word (see search_fuzzy.go)
+//	prefix: also words starting with the word
+//
+// Fuzzy and prefix matching use the trigram indexes and require at least 3 characters.
+var searchModes = map[string]struct{}{
+	"exact":  {},
+	"fuzzy":  {},
+	"prefix": {},
+}
+
+// searchPrefixWord is a word that can be safely embedded within a regular expression.
+var searchPrefixWord = regexp.MustCompile(`^[\p{L}\p{N}]{3,}$`)
+
+// fuzzyDistance returns the maximum edit distance for a fuzzy match. Short words
+// permit fewer edits.
+func fuzzyDistance(value string) int {
+	if utf8.RuneCountInString(value) <= 4 && maxFuzzyDistance > 1 {
+		return 1
+	}
+	return maxFuzzyDistance
+}
+
+// phraseRegexp returns a regular expression matching the words of a phrase next to each other
+// and in order (separated by anything other than letters and digits). The regular expression
+// uses the trigram indexes, so "" is returned if no word has at least 3 characters (the phrase
+// then matches refs containing all of its words). Regular expressions can't be passed as
+// variables, so the phrase is split into words that only contain letters and digits.
+func phraseRegexp(phrase string) string {
+
+	words := strings.FieldsFunc(phrase, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	if len(words) < 2 {
+		return ""
+	}
+
+	indexable := false
+	for _, w := range words {
+		if utf8.RuneCountInString(w) >= 3 {
+			indexable = true
+		}
+	}
+
+	if !indexable {
+		return ""
+	}
+
+	return fmt.Sprintf("/(^|[^\\p{L}\\p{N}])%s($|[^\\p{L}\\p{N}])/i", strings.Join(words, "[^\\p{L}\\p{N}]+"))
+}
+
+// dql converts the expression to a DQL filter. Values are passed as variables using addVar.
+// Negated words always match exactly. If lang is set, the synopsis is matched using the
+// language's stemmer (see search_lang.go).
+func (e *searchExpr) dql(fields []xdataField, mode, lang string, addVar func(typ, val string) string) string {
+
+	switch e.Op {
+	case "and", "or":
+		parts := []string{}
+		for _, child := range e.Children {
+			parts = append(parts, child.dql(fields, mode, lang, addVar))
+		}
+		return "(" + strings.Join(parts, " "+strings.ToUpper(e.Op)+" ") + ")"
+	case "not":
+		return "NOT " + e.Children[0].dql(fields, "exact", lang, addVar)
+	}
+
+	v := addVar(e.VarType, e.Value)
+
+	preds := e.textPredicates(fields, lang)
+	if len(preds) == 0 {
+		for _, f := range fields {
+			if f.Name != e.Field {
+				continue
+			}
+			if f.Type == "term" {
+				return fmt.Sprintf("allofterms(%s, %s)", f.predicate(), v)
+			}
+			return fmt.Sprintf("eq(%s, %s)", f.predicate(), v)
+		}
+		return ""
+	}
+
+	// The indexes only match the words of a phrase. Their order is checked by phraseRegexp.
+	phrase := ""
+	if e.Phrase {
+		phrase = phraseRegexp(e.Value)
+	}
+
+	parts := []string{}
+	for _, pred := range preds {
+		part := fmt.Sprintf("alloftext(%s, %s)", pred, v)
+		if pred == "node.search_title" {
+			part = fmt.Sprintf("allofterms(%s, %s)", pred, v)
+		}
+
+		if phrase != "" {
+			// Language tagged synopses are also stored untagged
+			part = fmt.Sprintf("(%s AND regexp(%s, %s))", part, strings.Split(pred, "@")[0], phrase)
+		}
+
+		parts = append(parts, part)
+	}
+
+	switch {
+	case mode == "fuzzy":
+		for _, pred := range preds {
+			// Language tagged synopses are also stored untagged
+			if uids := e.Fuzzy[strings.Split(pred, "@")[0]]; len(uids) > 0 {
+				parts = append(parts, "uid("+strings.Join(uids, ", ")+")")
+			}
+		}
+	case mode == "prefix" && !e.Phrase && searchPrefixWord.MatchString(e.Value):
+		// Regular expressions can't be passed as variables. The word only contains letters and digits.
+		// Language tagged synopses are also stored untagged (regexp doesn't support language tags)
+		for _, pred := range preds {
+			parts = append(parts, fmt.Sprintf("regexp(%s, /(^|[^\\p{L}\\p{N}])%s/i)", strings.Split(pred, "@")[0], e.Value))
+		}
+	}
+
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return "(" + strings.Join(parts, " OR ") + ")"
+}
+
+// textPredicates returns the text predicates matched by the term. nil is returned if the
+// term's field is not a text field.
+func (e *searchExpr) textPredicates(fields []xdataField, lang string) []string {
+
+	switch e.Field {
+	case "":
+		preds := []string{"node.search_title", synopsisPredicate(lang)}
+		for _, f := range xdataTextFields(fields) {
+			preds = append(preds, f.predicate())
+		}
+		return preds
+	case "title":
+		return []string{"node.search_title"}
+	case "synopsis":
+		return []string{synopsisPredicate(lang)}
+	}
+
+	for _, f := range xdataTextFields(fields) {
+		if f.Name == e.Field {
+			return []string{f.predicate()}
+		}
+	}
+	return nil
+}
+
+// textTerms returns the words and phrases that may match the title or synopsis of a ref.
+// Negated terms are excluded.
+func (e *searchExpr) textTerms() []string {
+
+	switch e.Op {
+	case "and", "or":
+		out := []string{}
+		for _, child := range e.Children {
+			out = append(out, child.textTerms()...)
+		}
+		return out
+	case "not":
+		return nil
+	}
+
+	switch e.Field {
+	case "", "title", "synopsis":
+		return []string{e.Value}
+	}
+	return nil
+}
+
+// fieldTerms returns the (non-negated) words and phrases that may match the field, restricted
+// to the field. The field is title, synopsis or the name of an xdata field.
+func (e *searchExpr) fieldTerms(field string, fields []xdataField) []*searchExpr {
+
+	switch e.Op {
+	case "and", "or":
+		out := []*searchExpr{}
+		for _, child := range e.Children {
+			out = append(out, child.fieldTerms(field, fields)...)
+		}
+		return out
+	case "not":
+		return nil
+	}
+
+	if e.Field == field {
+		return []*searchExpr{e}
+	}
+
+	if e.Field != "" {
+		return nil
+	}
+
+	switch field {
+	case "title", "synopsis":
+	default:
+		if !containsXDataField(xdataTextFields(fields), field) {
+			return nil
+		}
+	}
+
+	term := *e
+	term.Field = field
+	return []*searchExpr{&term}
+}
+
+func containsXDataField(fields []xdataField, name string) bool {
+	for _, f := range fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// String formats an expression for comparison within tests.
+func (e *searchExpr) String() string {
+
+	switch e.Op {
+	case "and", "or":
+		parts := []string{}
+		for _, child := range e.Children {
+			parts = append(parts, child.String())
+		}
+		return "(" + strings.Join(parts, " "+strings.ToUpper(e.Op)+" ") + ")"
+	case "not":
+		return "-" + e.Children[0].String()
+	}
+
+	value := e.Value
+	if e.Phrase {
+		value = fmt.Sprintf("%q", value)
+	}
+	if e.Field != "" {
+		return e.Field + ":" + value
+	}
+	return value
+}
+
+func TestParseSearchExpr(t *testing.T) {
+
+	fields := []xdataField{
+		{Name: "author", Type: "term"},
+		{Name: "year", Type: "int"},
+		{Name: "peer_reviewed", Type: "bool"},
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"graph", "graph"},
+		{"graph theory", "(graph AND theory)"},
+		{"graph AND theory", "(graph AND theory)"},
+		{"graph OR network flow", "(graph OR (network AND flow))"},
+		{"(graph OR network) flow", "((graph OR network) AND flow)"},
+		{`"graph theory"`, `"graph theory"`},
+		{`title:"graph theory" -survey author:knuth`, `(title:"graph theory" AND -survey AND author:knuth)`},
+		{"graph NOT survey", "(graph AND -survey)"},
+		{"-(a OR b) c", "(-(a OR b) AND c)"},
+		{"year:2019 peer_reviewed:true", "(year:2019 AND peer_reviewed:true)"},
+		{"well-known", "well-known"},
+		{"graph -", "graph"},
+		{"http://example.org", "http://example.org"},
+	}
+
+	for _, tt := range tests {
+		expr, err := parseSearchExpr(tt.query, fields)
+		if err != nil {
+			t.Errorf("parseSearchExpr(%q): %v", tt.query, err)
+			continue
+		}
+		if got := expr.String(); got != tt.want {
+			t.Errorf("parseSearchExpr(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	if expr, err := parseSearchExpr("   ", fields); expr != nil || err != nil {
+		t.Errorf("parseSearchExpr of an empty query = %v, %v, want nil", expr, err)
+	}
+}
+
+func TestParseSearchExprErrors(t *testing.T) {
+
+	fields := []xdataField{{Name: "year", Type: "int"}}
+
+	tests := []struct {
+		query    string
+		position int
+	}{
+		{"(graph", 0},
+		{"graph)", 5},
+		{`graph "theory`, 6},
+		{"graph OR", 8},
+		{"publisher:acm", 0},
+		{"year:recent", 0},
+		{"title: graph", 0},
+		{`""`, 0},
+	}
+
+	for _, tt := range tests {
+		_, err := parseSearchExpr(tt.query, fields)
+		se, ok := err.(*searchSyntaxError)
+		if !ok {
+			t.Errorf("parseSearchExpr(%q) = %v, want a syntax error", tt.query, err)
+			continue
+		}
+		if se.Position != tt.position {
+			t.Errorf("parseSearchExpr(%q) error at %d, want %d (%s)", tt.query, se.Position, tt.position, se.Message)
+		}
+	}
+}
+
+func TestPhraseRegexp(t *testing.T) {
+
+	tests := []struct {
+		phrase string
+		want   string
+	}{
+		{"graph theory", `/(^|[^\p{L}\p{N}])graph[^\p{L}\p{N}]+theory($|[^\p{L}\p{N}])/i`},
+		{"graph", ""},
+		{"a b", ""},
+	}
+
+	for _, tt := range tests {
+		if got := phraseRegexp(tt.phrase); got != tt.want {
+			t.Errorf("phraseRegexp(%q) = %s, want %s", tt.phrase, got, tt.want)
+		}
+	}
+}
+
+func TestSearchExprDQLPrefixLanguage(t *testing.T) {
+
+	e, err := parseSearchExpr("synopsis:graph", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addVar := func(typ, val string) string { return "$v0" }
+
+	// regexp doesn't support language tags, so the untagged synopsis is matched
+	got := e.dql(nil, "prefix", "en", addVar)
+	want := `(alloftext(node.search_synopsis@en, $v0) OR regexp(node.search_synopsis, /(^|[^\p{L}\p{N}])graph/i))`
+	if got != want {
+		t.Errorf("dql = %s, want %s", got, want)
+	}
+}
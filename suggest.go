@@ -0,0 +1,398 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+// suggestion is a ref title or an account name that can be suggested while typing.
+type suggestion struct {
+	Type  string `json:"type"` // ref or account
+	ID    string `json:"id"`   // ref id or @name
+	Title string `json:"title"`
+}
+
+// maxSuggestKey is the maximum length (in bytes) of an indexed key.
+const maxSuggestKey = 64
+
+// keys returns the keys that the suggestion is indexed by.
+func (s *suggestion) keys() []string {
+	if s.Type == "account" {
+		return []string{strings.ToLower(s.Title)}
+	}
+	return suggestKeys(s.Title)
+}
+
+type suggestEntry struct {
+	key string
+	s   *suggestion
+}
+
+// suggestIndex is an in-memory prefix index of the titles of searchable refs and the names of
+// validated accounts. Titles are indexed from the start of every word so that "theory"
+// suggests "Graph Theory". It is built when the server starts, updated as refs and accounts are
+// created and rebuilt daily.
+type suggestIndex struct {
+	sync.RWMutex
+	entries []suggestEntry // sorted by key
+
+	// Suggestions added and removed while the index is being rebuilt
+	rebuilding      bool
+	pending         []suggestEntry
+	removed         map[string]struct{} // ref ids and @names
+	removedAccounts []string            // @names of accounts whose refs were removed
+}
+
+var suggestions = &suggestIndex{}
+
+// suggestKeys returns the normalized text starting at every word of the text.
+func suggestKeys(text string) []string {
+
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+
+	keys := []string{}
+	prevIsWord := false
+
+	for i, char := range text {
+		isWord := unicode.IsLetter(char) || unicode.IsDigit(char)
+		if isWord && !prevIsWord {
+			keys = append(keys, truncateSuggestKey(text[i:]))
+		}
+		prevIsWord = isWord
+	}
+
+	return keys
+}
+
+func truncateSuggestKey(key string) string {
+	if len(key) <= maxSuggestKey {
+		return key
+	}
+
+	// Don't split a multi-byte character
+	end := maxSuggestKey
+	for end > 0 && !utf8.RuneStart(key[end]) {
+		end--
+	}
+	return key[:end]
+}
+
+// add inserts a suggestion into the index.
+func (si *suggestIndex) add(s suggestion) {
+
+	si.Lock()
+	defer si.Unlock()
+
+	for _, key := range s.keys() {
+		i := sort.Search(len(si.entries), func(i int) bool { return si.entries[i].key >= key })
+		si.entries = append(si.entries, suggestEntry{})
+		copy(si.entries[i+1:], si.entries[i:])
+		si.entries[i] = suggestEntry{key, &s}
+
+		if si.rebuilding {
+			si.pending = append(si.pending, suggestEntry{key, &s})
+		}
+	}
+}
+
+// removeAccount removes an account and its refs from the index.
+func (si *suggestIndex) removeAccount(id string) {
+
+	si.Lock()
+	defer si.Unlock()
+
+	matches := func(s *suggestion) bool {
+		return s.ID == id || strings.HasPrefix(s.ID, id+"/")
+	}
+
+	si.entries = filterSuggestEntries(si.entries, matches)
+
+	if si.rebuilding {
+		si.pending = filterSuggestEntries(si.pending, matches)
+		si.removed[id] = struct{}{}
+		si.removedAccounts = append(si.removedAccounts, id)
+	}
+}
+
+// remove removes a ref from the index.
+func (si *suggestIndex) remove(id string) {
+
+	si.Lock()
+	defer si.Unlock()
+
+	matches := func(s *suggestion) bool {
+		return s.ID == id
+	}
+
+	si.entries = filterSuggestEntries(si.entries, matches)
+
+	if si.rebuilding {
+		si.pending = filterSuggestEntries(si.pending, matches)
+		si.removed[id] = struct{}{}
+	}
+}
+
+// filterSuggestEntries removes the entries of matching suggestions (in place).
+func filterSuggestEntries(entries []suggestEntry, matches func(*suggestion) bool) []suggestEntry {
+	out := entries[:0]
+	for _, e := range entries {
+		if !matches(e.s) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// startRebuild records the suggestions added and removed until replace is called.
+func (si *suggestIndex) startRebuild() {
+	si.Lock()
+	si.rebuilding = true
+	si.pending = nil
+	si.removed = map[string]struct{}{}
+	si.removedAccounts = nil
+	si.Unlock()
+}
+
+// endRebuild stops recording suggestions.
+func (si *suggestIndex) endRebuild() {
+	si.Lock()
+	si.rebuilding = false
+	si.pending = nil
+	si.removed = nil
+	si.removedAccounts = nil
+	si.Unlock()
+}
+
+// replace swaps the contents of the index. Suggestions added since startRebuild are kept and
+// suggestions removed since startRebuild are dropped from the rebuilt entries (which may have
+// been loaded before they were removed).
+func (si *suggestIndex) replace(entries []suggestEntry) {
+
+	si.Lock()
+	defer si.Unlock()
+
+	entries = filterSuggestEntries(entries, func(s *suggestion) bool {
+		if _, removed := si.removed[s.ID]; removed {
+			return true
+		}
+		for _, id := range si.removedAccounts {
+			if strings.HasPrefix(s.ID, id+"/") {
+				return true
+			}
+		}
+		return false
+	})
+
+	// Suggestions removed and then added again are in pending
+	entries = append(entries, si.pending...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	si.entries = entries
+	si.pending = nil
+}
+
+// find returns up to n suggestions that start with the prefix. Suggestions that start with the
+// prefix (rather than containing a word that starts with it) and shorter suggestions are ranked first.
+func (si *suggestIndex) find(prefix string, n int) []suggestion {
+
+	prefix = truncateSuggestKey(strings.ToLower(strings.Join(strings.Fields(prefix), " ")))
+
+	out := []suggestion{}
+	if prefix == "" {
+		return out
+	}
+
+	// Only a limited number of matches are ranked so that short prefixes are fast
+	const maxCandidates = 500
+
+	si.RLock()
+	candidates := []*suggestion{}
+	seen := map[string]struct{}{} // a suggestion may be indexed more than once during a rebuild
+	i := sort.Search(len(si.entries), func(i int) bool { return si.entries[i].key >= prefix })
+	for ; i < len(si.entries) && len(candidates) < maxCandidates; i++ {
+		if !strings.HasPrefix(si.entries[i].key, prefix) {
+			break
+		}
+		if _, exists := seen[si.entries[i].s.ID]; !exists {
+			seen[si.entries[i].s.ID] = struct{}{}
+			candidates = append(candidates, si.entries[i].s)
+		}
+	}
+	si.RUnlock()
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		pi := strings.HasPrefix(strings.ToLower(candidates[i].Title), prefix)
+		pj := strings.HasPrefix(strings.ToLower(candidates[j].Title), prefix)
+		if pi != pj {
+			return pi
+		}
+		return len(candidates[i].Title) < len(candidates[j].Title)
+	})
+
+	for _, s := range candidates {
+		if len(out) == n {
+			break
+		}
+		out = append(out, *s)
+	}
+
+	return out
+}
+
+// suggestRef adds a new ref to the suggest index if it is searchable and has a title.
+func suggestRef(id string, searchable bool, title *string) {
+	if searchable && title != nil && strings.TrimSpace(*title) != "" {
+		suggestions.add(suggestion{Type: "ref", ID: id, Title: *title})
+	}
+}
+
+// suggestAccount adds a new (validated) account to the suggest index.
+func suggestAccount(name string) {
+	suggestions.add(suggestion{Type: "account", ID: "@" + name, Title: name})
+}
+
+// startSuggestIndex builds the suggest index in the background and rebuilds it daily.
+func startSuggestIndex() {
+	go func() {
+		for {
+			if err := rebuildSuggestIndex(context.Background()); err != nil {
+				log.Println(fmt.Sprintf("suggest index: %v", err))
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+// rebuildSuggestIndex loads all searchable ref titles and validated account names.
+func rebuildSuggestIndex(ctx context.Context) error {
+
+	suggestions.startRebuild()
+	defer suggestions.endRebuild()
+
+	entries := []suggestEntry{}
+
+	add := func(s suggestion) {
+		for _, key := range s.keys() {
+			entries = append(entries, suggestEntry{key, &s})
+		}
+	}
+
+	// Refs
+	after := "0x0"
+	for {
+		q := `
+			{
+				refs(func: eq(node.searchable, true), first: 1000, after: %s) @filter(has(node.search_title)) @normalize {
+					uid: uid
+					node.owner {
+						name: user.name
+					}
+					id: node.hashid
+					title: node.search_title
+				}
+			}
+		`
+
+		resp, err := dg.NewReadOnlyTxn().Query(ctx, fmt.Sprintf(q, after))
+		if err != nil {
+			return err
+		}
+
+		type Root struct {
+			Refs []struct {
+				UID   string  `json:"uid"`
+				Name  *string `json:"name"`
+				ID    string  `json:"id"`
+				Title string  `json:"title"`
+			} `json:"refs"`
+		}
+
+		var root Root
+		err = json.Unmarshal(resp.Json, &root)
+		if err != nil {
+			return err
+		}
+
+		if len(root.Refs) == 0 {
+			break
+		}
+
+		for _, r := range root.Refs {
+			id := r.ID
+			if r.Name != nil {
+				id = "@" + *r.Name + "/" + id
+			}
+			add(suggestion{Type: "ref", ID: id, Title: r.Title})
+		}
+
+		after = root.Refs[len(root.Refs)-1].UID
+	}
+
+	// Accounts
+	const q = `
+		{
+			accounts(func: eq(user.validated, true)) @filter(NOT has(user.deleted_at)) {
+				user.name
+			}
+		}
+	`
+
+	resp, err := dg.NewReadOnlyTxn().Query(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	type Root struct {
+		Accounts []struct {
+			Name string `json:"user.name"`
+		} `json:"accounts"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range root.Accounts {
+		add(suggestion{Type: "account", ID: "@" + a.Name, Title: a.Name})
+	}
+
+	suggestions.replace(entries)
+
+	return nil
+}
+
+// suggestHandler returns ref titles and account names that start with the typed prefix.
+// eg. /suggest?q=graph%20th&n=5
+func suggestHandler(c echo.Context) error {
+
+	n := 10
+	if val := c.QueryParam("n"); val != "" {
+		_n, err := strconv.Atoi(val)
+		if err != nil || _n <= 0 || _n > 50 {
+			return c.JSON(http.StatusBadRequest, ErrorFmt("n query param must be between 1 and 50"))
+		}
+		n = _n
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"suggestions": suggestions.find(c.QueryParam("q"), n),
+	})
+}
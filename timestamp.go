@@ -0,0 +1,542 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/protos/api"
+	"github.com/labstack/echo"
+)
+
+// Trusted timestamping (RFC 3161)
+//
+// When a TSA url is configured, the content hash of every new ref is sent to the
+// Time Stamping Authority. The returned timestamp token is stored on the ref as evidence
+// that the ref existed at the time stated by the TSA (not the server's clock).
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+)
+
+// refTimestamp is a timestamp token issued by a TSA for a ref's content hash.
+type refTimestamp struct {
+	Time  time.Time `json:"time"`
+	Token string    `json:"token"` // base64 encoded DER
+
+	// Hash is the content hash that was timestamped. It differs from the ref's current hash
+	// if the ids of the ref or its parents have changed (eg. an owner's account was deleted).
+	Hash string `json:"hash,omitempty"`
+}
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional,default:false"`
+}
+
+type tsaResponse struct {
+	Status struct {
+		Status       int
+		StatusString []string       `asn1:"optional,utf8"`
+		FailInfo     asn1.BitString `asn1:"optional"`
+	}
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Accuracy       struct {
+		Seconds int `asn1:"optional"`
+		Millis  int `asn1:"optional,tag:0"`
+		Micros  int `asn1:"optional,tag:1"`
+	} `asn1:"optional"`
+	Ordering   bool          `asn1:"optional,default:false"`
+	Nonce      *big.Int      `asn1:"optional"`
+	TSA        asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     []byte `asn1:"explicit,optional,tag:0"`
+	}
+	Certificates asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs         asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos  []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// timestampVerification is the result of verifying a timestamp token.
+type timestampVerification struct {
+	Time         time.Time `json:"time"`
+	SerialNumber string    `json:"serial_number"`
+	Policy       string    `json:"policy"`
+	TSA          string    `json:"tsa"`
+
+	// Trusted is true if the TSA's certificate chains to one of the configured TSA roots.
+	Trusted bool `json:"trusted"`
+}
+
+var tsaRoots *x509.CertPool
+
+func init() {
+	if tsaRootsFile == "" {
+		return
+	}
+
+	pem, err := ioutil.ReadFile(tsaRootsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tsaRoots = x509.NewCertPool()
+	if !tsaRoots.AppendCertsFromPEM(pem) {
+		log.Fatal("TSA_ROOTS_FILE contains no certificates")
+	}
+}
+
+// requestTimestamp obtains a timestamp token for a (hex encoded) sha256 content hash
+// from the configured TSA.
+func requestTimestamp(ctx context.Context, contentHash string) (*refTimestamp, error) {
+
+	digest, err := hex.DecodeString(contentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := asn1.Marshal(tsaRequest{
+		Version: 1,
+		MessageImprint: tsaMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(tsaTimeout)*time.Millisecond)
+	defer cancel()
+
+	httpReq, err := http.NewRequest(http.MethodPost, tsaURL, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/timestamp-query")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tsa responded with status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tsr tsaResponse
+	_, err = asn1.Unmarshal(body, &tsr)
+	if err != nil {
+		return nil, fmt.Errorf("tsa response is malformed: %v", err)
+	}
+
+	// 0 = granted, 1 = granted with modifications
+	if tsr.Status.Status > 1 {
+		return nil, fmt.Errorf("tsa rejected request (status %d): %s", tsr.Status.Status, strings.Join(tsr.Status.StatusString, "; "))
+	}
+
+	token := tsr.TimeStampToken.FullBytes
+
+	info, _, err := parseTimestampToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Nonce == nil || info.Nonce.Cmp(nonce) != 0 {
+		return nil, errors.New("tsa response nonce does not match request")
+	}
+
+	_, err = verifyTimestampToken(token, contentHash, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &refTimestamp{
+		Time:  info.GenTime.UTC(),
+		Token: base64.StdEncoding.EncodeToString(token),
+	}, nil
+}
+
+// parseTimestampToken extracts the TSTInfo and SignedData from a timestamp token.
+func parseTimestampToken(token []byte) (*tstInfo, *cmsSignedData, error) {
+
+	var ci cmsContentInfo
+	_, err := asn1.Unmarshal(token, &ci)
+	if err != nil {
+		return nil, nil, fmt.Errorf("timestamp token is malformed: %v", err)
+	}
+
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, errors.New("timestamp token is not signed data")
+	}
+
+	var sd cmsSignedData
+	_, err = asn1.Unmarshal(ci.Content.Bytes, &sd)
+	if err != nil {
+		return nil, nil, fmt.Errorf("timestamp token is malformed: %v", err)
+	}
+
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, nil, errors.New("timestamp token does not contain TSTInfo")
+	}
+
+	var info tstInfo
+	_, err = asn1.Unmarshal(sd.EncapContentInfo.EContent, &info)
+	if err != nil {
+		return nil, nil, fmt.Errorf("timestamp token is malformed: %v", err)
+	}
+
+	return &info, &sd, nil
+}
+
+// verifyTimestampToken checks that a timestamp token was issued for the (hex encoded) sha256
+// content hash and that it was signed by the certificate embedded within it.
+// If roots is provided, the certificate must also chain to one of the roots.
+func verifyTimestampToken(token []byte, contentHash string, roots *x509.CertPool) (*timestampVerification, error) {
+
+	info, sd, err := parseTimestampToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, err := hex.DecodeString(contentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.MessageImprint.HashAlgorithm.Algorithm.Equal(oidSHA256) || !bytes.Equal(info.MessageImprint.HashedMessage, digest) {
+		return nil, errors.New("timestamp token was not issued for the ref's content")
+	}
+
+	if len(sd.SignerInfos) != 1 {
+		return nil, errors.New("timestamp token must have exactly one signer")
+	}
+	si := sd.SignerInfos[0]
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp token certificates are malformed: %v", err)
+	}
+
+	signer := findSignerCertificate(certs, si.SID)
+	if signer == nil {
+		return nil, errors.New("timestamp token does not contain the signer's certificate")
+	}
+
+	hash, err := digestAlgorithmHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the signed attributes, which include a digest of the TSTInfo
+	if len(si.SignedAttrs.Bytes) == 0 {
+		return nil, errors.New("timestamp token has no signed attributes")
+	}
+
+	h := hash.New()
+	h.Write(sd.EncapContentInfo.EContent)
+	eContentDigest := h.Sum(nil)
+
+	messageDigestFound := false
+	rest := si.SignedAttrs.Bytes
+	for len(rest) > 0 {
+		var attr cmsAttribute
+		rest, err = asn1.Unmarshal(rest, &attr)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp token signed attributes are malformed: %v", err)
+		}
+
+		switch {
+		case attr.Type.Equal(oidMessageDigest):
+			var md []byte
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &md); err != nil || !bytes.Equal(md, eContentDigest) {
+				return nil, errors.New("timestamp token message digest does not match")
+			}
+			messageDigestFound = true
+		case attr.Type.Equal(oidContentType):
+			var ct asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &ct); err != nil || !ct.Equal(oidTSTInfo) {
+				return nil, errors.New("timestamp token content type does not match")
+			}
+		}
+	}
+
+	if !messageDigestFound {
+		return nil, errors.New("timestamp token has no message digest")
+	}
+
+	// Signed attributes are signed with their universal SET tag rather than the implicit [0]
+	signed := append([]byte{}, si.SignedAttrs.FullBytes...)
+	signed[0] = asn1.TagSet | 0x20
+
+	algo, err := signatureAlgorithm(signer, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = signer.CheckSignature(algo, signed, si.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("timestamp token signature is invalid: %v", err)
+	}
+
+	v := &timestampVerification{
+		Time:         info.GenTime.UTC(),
+		SerialNumber: info.SerialNumber.String(),
+		Policy:       info.Policy.String(),
+		TSA:          signer.Subject.String(),
+	}
+
+	if roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs {
+			intermediates.AddCert(cert)
+		}
+
+		_, err = signer.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   info.GenTime,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		})
+		v.Trusted = err == nil
+	}
+
+	return v, nil
+}
+
+// findSignerCertificate returns the certificate identified by a SignerInfo's sid.
+func findSignerCertificate(certs []*x509.Certificate, sid asn1.RawValue) *x509.Certificate {
+
+	if sid.Class == asn1.ClassContextSpecific && sid.Tag == 0 {
+		// subjectKeyIdentifier
+		for _, cert := range certs {
+			if bytes.Equal(cert.SubjectKeyId, sid.Bytes) {
+				return cert
+			}
+		}
+		return nil
+	}
+
+	// issuerAndSerialNumber
+	var ias struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}
+	_, err := asn1.Unmarshal(sid.FullBytes, &ias)
+	if err != nil {
+		return nil
+	}
+
+	for _, cert := range certs {
+		if cert.SerialNumber.Cmp(ias.SerialNumber) == 0 && bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+func digestAlgorithmHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm: %s", oid)
+}
+
+func signatureAlgorithm(cert *x509.Certificate, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+
+	switch cert.PublicKeyAlgorithm {
+	case x509.RSA:
+		switch hash {
+		case crypto.SHA1:
+			return x509.SHA1WithRSA, nil
+		case crypto.SHA256:
+			return x509.SHA256WithRSA, nil
+		case crypto.SHA384:
+			return x509.SHA384WithRSA, nil
+		case crypto.SHA512:
+			return x509.SHA512WithRSA, nil
+		}
+	case x509.ECDSA:
+		switch hash {
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1, nil
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256, nil
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384, nil
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512, nil
+		}
+	case x509.Ed25519:
+		return x509.PureEd25519, nil
+	}
+
+	return x509.UnknownSignatureAlgorithm, errors.New("unsupported tsa signature algorithm")
+}
+
+// timestampRef obtains a timestamp token for a ref's content hash and stores it on the ref.
+func timestampRef(ctx context.Context, uid, contentHash string) error {
+
+	ts, err := requestTimestamp(ctx, contentHash)
+	if err != nil {
+		return err
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	data := map[string]interface{}{
+		"uid":                  uid,
+		"node.timestamp":       ts.Time,
+		"node.timestamp_token": ts.Token,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit(ctx)
+}
+
+// verifyTimestampHandler verifies the timestamp token of a ref against the content hash stored
+// when the ref was created. content_matches reports whether the ref's current content still
+// has that hash (eg. it changes if the owner's account is deleted).
+func verifyTimestampHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	nodeID, _, _ := splitRefPath(c.Param("*"))
+
+	txn := dg.NewReadOnlyTxn()
+
+	uid, err := lookupRef(ctx, txn, nodeID)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if uid == "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("can't find ref"))
+	}
+
+	refs, err := loadBundleRefs(ctx, txn, []string{uid})
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	br := refs[uid]
+	if br.Timestamp == nil {
+		return c.JSON(http.StatusNotFound, ErrorFmt("ref has no timestamp"))
+	}
+
+	// Imported refs don't have a stored content hash (see loadBundleRefs)
+	hash := br.Timestamp.Hash
+	matches := hash == br.Hash
+
+	token, err := base64.StdEncoding.DecodeString(br.Timestamp.Token)
+	if err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{"valid": false, "hash": hash, "content_matches": matches, "error": "timestamp token is malformed"})
+	}
+
+	v, err := verifyTimestampToken(token, hash, tsaRoots)
+	if err != nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{"valid": false, "hash": hash, "content_matches": matches, "error": err.Error()})
+	}
+
+	return c.JSONPretty(http.StatusOK, map[string]interface{}{
+		"valid":           true,
+		"hash":            hash,
+		"content_matches": matches,
+		"timestamp":       v,
+	}, "  ")
+}
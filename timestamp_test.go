@@ -0,0 +1,351 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTSA is a local stand-in for a Time Stamping Authority. Its certificate is issued by a
+// test root.
+type testTSA struct {
+	root *x509.Certificate
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	// nonce and digest replace the nonce and hashed message of requests (if set)
+	nonce  *big.Int
+	digest []byte
+}
+
+func newTestTSA(t *testing.T) *testTSA {
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rootTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test TSA Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTmpl, rootTmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, &key.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testTSA{root: root, cert: cert, key: key}
+}
+
+// token returns a timestamp token for a request.
+func (tsa *testTSA) token(req tsaRequest) ([]byte, error) {
+
+	info := tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3, 4},
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   big.NewInt(7),
+		GenTime:        time.Now().UTC().Truncate(time.Second),
+		Nonce:          req.Nonce,
+	}
+
+	if tsa.nonce != nil {
+		info.Nonce = tsa.nonce
+	}
+	if tsa.digest != nil {
+		info.MessageImprint.HashedMessage = tsa.digest
+	}
+
+	infoDER, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	// Signed attributes
+	set := func(b []byte) asn1.RawValue {
+		return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: b}
+	}
+
+	contentType, err := asn1.Marshal(oidTSTInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(infoDER)
+	messageDigest, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []byte{}
+	for _, a := range []cmsAttribute{{oidContentType, set(contentType)}, {oidMessageDigest, set(messageDigest)}} {
+		der, err := asn1.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, der...)
+	}
+
+	signed, err := asn1.Marshal(set(attrs))
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(signed)
+	signature, err := ecdsa.SignASN1(rand.Reader, tsa.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sid, err := asn1.Marshal(struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}{asn1.RawValue{FullBytes: tsa.cert.RawIssuer}, tsa.cert.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+
+	sd := cmsSignedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsa.cert.Raw},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			Signature:          signature,
+		}},
+	}
+	sd.EncapContentInfo.EContentType = oidTSTInfo
+	sd.EncapContentInfo.EContent = infoDER
+
+	sdDER, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdDER},
+	})
+}
+
+func (tsa *testTSA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req tsaRequest
+	if _, err := asn1.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, err := tsa.token(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := asn1.Marshal(tsaResponse{TimeStampToken: asn1.RawValue{FullBytes: token}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(resp)
+}
+
+// withTestTSA points tsaURL at a local TSA for the duration of a test.
+func withTestTSA(t *testing.T, tsa *testTSA) {
+
+	srv := httptest.NewServer(tsa)
+	prev := tsaURL
+	tsaURL = srv.URL
+
+	t.Cleanup(func() {
+		tsaURL = prev
+		srv.Close()
+	})
+}
+
+func testContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRequestTimestamp(t *testing.T) {
+
+	tsa := newTestTSA(t)
+	withTestTSA(t, tsa)
+
+	hash := testContentHash("ref")
+
+	ts, err := requestTimestamp(context.Background(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := base64.StdEncoding.DecodeString(ts.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tsa.root)
+
+	v, err := verifyTimestampToken(token, hash, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.Trusted {
+		t.Error("expected the token to be trusted")
+	}
+
+	if v.TSA != tsa.cert.Subject.String() {
+		t.Errorf("tsa = %q, want %q", v.TSA, tsa.cert.Subject.String())
+	}
+
+	if !v.Time.Equal(ts.Time) {
+		t.Errorf("time = %v, want %v", v.Time, ts.Time)
+	}
+}
+
+func TestRequestTimestampNonceMismatch(t *testing.T) {
+
+	tsa := newTestTSA(t)
+	tsa.nonce = big.NewInt(1)
+	withTestTSA(t, tsa)
+
+	_, err := requestTimestamp(context.Background(), testContentHash("ref"))
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("err = %v, want a nonce mismatch", err)
+	}
+}
+
+func TestRequestTimestampHashMismatch(t *testing.T) {
+
+	tsa := newTestTSA(t)
+	other := sha256.Sum256([]byte("other ref"))
+	tsa.digest = other[:]
+	withTestTSA(t, tsa)
+
+	_, err := requestTimestamp(context.Background(), testContentHash("ref"))
+	if err == nil || !strings.Contains(err.Error(), "content") {
+		t.Fatalf("err = %v, want a content hash mismatch", err)
+	}
+}
+
+func TestVerifyTimestampToken(t *testing.T) {
+
+	tsa := newTestTSA(t)
+	withTestTSA(t, tsa)
+
+	hash := testContentHash("ref")
+
+	ts, err := requestTimestamp(context.Background(), hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := base64.StdEncoding.DecodeString(ts.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token is only valid for the hash that was timestamped
+	if _, err := verifyTimestampToken(token, testContentHash("other ref"), nil); err == nil {
+		t.Error("expected a token for another hash to be rejected")
+	}
+
+	// The signature is at the end of the token
+	tampered := append([]byte{}, token...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := verifyTimestampToken(tampered, hash, nil); err == nil {
+		t.Error("expected a tampered token to be rejected")
+	}
+
+	// A valid token that does not chain to a configured root is not trusted
+	untrusted := newTestTSA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(untrusted.root)
+
+	v, err := verifyTimestampToken(token, hash, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Trusted {
+		t.Error("expected a token from an untrusted root not to be trusted")
+	}
+
+	// Trust is only checked if roots are configured
+	v, err = verifyTimestampToken(token, hash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Trusted {
+		t.Error("expected trusted to be false without roots")
+	}
+}
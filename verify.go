@@ -6,43 +6,49 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"golang.org/x/xerrors"
-	"hash/crc32"
 	"log"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/dgraph-io/dgo"
 	"github.com/dgraph-io/dgo/protos/api"
 	"github.com/labstack/echo"
-	"github.com/myesui/uuid"
 	"gopkg.in/gomail.v2"
 )
 
 func init() {
 	go func() {
-		c := time.Tick(24 * time.Hour) // Run daily
+		c := time.Tick(time.Duration(cleanupInterval) * time.Hour)
 		for range c {
 			cleanup(context.Background())
 		}
 	}()
 }
 
-// cleanup will remove all nodes that have not been activated for 48 hours.
+// cleanup will remove all accounts that have not been activated before their verification
+// code expired. Accounts created before verification codes expired are removed once they are
+// older than the verification window.
 func cleanup(ctx context.Context) {
 
 	txn := dg.NewTxn()
 	defer txn.Discard(ctx)
 
+	now := time.Now().UTC()
+
 	vars := map[string]string{
-		"$dt": time.Now().UTC().Add(-2 * 24 * time.Hour).Format(time.RFC3339),
+		"$now": now.Format(time.RFC3339),
+		"$dt":  now.Add(-time.Duration(verificationExpiry) * time.Hour).Format(time.RFC3339),
 	}
 
 	const q = `
-		query withvar($dt: string) {
-			find_users(func: eq(user.validated, false)) @filter(le(user.created_at, $dt))
+		query withvar($now: string, $dt: string) {
+			find_users(func: eq(user.validated, false)) @filter(le(user.code_expires_at, $now) OR (NOT has(user.code_expires_at) AND le(user.created_at, $dt)))
 			{
 				uid
 			}
@@ -89,27 +95,56 @@ func cleanup(ctx context.Context) {
 
 func sendEmail(email, code string) error {
 
+	url := fmt.Sprintf("%s/verify/%s", serverHostUrl, code)
+
+	return deliverEmail(email, "Activate Lemma Chain Account", fmt.Sprintf("Click on the link within %d hours to activate account: ", verificationExpiry)+fmt.Sprintf("<a href=\"%s\">%s</a>", url, url))
+}
+
+// sendEmailChange sends the link that confirms a new email address for an account.
+func sendEmailChange(email, code string) error {
+
+	url := fmt.Sprintf("%s/verify/%s", serverHostUrl, code)
+
+	return deliverEmail(email, "Confirm Lemma Chain Email Address", fmt.Sprintf("Click on the link within %d hours to use this email address for your account: ", verificationExpiry)+fmt.Sprintf("<a href=\"%s\">%s</a>", url, url))
+}
+
+// newVerificationCode returns a random code for a verification link and when it expires.
+func newVerificationCode() (string, time.Time, error) {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return hex.EncodeToString(b), time.Now().UTC().Add(time.Duration(verificationExpiry) * time.Hour), nil
+}
+
+// emailConfigured returns true if emails can be sent (both gmailAccount and gmailPassword are set).
+func emailConfigured() bool {
+	return strings.TrimSpace(gmailAccount) != "" && strings.TrimSpace(gmailPassword) != ""
+}
+
+// deliverEmail sends a html email using the gmail account.
+func deliverEmail(email, subject, body string) error {
+
 	gmailAccount := gmailAccount
 	if !strings.Contains(gmailAccount, "@") {
 		gmailAccount = gmailAccount + "@gmail.com"
 	}
 
-	url := fmt.Sprintf("%s/verify/%s", serverHostUrl, code)
-
 	m := gomail.NewMessage()
 	m.SetHeader("From", gmailAccount)
 	m.SetHeader("To", email)
-	m.SetHeader("Subject", "Activate Lemma Chain Account")
-	m.SetBody("text/html", "Click on the link within 48 hours to activate account: "+fmt.Sprintf("<a href=\"%s\">%s</a>", url, url))
+	m.SetHeader("Subject", subject)
+	m.SetBody("text/html", body)
 
 	d := gomail.NewDialer(smtpHost, smtpPort, gmailAccount, gmailPassword)
 
-	// Send the email to Bob, Cora and Dan.
 	err := d.DialAndSend(m)
 	return err
 }
 
-// verifyHandler is used to verify account creation
+// verifyHandler is used to verify account creation and email address changes
 func verifyHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -130,6 +165,10 @@ func verifyHandler(c echo.Context) error {
 		query withvar($code: string) {
 			nodes(func: eq(user.code, $code))  {
 				uid
+				user.name
+				user.pending_email
+				user.code_expires_at
+				user.created_at
 			}
 		}
 	`
@@ -142,7 +181,11 @@ func verifyHandler(c echo.Context) error {
 
 	type Root struct {
 		Nodes []struct {
-			UID string `json:"uid"`
+			UID          string     `json:"uid"`
+			Name         string     `json:"user.name"`
+			PendingEmail *string    `json:"user.pending_email"`
+			ExpiresAt    *time.Time `json:"user.code_expires_at"`
+			CreatedAt    time.Time  `json:"user.created_at"`
 		} `json:"nodes"`
 	}
 
@@ -157,22 +200,238 @@ func verifyHandler(c echo.Context) error {
 		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?activated=0", website))
 	}
 
+	// Codes issued before codes expired are valid for the verification window after the
+	// account was created
+	expiresAt := root.Nodes[0].CreatedAt.Add(time.Duration(verificationExpiry) * time.Hour)
+	if root.Nodes[0].ExpiresAt != nil {
+		expiresAt = *root.Nodes[0].ExpiresAt
+	}
+	expired := time.Now().UTC().After(expiresAt)
+
+	if root.Nodes[0].PendingEmail != nil {
+		if expired {
+			return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?email_changed=0", website))
+		}
+		return verifyEmailChange(c, txn, root.Nodes[0].UID, *root.Nodes[0].PendingEmail)
+	}
+
+	if expired {
+		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?activated=0", website))
+	}
+
 	// Update node as active
 	data := struct {
 		UID       string `json:"uid"`
-		Code      string `json:"user.code"`
 		Validated bool   `json:"user.validated"`
 	}{
 		root.Nodes[0].UID,
-		fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(uuid.NewV4().String()))),
 		true,
 	}
 
-	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	// The code can only be used once
+	del := map[string]interface{}{
+		"uid":                  root.Nodes[0].UID,
+		"user.code":            nil,
+		"user.code_expires_at": nil,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data), DeleteJson: marshal(del)})
+	if err != nil {
+		log.Println(err)
+		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?activated=0", website))
+	}
+
+	err = txn.Commit(ctx)
 	if err != nil {
 		log.Println(err)
 		return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?activated=0", website))
 	}
 
+	suggestAccount(root.Nodes[0].Name)
+
 	return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?activated=1", website))
 }
+
+// verifyEmailChange switches the email address of an account to the pending email address.
+func verifyEmailChange(c echo.Context, txn *dgo.Txn, uid, email string) error {
+	ctx := c.Request().Context()
+
+	failed := fmt.Sprintf("%s?email_changed=0", website)
+
+	// Check the email address has not been taken since the change was requested
+	vars := map[string]string{
+		"$email": email,
+	}
+
+	const q = `
+		query withvar($email: string) {
+			user_check(func: eq(user.email, $email)) {
+				uid
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.Redirect(http.StatusTemporaryRedirect, failed)
+	}
+
+	type Root struct {
+		Check []struct {
+			UID string `json:"uid"`
+		} `json:"user_check"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.Redirect(http.StatusTemporaryRedirect, failed)
+	}
+
+	if len(root.Check) != 0 {
+		return c.Redirect(http.StatusTemporaryRedirect, failed)
+	}
+
+	set := struct {
+		UID   string `json:"uid"`
+		Email string `json:"user.email"`
+	}{
+		uid,
+		email,
+	}
+
+	del := map[string]interface{}{
+		"uid":                  uid,
+		"user.pending_email":   nil,
+		"user.code":            nil,
+		"user.code_expires_at": nil,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(set), DeleteJson: marshal(del)})
+	if err != nil {
+		log.Println(err)
+		return c.Redirect(http.StatusTemporaryRedirect, failed)
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+		return c.Redirect(http.StatusTemporaryRedirect, failed)
+	}
+
+	// Cached logins by the old email address must not work
+	revokeLogins(uid)
+
+	return c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s?email_changed=1", website))
+}
+
+type resendVerification struct {
+	Email string `json:"email" form:"email"`
+}
+
+// resendVerificationHandler sends a new activation link to an account that has not been
+// activated. A link can only be requested once every RESEND_VERIFICATION_MINUTES per email
+// (further requests are silently ignored). The response does not reveal whether an account
+// exists, so the same response is returned once the email address has been checked.
+func resendVerificationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	rv := new(resendVerification)
+	if err := c.Bind(rv); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorFmt(err))
+	}
+
+	email := strings.ToLower(strings.TrimSpace(rv.Email))
+	if email == "" {
+		return c.JSON(http.StatusBadRequest, ErrorFmt("email must not be empty"))
+	}
+
+	txn := dg.NewTxn()
+	defer txn.Discard(ctx)
+
+	vars := map[string]string{
+		"$email": email,
+	}
+
+	const q = `
+		query withvar($email: string) {
+			user_check(func: eq(user.email, $email), first: 1) @filter(eq(user.validated, false)) {
+				uid
+				user.code_sent_at
+			}
+		}
+	`
+
+	resp, err := txn.QueryWithVars(ctx, q, vars)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	type Root struct {
+		Check []struct {
+			UID    string     `json:"uid"`
+			SentAt *time.Time `json:"user.code_sent_at"`
+		} `json:"user_check"`
+	}
+
+	var root Root
+	err = json.Unmarshal(resp.Json, &root)
+	if err != nil {
+		log.Println(err)
+		return c.JSON(http.StatusInternalServerError, ErrorFmt("something went wrong. Try again"))
+	}
+
+	if len(root.Check) == 0 {
+		// Account doesn't exist or is already activated
+		return c.NoContent(http.StatusOK)
+	}
+
+	now := time.Now().UTC()
+
+	if sentAt := root.Check[0].SentAt; sentAt != nil {
+		if now.Before(sentAt.Add(time.Duration(resendVerificationInterval) * time.Minute)) {
+			// An activation email was sent recently
+			return c.NoContent(http.StatusOK)
+		}
+	}
+
+	code, expiresAt, err := newVerificationCode()
+	if err != nil {
+		log.Println(err)
+		return c.NoContent(http.StatusOK)
+	}
+
+	data := struct {
+		UID       string    `json:"uid"`
+		Code      string    `json:"user.code"`
+		ExpiresAt time.Time `json:"user.code_expires_at"`
+		SentAt    time.Time `json:"user.code_sent_at"`
+	}{
+		root.Check[0].UID,
+		code,
+		expiresAt,
+		now,
+	}
+
+	_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(data)})
+	if err != nil {
+		log.Println(err)
+		return c.NoContent(http.StatusOK)
+	}
+
+	err = sendEmail(email, code)
+	if err != nil {
+		log.Println(err)
+		return c.NoContent(http.StatusOK)
+	}
+
+	err = txn.Commit(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,34 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import "testing"
+
+func TestEmailConfigured(t *testing.T) {
+
+	prevAccount, prevPassword := gmailAccount, gmailPassword
+	defer func() {
+		gmailAccount, gmailPassword = prevAccount, prevPassword
+	}()
+
+	tests := []struct {
+		account  string
+		password string
+		want     bool
+	}{
+		{"", "", false},
+		{"lemma", "", false},
+		{"", "secret", false},
+		{" ", "secret", false},
+		{"lemma", "secret", true},
+	}
+
+	for _, tt := range tests {
+		gmailAccount, gmailPassword = tt.account, tt.password
+		if got := emailConfigured(); got != tt.want {
+			t.Errorf("emailConfigured() with account %q and password %q = %v, want %v", tt.account, tt.password, got, tt.want)
+		}
+	}
+}
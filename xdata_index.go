@@ -0,0 +1,432 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/protos/api"
+)
+
+// Selected fields of a ref's data payload can be indexed into typed predicates so that refs
+// can be queried by them (see queryHandler). Text fields are also matched by search terms
+// (see searchHandler).
+//
+// XDATA_INDEX is a comma separated list of fields in the form name=path:type.
+// eg. "year=year:int,author=authors[*].name:term,doi=doi:exact,keywords:text"
+//
+// The path selects values within the data payload. Object keys are separated by "." and
+// "[*]" selects every element of an array. If "name=" is omitted, the name is derived from the path.
+//
+// Supported types are: int, float, bool, datetime, exact (string equality and ranges),
+// term (string matching any or all terms) and text (full-text search).
+
+// xdataField is an indexed field of the data payload.
+type xdataField struct {
+	Name string
+	Path []string
+	Type string
+}
+
+// predicate is the name of the DGraph predicate that stores the field's values.
+func (f xdataField) predicate() string {
+	return "xdata." + f.Name
+}
+
+// xdataFields is initialized with the package variables (rather than by init) because
+// setSchema uses it from main.go's init.
+var xdataFields = mustParseXDataFields()
+
+// xdataFieldTypes maps the supported types to their DGraph schema.
+var xdataFieldTypes = map[string]string{
+	"int":      "[int] @index(int)",
+	"float":    "[float] @index(float)",
+	"bool":     "[bool] @index(bool)",
+	"datetime": "[dateTime] @index(hour)",
+	"exact":    "[string] @index(exact)",
+	"term":     "[string] @index(term)",
+	"text":     "[string] @index(fulltext, trigram)",
+}
+
+var xdataFieldName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+func mustParseXDataFields() []xdataField {
+	fields, err := parseXDataFields(xdataIndexConfig, xdataFieldTypes)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("XDATA_INDEX: %v", err))
+	}
+	return fields
+}
+
+// xdataTextFields returns the fields that are matched by unprefixed search terms.
+func xdataTextFields(fields []xdataField) []xdataField {
+	out := []xdataField{}
+	for _, f := range fields {
+		if f.Type == "text" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// parseXDataFields parses a list of fields in the form name=path:type.
+func parseXDataFields(config string, types map[string]string) ([]xdataField, error) {
+
+	fields := []xdataField{}
+	names := map[string]struct{}{}
+
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		i := strings.LastIndex(entry, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("%s: type is missing", entry)
+		}
+		typ := strings.TrimSpace(entry[i+1:])
+		if _, exists := types[typ]; !exists {
+			return nil, fmt.Errorf("%s: unsupported type %q", entry, typ)
+		}
+
+		name, rawPath := "", entry[:i]
+		if j := strings.Index(rawPath, "="); j != -1 {
+			name, rawPath = strings.TrimSpace(rawPath[:j]), rawPath[j+1:]
+		}
+
+		path, err := parseXDataPath(strings.TrimSpace(rawPath))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry, err)
+		}
+
+		if name == "" {
+			// Derive name from path. eg. authors[*].name => authors_name
+			parts := []string{}
+			for _, p := range path {
+				if p != "[*]" {
+					parts = append(parts, strings.ToLower(p))
+				}
+			}
+			name = strings.Join(parts, "_")
+		}
+
+		if !xdataFieldName.MatchString(name) {
+			return nil, fmt.Errorf("%s: name must be lower case alphanumeric", entry)
+		}
+
+		if _, exists := names[name]; exists {
+			return nil, fmt.Errorf("%s: name is used more than once", entry)
+		}
+		names[name] = struct{}{}
+
+		fields = append(fields, xdataField{Name: name, Path: path, Type: typ})
+	}
+
+	return fields, nil
+}
+
+// parseXDataPath splits a path into object keys and array wildcards.
+// eg. "authors[*].name" returns ["authors", "[*]", "name"].
+func parseXDataPath(path string) ([]string, error) {
+
+	if path == "" {
+		return nil, errors.New("path must not be empty")
+	}
+
+	out := []string{}
+
+	for _, segment := range strings.Split(path, ".") {
+		wildcards := 0
+		for strings.HasSuffix(segment, "[*]") {
+			segment = strings.TrimSuffix(segment, "[*]")
+			wildcards++
+		}
+
+		if segment == "" || strings.ContainsAny(segment, "[]") {
+			return nil, fmt.Errorf("path %q is invalid", path)
+		}
+
+		out = append(out, segment)
+		for i := 0; i < wildcards; i++ {
+			out = append(out, "[*]")
+		}
+	}
+
+	return out, nil
+}
+
+// extractXDataPath returns all values selected by a path. If the selected value is an array,
+// its elements are returned.
+func extractXDataPath(data interface{}, path []string) []interface{} {
+
+	if len(path) == 0 {
+		if arr, ok := data.([]interface{}); ok {
+			out := []interface{}{}
+			for _, v := range arr {
+				if _, nested := v.([]interface{}); !nested {
+					out = append(out, v)
+				}
+			}
+			return out
+		}
+		if data == nil {
+			return nil
+		}
+		return []interface{}{data}
+	}
+
+	switch v := data.(type) {
+	case map[string]interface{}:
+		if path[0] == "[*]" {
+			return nil
+		}
+		return extractXDataPath(v[path[0]], path[1:])
+	case []interface{}:
+		if path[0] != "[*]" {
+			return nil
+		}
+		out := []interface{}{}
+		for _, elem := range v {
+			out = append(out, extractXDataPath(elem, path[1:])...)
+		}
+		return out
+	}
+
+	return nil
+}
+
+// convertXDataValue converts a value from the data payload to the field's type.
+// Values that can't be converted are not indexed.
+func convertXDataValue(typ string, v interface{}) (interface{}, bool) {
+
+	switch typ {
+	case "int":
+		switch x := v.(type) {
+		case float64:
+			if x == math.Trunc(x) && math.Abs(x) < 1<<53 {
+				return int64(x), true
+			}
+		case string:
+			i, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+			return i, err == nil
+		}
+	case "float":
+		switch x := v.(type) {
+		case float64:
+			return x, true
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			return f, err == nil
+		}
+	case "bool":
+		b, ok := v.(bool)
+		return b, ok
+	case "datetime":
+		if x, ok := v.(string); ok {
+			t, err := parseXDataTime(x)
+			return t, err == nil
+		}
+	default:
+		switch x := v.(type) {
+		case string:
+			return x, strings.TrimSpace(x) != ""
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(x), true
+		}
+	}
+
+	return nil, false
+}
+
+// parseXDataTime parses a RFC 3339 date-time, a date or a year.
+func parseXDataTime(s string) (time.Time, error) {
+
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02", "2006-01", "2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%q is not a date", s)
+}
+
+// xdataFieldValues extracts the values of the fields from a (json encoded) data payload.
+// The returned map's key is the predicate.
+func xdataFieldValues(fields []xdataField, xdata string) map[string][]interface{} {
+
+	out := map[string][]interface{}{}
+	if len(fields) == 0 {
+		return out
+	}
+
+	var data interface{}
+	if err := json.Unmarshal([]byte(xdata), &data); err != nil {
+		return out
+	}
+
+	for _, f := range fields {
+		values := []interface{}{}
+		seen := map[interface{}]struct{}{}
+
+		for _, v := range extractXDataPath(data, f.Path) {
+			converted, ok := convertXDataValue(f.Type, v)
+			if !ok {
+				continue
+			}
+
+			if _, exists := seen[converted]; exists {
+				continue
+			}
+			seen[converted] = struct{}{}
+
+			values = append(values, converted)
+		}
+
+		if len(values) > 0 {
+			out[f.predicate()] = values
+		}
+	}
+
+	return out
+}
+
+// xdataFieldsSchema returns the DGraph schema of the fields.
+func xdataFieldsSchema(fields []xdataField, types map[string]string) string {
+	lines := []string{}
+	for _, f := range fields {
+		lines = append(lines, fmt.Sprintf("%s: %s .", f.predicate(), types[f.Type]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// backfillXDataCommand indexes the configured fields for all existing refs.
+// It should be run after XDATA_INDEX is changed.
+func backfillXDataCommand(args []string) error {
+	return backfillRefs("backfill-xdata", func(n backfillNode) (map[string]interface{}, map[string]interface{}) {
+
+		del := map[string]interface{}{"uid": n.UID}
+		set := map[string]interface{}{"uid": n.UID}
+
+		for _, f := range xdataFields {
+			del[f.predicate()] = nil
+		}
+
+		for pred, values := range xdataFieldValues(xdataFields, n.XData) {
+			set[pred] = values
+		}
+
+		return del, set
+	})
+}
+
+// backfillNode is a ref visited by backfillRefs.
+type backfillNode struct {
+	UID      string  `json:"uid"`
+	XData    string  `json:"node.xdata"`
+	Title    *string `json:"node.search_title"`
+	Synopsis *string `json:"node.search_synopsis"`
+	Lang     *string `json:"node.lang"`
+}
+
+// backfillRefs visits all refs in batches. For each ref, update returns the predicates to
+// delete and the predicates to set.
+func backfillRefs(name string, update func(n backfillNode) (map[string]interface{}, map[string]interface{})) error {
+
+	ctx := context.Background()
+	after := "0x0"
+	total := 0
+
+	for {
+		txn := dg.NewTxn()
+
+		q := `
+			{
+				nodes(func: eq(node, true), first: 500, after: %s) {
+					uid
+					node.xdata
+					node.search_title
+					node.search_synopsis
+					node.lang
+				}
+			}
+		`
+
+		resp, err := txn.Query(ctx, fmt.Sprintf(q, after))
+		if err != nil {
+			txn.Discard(ctx)
+			return err
+		}
+
+		type Root struct {
+			Nodes []backfillNode `json:"nodes"`
+		}
+
+		var root Root
+		err = json.Unmarshal(resp.Json, &root)
+		if err != nil {
+			txn.Discard(ctx)
+			return err
+		}
+
+		if len(root.Nodes) == 0 {
+			txn.Discard(ctx)
+			break
+		}
+
+		dels := []map[string]interface{}{}
+		sets := []map[string]interface{}{}
+
+		for _, n := range root.Nodes {
+			del, set := update(n)
+			if len(del) > 1 {
+				dels = append(dels, del)
+			}
+			if len(set) > 1 {
+				sets = append(sets, set)
+			}
+		}
+
+		if len(dels) > 0 {
+			_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: marshal(dels)})
+			if err != nil {
+				txn.Discard(ctx)
+				return err
+			}
+		}
+
+		if len(sets) > 0 {
+			_, err = txn.Mutate(ctx, &api.Mutation{SetJson: marshal(sets)})
+			if err != nil {
+				txn.Discard(ctx)
+				return err
+			}
+		}
+
+		err = txn.Commit(ctx)
+		if err != nil {
+			return err
+		}
+
+		total = total + len(root.Nodes)
+		after = root.Nodes[len(root.Nodes)-1].UID
+
+		log.Println(fmt.Sprintf("%s: %d refs processed", name, total))
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2019
+// The Honest Scoop and P.J. Siripala
+// All rights reserved
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseXDataPath(t *testing.T) {
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"year", []string{"year"}},
+		{"journal.name", []string{"journal", "name"}},
+		{"authors[*].name", []string{"authors", "[*]", "name"}},
+		{"matrix[*][*]", []string{"matrix", "[*]", "[*]"}},
+		{"keywords[*]", []string{"keywords", "[*]"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseXDataPath(tt.path)
+		if err != nil {
+			t.Errorf("parseXDataPath(%q): %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseXDataPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	for _, path := range []string{"", ".", "a..b", "[*]", "a[0]", "a[*]b", "a.[*]", "a]"} {
+		if _, err := parseXDataPath(path); err == nil {
+			t.Errorf("parseXDataPath(%q): expected an error", path)
+		}
+	}
+}